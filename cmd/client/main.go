@@ -45,20 +45,23 @@ func main() {
 			return conf, err
 		}
 
-		if conf.Username == "" {
-			if err := survey.AskOne(&survey.Input{Message: "Please type your username"}, &conf.Username); err != nil {
-				panic(fmt.Errorf("invalid username: %v", err))
+		// 使用客户端证书登录时，由服务端从证书中识别用户身份，使用令牌或 OIDC 登录时由服务端从令牌中识别用户身份
+		if !conf.TLS.HasClientCert() && conf.Token == "" && !conf.OIDCEnabled() {
+			if conf.Username == "" {
+				if err := survey.AskOne(&survey.Input{Message: "Please type your username"}, &conf.Username); err != nil {
+					panic(fmt.Errorf("invalid username: %v", err))
+				}
 			}
-		}
 
-		if conf.Password == "" {
-			if err := survey.AskOne(&survey.Password{Message: "Please type your password"}, &conf.Password); err != nil {
-				panic(fmt.Errorf("invalid password: %v", err))
+			if conf.Password == "" {
+				if err := survey.AskOne(&survey.Password{Message: "Please type your password"}, &conf.Password); err != nil {
+					panic(fmt.Errorf("invalid password: %v", err))
+				}
 			}
-		}
 
-		if conf.Username == "" || conf.Password == "" {
-			panic(fmt.Errorf("username and password are required"))
+			if conf.Username == "" || conf.Password == "" {
+				panic(fmt.Errorf("username and password are required"))
+			}
 		}
 
 		if c.String("server") != "" {
@@ -109,7 +112,19 @@ func ensureConfigFile(defaultConfigFile string) string {
 			panic(fmt.Errorf("invalid server address: %v", err))
 		}
 
-		clientConfData, err := yaml.Marshal(requestServer(serverAddress))
+		// 服务端按用户过滤可以访问的后端，不输入用户名时只返回未限制访问的后端
+		var username, password string
+		if err := survey.AskOne(&survey.Input{Message: "Please type your username (optional)"}, &username); err != nil {
+			panic(fmt.Errorf("invalid username: %v", err))
+		}
+
+		if username != "" {
+			if err := survey.AskOne(&survey.Password{Message: "Please type your password"}, &password); err != nil {
+				panic(fmt.Errorf("invalid password: %v", err))
+			}
+		}
+
+		clientConfData, err := yaml.Marshal(requestServer(serverAddress, username, password))
 		if err != nil {
 			panic(err)
 		}
@@ -122,13 +137,22 @@ func ensureConfigFile(defaultConfigFile string) string {
 	return defaultConfigFile
 }
 
-func requestServer(serverAddress string) config.Client {
+func requestServer(serverAddress, username, password string) config.Client {
 	serverURL, err := url.Parse(serverAddress)
 	if err != nil {
 		panic(fmt.Errorf("invalid server address: %v", err))
 	}
 
-	resp, err := http.Get(serverAddress)
+	req, err := http.NewRequest(http.MethodGet, serverAddress, nil)
+	if err != nil {
+		panic(fmt.Errorf("invalid server address: %v", err))
+	}
+
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		panic(fmt.Errorf("request to server failed: %v", err))
 	}
@@ -151,6 +175,8 @@ func requestServer(serverAddress string) config.Client {
 	client.Server = fmt.Sprintf("%s:%s", serverURL.Hostname(), clientConfResp.ServerPort)
 	client.Backends = clientConfResp.Backends
 	client.Secret = clientConfResp.Secret
+	client.Username = username
+	client.OIDC = clientConfResp.OIDC
 
 	return client
 }
@@ -14,6 +14,8 @@ import (
 	"github.com/mylxsw/secure-tunnel/internal/auth/local"
 	"github.com/mylxsw/secure-tunnel/internal/auth/misc"
 	"github.com/mylxsw/secure-tunnel/internal/auth/none"
+	"github.com/mylxsw/secure-tunnel/internal/auth/oidc"
+	"github.com/mylxsw/secure-tunnel/internal/auth/token"
 	"github.com/mylxsw/secure-tunnel/internal/config"
 	"github.com/mylxsw/secure-tunnel/internal/tunnel"
 	"time"
@@ -56,6 +58,8 @@ func main() {
 		none.Provider{},
 		local.Provider{},
 		misc.Provider{},
+		oidc.Provider{},
+		token.Provider{},
 		config.ServerProvider{},
 		tunnel.ServerProvider{},
 		api.Provider{},
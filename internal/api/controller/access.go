@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/glacier/web"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/server"
+)
+
+// AccessController 临时访问申请和审批，所有接口都需要 HTTP Basic 认证，审批、拒绝和撤销不接受个人访问令牌
+type AccessController struct {
+	resolver infra.Resolver
+}
+
+func NewAccessController(resolver infra.Resolver) web.Controller {
+	return &AccessController{resolver: resolver}
+}
+
+func (ctl AccessController) Register(router web.Router) {
+	router.Group("/access", func(router web.Router) {
+		router.Get("/requests", ctl.List)
+		router.Post("/requests", ctl.Create)
+		router.Post("/requests/{id}/approve", ctl.Approve)
+		router.Post("/requests/{id}/reject", ctl.Reject)
+		router.Post("/requests/{id}/revoke", ctl.Revoke)
+	})
+}
+
+type AccessRequestReq struct {
+	Backend  string `json:"backend"`
+	Duration string `json:"duration"` // 如 2h、30m
+	Reason   string `json:"reason"`
+}
+
+type AccessDecisionReq struct {
+	Comment string `json:"comment"`
+}
+
+// List 当前用户提交的申请和可以审批的申请
+func (ctl AccessController) List(ctx web.Context, srv *server.Server, author auth.Author) web.Response {
+	user, err := authenticate(ctx, author)
+	if err != nil || user == nil {
+		return unauthorized(ctx, err)
+	}
+
+	return ctx.JSON(srv.AccessRequests(user))
+}
+
+// Create 提交临时访问申请
+func (ctl AccessController) Create(ctx web.Context, srv *server.Server, author auth.Author) web.Response {
+	user, err := authenticate(ctx, author)
+	if err != nil || user == nil {
+		return unauthorized(ctx, err)
+	}
+
+	var req AccessRequestReq
+	if err := ctx.Unmarshal(&req); err != nil {
+		return ctx.JSONError(fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+	}
+
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		return ctx.JSONError(fmt.Sprintf("invalid duration: %v", err), http.StatusBadRequest)
+	}
+
+	accessReq, err := srv.RequestAccess(user, req.Backend, duration, req.Reason)
+	if err != nil {
+		return accessError(ctx, err)
+	}
+
+	return ctx.JSONWithCode(accessReq, http.StatusCreated)
+}
+
+// Approve 审批通过访问申请
+func (ctl AccessController) Approve(ctx web.Context, srv *server.Server, author auth.Author) web.Response {
+	user, err := authenticateWithPassword(ctx, author)
+	if err != nil || user == nil {
+		return unauthorized(ctx, err)
+	}
+
+	accessReq, err := srv.ApproveAccess(user, ctx.PathVar("id"))
+	if err != nil {
+		return accessError(ctx, err)
+	}
+
+	return ctx.JSON(accessReq)
+}
+
+// Reject 拒绝访问申请
+func (ctl AccessController) Reject(ctx web.Context, srv *server.Server, author auth.Author) web.Response {
+	user, err := authenticateWithPassword(ctx, author)
+	if err != nil || user == nil {
+		return unauthorized(ctx, err)
+	}
+
+	var req AccessDecisionReq
+	_ = ctx.Unmarshal(&req)
+
+	accessReq, err := srv.RejectAccess(user, ctx.PathVar("id"), req.Comment)
+	if err != nil {
+		return accessError(ctx, err)
+	}
+
+	return ctx.JSON(accessReq)
+}
+
+// Revoke 撤销授权或取消申请
+func (ctl AccessController) Revoke(ctx web.Context, srv *server.Server, author auth.Author) web.Response {
+	user, err := authenticateWithPassword(ctx, author)
+	if err != nil || user == nil {
+		return unauthorized(ctx, err)
+	}
+
+	var req AccessDecisionReq
+	_ = ctx.Unmarshal(&req)
+
+	accessReq, err := srv.RevokeAccess(user, ctx.PathVar("id"), req.Comment)
+	if err != nil {
+		return accessError(ctx, err)
+	}
+
+	return ctx.JSON(accessReq)
+}
+
+// authenticate 使用 HTTP Basic 认证信息登录，请求中没有认证信息时返回 nil
+func authenticate(ctx web.Context, author auth.Author) (*auth.AuthedUser, error) {
+	username, password, ok := ctx.Request().Raw().BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	user, err := author.Login(username, password)
+	if err != nil {
+		return nil, fmt.Errorf("login failed: %v", err)
+	}
+
+	return user, nil
+}
+
+func unauthorized(ctx web.Context, err error) web.Response {
+	if err == nil {
+		err = errors.New("authentication required")
+	}
+
+	ctx.Response().Header("WWW-Authenticate", `Basic realm="secure-tunnel"`)
+	return ctx.JSONError(err.Error(), http.StatusUnauthorized)
+}
+
+func accessError(ctx web.Context, err error) web.Response {
+	switch {
+	case errors.Is(err, server.ErrAccessRequestNotFound):
+		return ctx.JSONError(err.Error(), http.StatusNotFound)
+	case errors.Is(err, server.ErrNotEligible), errors.Is(err, server.ErrNotApprover), errors.Is(err, server.ErrSelfApproval):
+		return ctx.JSONError(err.Error(), http.StatusForbidden)
+	case errors.Is(err, server.ErrInvalidAccessRequest), errors.Is(err, server.ErrJITNotEnabled):
+		return ctx.JSONError(err.Error(), http.StatusBadRequest)
+	}
+
+	return ctx.JSONError(err.Error(), http.StatusInternalServerError)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/mylxsw/glacier/infra"
 	"github.com/mylxsw/glacier/web"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
 	"github.com/mylxsw/secure-tunnel/internal/config"
 	"net/http"
 	"strings"
@@ -29,30 +30,62 @@ type ClientConfResp struct {
 	ServerPort string                      `json:"server_port"`
 	Backends   []config.BackendPortMapping `json:"backends"`
 	Secret     string                      `json:"secret"`
+	// OIDC 服务端使用 OIDC 认证时，客户端通过设备授权流程登录
+	OIDC *config.ClientOIDC `json:"oidc,omitempty"`
 }
 
-func (c ClientController) GenerateConf(ctx web.Context, conf *config.Server) web.Response {
+// GenerateConf 生成客户端配置，请求携带 HTTP Basic 认证信息时只返回该用户可以访问的后端，否则只返回未限制访问的后端
+func (c ClientController) GenerateConf(ctx web.Context, conf *config.Server, author auth.Author) web.Response {
 	secret := ctx.PathVar("secret")
 	if secret != conf.Secret {
 		return ctx.JSONError(fmt.Sprintf("invalid secert"), http.StatusBadRequest)
 	}
 
+	user, err := authenticate(ctx, author)
+	if err != nil {
+		return unauthorized(ctx, err)
+	}
+
 	backends := make([]config.BackendPortMapping, 0)
 	for _, back := range conf.Backends {
+		if user == nil && back.Restricted() || user != nil && (!back.Allowed(user.Account, user.Groups) || !user.InScope(back.Name)) {
+			continue
+		}
+
 		listenAddr := back.BindSuggest
 		if listenAddr == "" {
-			listenAddr = fmt.Sprintf("127.0.0.1:%s", strings.Split(back.Addr, ":")[1])
+			if _, ok := config.UnixSocketPath(back.Addr); ok {
+				// Unix socket 后端没有端口可以参考，建议客户端同样监听 socket 文件
+				listenAddr = fmt.Sprintf("unix:/tmp/secure-tunnel-%s.sock", back.Name)
+			} else {
+				listenAddr = fmt.Sprintf("127.0.0.1:%s", strings.Split(back.Addr, ":")[1])
+			}
 		}
 
-		backends = append(backends, config.BackendPortMapping{
+		mapping := config.BackendPortMapping{
 			Backend: back.Name,
 			Listen:  listenAddr,
-		})
+		}
+		if back.Protocol == "udp" {
+			mapping.Protocol = "udp"
+		}
+
+		backends = append(backends, mapping)
 	}
 
 	return ctx.JSON(ClientConfResp{
 		Backends:   backends,
 		ServerPort: strings.Split(conf.Listen, ":")[1],
 		Secret:     secret,
+		OIDC:       oidcClientConf(conf),
 	})
 }
+
+// oidcClientConf 服务端使用 OIDC 认证时下发给客户端的配置
+func oidcClientConf(conf *config.Server) *config.ClientOIDC {
+	if conf.AuthType != "oidc" {
+		return nil
+	}
+
+	return conf.OIDC.ClientConf()
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/glacier/web"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/policy"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/server"
+)
+
+type PolicyController struct {
+	resolver infra.Resolver
+}
+
+func NewPolicyController(resolver infra.Resolver) web.Controller {
+	return &PolicyController{resolver: resolver}
+}
+
+func (ctl PolicyController) Register(router web.Router) {
+	router.Group("/policy", func(router web.Router) {
+		router.Post("/evaluate", ctl.Evaluate)
+	})
+}
+
+type PolicyEvaluateResp struct {
+	Input  policy.Input        `json:"input"`
+	Result server.AccessResult `json:"result"`
+}
+
+// Evaluate 试运行访问控制规则和访问策略，请求体为 policy.Input，需要 HTTP Basic 认证
+// 普通用户只能试运行自己的账号，使用登录时的用户信息；管理员可以指定任意账号和用户组
+// 管理员只指定了账号时从认证服务查询用户的用户组，未指定时间时使用当前时间
+func (ctl PolicyController) Evaluate(ctx web.Context, conf *config.Server, srv *server.Server, author auth.Author) web.Response {
+	caller, err := authenticate(ctx, author)
+	if err != nil || caller == nil {
+		return unauthorized(ctx, err)
+	}
+
+	var in policy.Input
+	if err := ctx.Unmarshal(&in); err != nil {
+		return ctx.JSONError(fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+	}
+
+	if in.User.Account == "" {
+		in.User.Account = caller.Account
+	}
+
+	if in.Backend.Name == "" {
+		return ctx.JSONError("backend.name is required", http.StatusBadRequest)
+	}
+
+	if !conf.IsAdmin(caller.Account, caller.Groups) {
+		if in.User.Account != caller.Account {
+			return ctx.JSONError("only admins can evaluate access for other users", http.StatusForbidden)
+		}
+
+		in.User = *caller
+	} else if len(in.User.Groups) == 0 {
+		user, err := author.GetUser(in.User.Account)
+		if err != nil {
+			return ctx.JSONError(fmt.Sprintf("query user %s failed: %v", in.User.Account, err), http.StatusBadRequest)
+		}
+		in.User = *user
+	}
+
+	if in.Time.IsZero() {
+		in.Time = time.Now()
+	}
+
+	return ctx.JSON(PolicyEvaluateResp{
+		Input:  in,
+		Result: srv.CheckAccess(in),
+	})
+}
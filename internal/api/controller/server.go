@@ -36,6 +36,13 @@ type Connection struct {
 	ReadBytes  int64     `json:"read_bytes"`
 	WriteBytes int64     `json:"write_bytes"`
 	CreatedAt  time.Time `json:"created_at"`
+
+	Compression      string  `json:"compression"`
+	CompressionRatio float64 `json:"compression_ratio"`
+
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	RTT           float64   `json:"rtt_ms"`
+	Throttled     float64   `json:"throttled_seconds"`
 }
 
 func (ctl ServerController) ServerStatus(wtx web.Context, srv *server.Server) web.Response {
@@ -53,11 +60,18 @@ func (ctl ServerController) ServerStatus(wtx web.Context, srv *server.Server) we
 					ReadBytes:  cs.ReadBytes,
 					WriteBytes: cs.WriteBytes,
 					CreatedAt:  cs.CreatedAt,
+
+					Compression:      cs.Compression,
+					CompressionRatio: cs.CompressionRatio,
+
+					LastHeartbeat: cs.LastHeartbeat,
+					RTT:           cs.RTT,
+					Throttled:     cs.Throttled,
 				})
 			}
 
 			return UserConnections{Connections: conns, User: css[0].(server.ConnStatus).User}
 		}).AsArray().Items()
 
-	return wtx.JSON(web.M{"data": connections})
+	return wtx.JSON(web.M{"data": connections, "rate_limits": srv.RateLimitStatus()})
 }
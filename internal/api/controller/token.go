@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/glacier/web"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/auth/token"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/server"
+)
+
+// TokenController 个人访问令牌管理，所有接口都需要使用账号密码进行 HTTP Basic 认证
+type TokenController struct {
+	resolver infra.Resolver
+}
+
+func NewTokenController(resolver infra.Resolver) web.Controller {
+	return &TokenController{resolver: resolver}
+}
+
+func (ctl TokenController) Register(router web.Router) {
+	router.Get("/tokens", ctl.List)
+	router.Post("/tokens", ctl.Create)
+	router.Post("/tokens/{id}/revoke", ctl.Revoke)
+}
+
+type TokenCreateReq struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in"` // 如 720h，为空时使用服务端允许的最长有效期
+}
+
+type TokenCreateResp struct {
+	token.Token
+	// Secret 令牌明文，只在创建时返回一次
+	Secret string `json:"token"`
+}
+
+// List 当前用户的所有令牌
+func (ctl TokenController) List(ctx web.Context, store *token.Store, author auth.Author) web.Response {
+	user, err := authenticateWithPassword(ctx, author)
+	if err != nil || user == nil {
+		return unauthorized(ctx, err)
+	}
+
+	return ctx.JSON(store.Tokens(user.Account))
+}
+
+// Create 为当前用户签发令牌
+func (ctl TokenController) Create(ctx web.Context, conf *config.Server, store *token.Store, author auth.Author) web.Response {
+	user, err := authenticateWithPassword(ctx, author)
+	if err != nil || user == nil {
+		return unauthorized(ctx, err)
+	}
+
+	var req TokenCreateReq
+	if err := ctx.Unmarshal(&req); err != nil {
+		return ctx.JSONError(fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+	}
+
+	if req.Name == "" {
+		return ctx.JSONError("name is required", http.StatusBadRequest)
+	}
+
+	ttl := conf.TokenMaxTTL
+	if req.ExpiresIn != "" {
+		ttl, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			return ctx.JSONError(fmt.Sprintf("invalid expires_in: %v", err), http.StatusBadRequest)
+		}
+
+		if ttl <= 0 || ttl > conf.TokenMaxTTL {
+			return ctx.JSONError(fmt.Sprintf("expires_in must be positive and no more than %s", conf.TokenMaxTTL), http.StatusBadRequest)
+		}
+	}
+
+	issued, secret, err := store.Issue(user, req.Name, req.Scopes, ttl)
+	if err != nil {
+		return ctx.JSONError(err.Error(), http.StatusBadRequest)
+	}
+
+	return ctx.JSONWithCode(TokenCreateResp{Token: *issued, Secret: secret}, http.StatusCreated)
+}
+
+// Revoke 撤销当前用户的令牌，并断开使用该令牌登录的隧道
+func (ctl TokenController) Revoke(ctx web.Context, store *token.Store, srv *server.Server, author auth.Author) web.Response {
+	user, err := authenticateWithPassword(ctx, author)
+	if err != nil || user == nil {
+		return unauthorized(ctx, err)
+	}
+
+	revoked, err := store.Revoke(user.Account, ctx.PathVar("id"))
+	if err != nil {
+		if errors.Is(err, token.ErrTokenNotFound) {
+			return ctx.JSONError(err.Error(), http.StatusNotFound)
+		}
+
+		return ctx.JSONError(err.Error(), http.StatusInternalServerError)
+	}
+
+	srv.TerminateToken(user, revoked.ID)
+	return ctx.JSON(revoked)
+}
+
+// authenticateWithPassword 与 authenticate 相同，但不接受个人访问令牌登录，用于令牌管理、审批等不能由令牌代为执行的操作
+func authenticateWithPassword(ctx web.Context, author auth.Author) (*auth.AuthedUser, error) {
+	user, err := authenticate(ctx, author)
+	if err != nil || user == nil {
+		return user, err
+	}
+
+	if user.TokenID != "" {
+		return nil, errors.New("this operation requires password authentication, personal access tokens are not accepted")
+	}
+
+	return user, nil
+}
@@ -3,7 +3,9 @@ package api
 import (
 	"fmt"
 	"github.com/mylxsw/secure-tunnel/internal/api/controller"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
 	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/server"
 	"net"
 	"net/http"
 	"runtime/debug"
@@ -49,6 +51,9 @@ func (s Provider) routes(resolver infra.Resolver, router web.Router, mw web.Requ
 		"/api",
 		controller.NewServerController(resolver),
 		controller.NewClientController(resolver),
+		controller.NewPolicyController(resolver),
+		controller.NewAccessController(resolver),
+		controller.NewTokenController(resolver),
 	)
 }
 
@@ -59,6 +64,13 @@ func (s Provider) muxRoutes(cc infra.Resolver, router *mux.Router) {
 		// health check
 		router.PathPrefix("/health").Handler(HealthCheck{})
 	})
+
+	// 通过 WebSocket 建立隧道连接
+	cc.MustResolve(func(conf *config.Server, srv *server.Server, author auth.Author) {
+		if conf.WebSocket != "" {
+			router.Path(conf.WebSocket).Handler(srv.WebSocketHandler(author))
+		}
+	})
 }
 
 type HealthCheck struct{}
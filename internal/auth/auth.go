@@ -3,6 +3,7 @@ package auth
 import (
 	"errors"
 	"github.com/mylxsw/asteria/log"
+	"path"
 )
 
 type Author interface {
@@ -11,6 +12,12 @@ type Author interface {
 	Users() ([]AuthedUser, error)
 }
 
+// LoginOnly 只能在用户登录时得到用户信息的认证方式（如 OIDC）实现该接口，
+// 这类认证方式的 GetUser 只能查询服务启动后登录过的用户
+type LoginOnly interface {
+	LoginOnly() bool
+}
+
 type AuthedUser struct {
 	Type    string   `json:"type,omitempty" yaml:"type,omitempty"`
 	UUID    string   `json:"uuid,omitempty" yaml:"uuid,omitempty"`
@@ -18,6 +25,26 @@ type AuthedUser struct {
 	Account string   `json:"account,omitempty" yaml:"account,omitempty"`
 	Groups  []string `json:"groups,omitempty" yaml:"groups,omitempty"`
 	Status  int8     `json:"status,omitempty" yaml:"status,omitempty"`
+
+	// TokenID 使用个人访问令牌登录时为令牌 ID
+	TokenID string `json:"token_id,omitempty" yaml:"token_id,omitempty"`
+	// Scopes 使用令牌登录时可以访问的后端，支持 * 和 ? 通配符，为空时不限制
+	Scopes []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+}
+
+// InScope 当前登录方式是否可以访问后端，令牌的访问范围之外的后端不能访问
+func (au *AuthedUser) InScope(backend string) bool {
+	if len(au.Scopes) == 0 {
+		return true
+	}
+
+	for _, pattern := range au.Scopes {
+		if ok, _ := path.Match(pattern, backend); ok {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (au *AuthedUser) ToLogEntry() log.M {
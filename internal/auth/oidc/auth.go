@@ -0,0 +1,101 @@
+package oidc
+
+import (
+	"crypto/md5"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+// Auth 使用 OIDC 身份提供方签发的 ID Token 登录，客户端将 ID Token 作为密码提交
+type Auth struct {
+	conf     *config.OIDC
+	verifier *Verifier
+	logger   log.Logger
+
+	lock  sync.RWMutex
+	users map[string]auth.AuthedUser
+}
+
+func New(conf *config.OIDC) auth.Author {
+	audiences := append([]string{conf.ClientID}, conf.Audiences...)
+	return &Auth{
+		conf:     conf,
+		verifier: NewVerifier(conf.Issuer, conf.JWKSURL, audiences),
+		logger:   log.Module("auth:oidc"),
+		users:    make(map[string]auth.AuthedUser),
+	}
+}
+
+// Login 校验 ID Token，username 不为空时必须与令牌中的账号一致
+func (provider *Auth) Login(username, password string) (*auth.AuthedUser, error) {
+	claims, err := provider.verifier.Verify(password)
+	if err != nil {
+		provider.logger.Warningf("user %s login failed: %v", username, err)
+		return nil, err
+	}
+
+	account := claims.String(provider.conf.UsernameClaim)
+	if account == "" {
+		return nil, fmt.Errorf("%w: claim %s is required", ErrInvalidIDToken, provider.conf.UsernameClaim)
+	}
+
+	if username != "" && username != account {
+		return nil, fmt.Errorf("%w: token is issued to %s", ErrInvalidIDToken, account)
+	}
+
+	name := claims.String("name")
+	if name == "" {
+		name = account
+	}
+
+	user := auth.AuthedUser{
+		Type:    "oidc",
+		UUID:    fmt.Sprintf("%x", md5.Sum([]byte(provider.conf.Issuer+"-"+claims.String("sub")))),
+		Name:    name,
+		Account: account,
+		Groups:  claims.Strings(provider.conf.GroupsClaim),
+		Status:  1,
+	}
+
+	provider.lock.Lock()
+	provider.users[account] = user
+	provider.lock.Unlock()
+
+	return &user, nil
+}
+
+// GetUser OIDC 无法按账号查询用户，只能返回服务启动后登录过的用户
+func (provider *Auth) GetUser(username string) (*auth.AuthedUser, error) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+
+	user, ok := provider.users[username]
+	if !ok {
+		return nil, auth.ErrNoSuchUser
+	}
+
+	return &user, nil
+}
+
+// LoginOnly OIDC 只能在用户登录时得到用户信息
+func (provider *Auth) LoginOnly() bool {
+	return true
+}
+
+func (provider *Auth) Users() ([]auth.AuthedUser, error) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+
+	users := make([]auth.AuthedUser, 0, len(provider.users))
+	for _, user := range provider.users {
+		users = append(users, user)
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Account < users[j].Account })
+	return users, nil
+}
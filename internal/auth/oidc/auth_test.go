@@ -0,0 +1,185 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+func newTestAuth(idp *testIdP) auth.Author {
+	return New(&config.OIDC{
+		Issuer:        idp.issuer(),
+		ClientID:      idp.clientID,
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+	})
+}
+
+func TestLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	author := newTestAuth(idp)
+
+	user, err := author.Login("", idp.idToken(t, map[string]interface{}{"name": "Alice"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Account != "alice" || user.Name != "Alice" || user.Type != "oidc" || strings.Join(user.Groups, ",") != "dev,ops" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	if _, err := author.Login("bob", idp.idToken(t, nil)); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("token of another user should be rejected, got %v", err)
+	}
+
+	// 登录过的用户可以查询
+	if u, err := author.GetUser("alice"); err != nil || u.Account != "alice" {
+		t.Fatalf("get user failed: %v", err)
+	}
+
+	if _, err := author.GetUser("bob"); err != auth.ErrNoSuchUser {
+		t.Fatalf("expect no such user, got %v", err)
+	}
+}
+
+func TestLoginNestedGroupsClaim(t *testing.T) {
+	idp := newTestIdP(t)
+	author := New(&config.OIDC{
+		Issuer:        idp.issuer(),
+		ClientID:      idp.clientID,
+		UsernameClaim: "email",
+		GroupsClaim:   "realm_access.roles",
+	})
+
+	user, err := author.Login("", idp.idToken(t, map[string]interface{}{
+		"email":        "alice@example.com",
+		"realm_access": map[string]interface{}{"roles": []string{"dba"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Account != "alice@example.com" || strings.Join(user.Groups, ",") != "dba" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+}
+
+func TestLoginInvalidToken(t *testing.T) {
+	idp := newTestIdP(t)
+	author := newTestAuth(idp)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := idp.idToken(t, nil)
+	parts := strings.Split(valid, ".")
+
+	cases := map[string]string{
+		"issuer":    idp.idToken(t, map[string]interface{}{"iss": "https://evil.example.com"}),
+		"audience":  idp.idToken(t, map[string]interface{}{"aud": []string{"other-client"}}),
+		"azp":       idp.idToken(t, map[string]interface{}{"aud": []string{idp.clientID, "other"}, "azp": "other"}),
+		"expired":   idp.idToken(t, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"nbf":       idp.idToken(t, map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}),
+		"username":  idp.idToken(t, map[string]interface{}{"preferred_username": ""}),
+		"signature": signToken(t, otherKey, idp.kid, map[string]interface{}{"iss": idp.issuer(), "aud": idp.clientID, "preferred_username": "alice", "exp": time.Now().Add(time.Hour).Unix()}),
+		"alg-none":  "eyJhbGciOiJub25lIn0." + parts[1] + ".",
+		"malformed": "not-a-jwt",
+		"password":  "admin",
+	}
+
+	for name, token := range cases {
+		if _, err := author.Login("", token); !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("%s: expect invalid id token, got %v", name, err)
+		}
+	}
+
+	if _, err := author.Login("", valid); err != nil {
+		t.Fatalf("valid token should be accepted: %v", err)
+	}
+}
+
+func TestVerifierKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	verifier := NewVerifier(idp.issuer(), "", []string{idp.clientID})
+
+	if _, err := verifier.Verify(idp.idToken(t, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未知的 kid 在刷新间隔内不会重新获取公钥
+	idp.rotateKey()
+	if _, err := verifier.Verify(idp.idToken(t, nil)); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("expect unknown key, got %v", err)
+	}
+
+	verifier.fetchedAt = time.Now().Add(-jwksRefreshInterval)
+	if _, err := verifier.Verify(idp.idToken(t, nil)); err != nil {
+		t.Fatalf("rotated key should be fetched: %v", err)
+	}
+
+	if n := idp.requestCount("jwks"); n != 2 {
+		t.Fatalf("expect jwks fetched twice, got %d", n)
+	}
+}
+
+// signES 使用 ECDSA 私钥按 JWS 格式签名，hash 由算法决定，签名长度由曲线决定
+func signES(t *testing.T, key *ecdsa.PrivateKey, hash crypto.Hash, signingInput string) []byte {
+	t.Helper()
+
+	h := hash.New()
+	h.Write([]byte(signingInput))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	return signature
+}
+
+func TestVerifySignatureCurve(t *testing.T) {
+	algs := []struct {
+		alg   string
+		hash  crypto.Hash
+		curve elliptic.Curve
+	}{
+		{alg: "ES256", hash: crypto.SHA256, curve: elliptic.P256()},
+		{alg: "ES384", hash: crypto.SHA384, curve: elliptic.P384()},
+		{alg: "ES512", hash: crypto.SHA512, curve: elliptic.P521()},
+	}
+
+	const input = "header.payload"
+	for _, keyAlg := range algs {
+		key, err := ecdsa.GenerateKey(keyAlg.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 签名本身有效，但算法与公钥的曲线不一致时拒绝
+		for _, alg := range algs {
+			err := verifySignature(alg.alg, &key.PublicKey, input, signES(t, key, alg.hash, input))
+			if alg.alg == keyAlg.alg && err != nil {
+				t.Fatalf("%s signature with %s key should be accepted: %v", alg.alg, keyAlg.curve.Params().Name, err)
+			}
+
+			if alg.alg != keyAlg.alg && err == nil {
+				t.Fatalf("%s signature with %s key should be rejected", alg.alg, keyAlg.curve.Params().Name)
+			}
+		}
+	}
+}
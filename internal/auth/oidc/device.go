@@ -0,0 +1,247 @@
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+// defaultScopes 未配置 scopes 时申请的 scope，offline_access 用于获取刷新令牌
+var defaultScopes = []string{"openid", "profile", "email", "offline_access"}
+
+// defaultPollInterval 身份提供方未指定轮询间隔时使用的默认值（RFC 8628）
+var defaultPollInterval = 5 * time.Second
+
+// refreshBefore ID Token 在过期前多久刷新，避免握手过程中令牌过期
+const refreshBefore = time.Minute
+
+// DeviceAuthorization 设备授权响应，需要用户在浏览器中打开验证地址并输入用户码
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+type tokenResponse struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenCache 缓存到文件中的刷新令牌，issuer 或 client_id 变化后缓存失效
+type tokenCache struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// TokenSource 客户端通过 OAuth 2.0 设备授权流程（RFC 8628）获取 ID Token
+// 获取到的刷新令牌缓存在文件中，之后启动时不需要再次在浏览器中登录
+type TokenSource struct {
+	conf   config.ClientOIDC
+	prompt func(da DeviceAuthorization)
+
+	lock    sync.Mutex
+	meta    *Metadata
+	idToken string
+	expiry  time.Time
+}
+
+// NewTokenSource 创建 ID Token 获取器
+func NewTokenSource(conf config.ClientOIDC) *TokenSource {
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = defaultScopes
+	}
+
+	return &TokenSource{conf: conf, prompt: printDeviceAuthorization}
+}
+
+func printDeviceAuthorization(da DeviceAuthorization) {
+	if da.VerificationURIComplete != "" {
+		_, _ = fmt.Fprintf(os.Stderr, "\nTo sign in, open %s in your browser and confirm the code %s\n\n", da.VerificationURIComplete, da.UserCode)
+		return
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "\nTo sign in, open %s in your browser and enter the code %s\n\n", da.VerificationURI, da.UserCode)
+}
+
+// IDToken 返回有效的 ID Token，即将过期时使用刷新令牌更新，刷新失败时重新进行设备授权
+func (ts *TokenSource) IDToken() (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.idToken != "" && time.Now().Add(refreshBefore).Before(ts.expiry) {
+		return ts.idToken, nil
+	}
+
+	if ts.meta == nil {
+		meta, err := Discover(ts.conf.Issuer)
+		if err != nil {
+			return "", err
+		}
+
+		if meta.DeviceAuthorizationEndpoint == "" || meta.TokenEndpoint == "" {
+			return "", errors.New("identity provider does not support device authorization grant")
+		}
+
+		ts.meta = meta
+	}
+
+	if refreshToken := ts.loadRefreshToken(); refreshToken != "" {
+		token, err := ts.refresh(refreshToken)
+		if err == nil {
+			return ts.accept(token, refreshToken)
+		}
+
+		// 刷新令牌被撤销或过期时删除缓存，网络错误等情况下保留
+		var te *tokenError
+		if errors.As(err, &te) {
+			_ = os.Remove(ts.conf.TokenCache)
+		}
+
+		log.Warningf("refresh oidc token failed, sign in again: %v", err)
+	}
+
+	token, err := ts.deviceLogin()
+	if err != nil {
+		return "", err
+	}
+
+	return ts.accept(token, "")
+}
+
+// accept 保存新的 ID Token，身份提供方返回新的刷新令牌时更新缓存
+func (ts *TokenSource) accept(token *tokenResponse, refreshToken string) (string, error) {
+	if token.IDToken == "" {
+		return "", errors.New("identity provider did not return an id token, openid scope is required")
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	parts := strings.Split(token.IDToken, ".")
+	if len(parts) != 3 || decodeSegment(parts[1], &claims) != nil || claims.Exp == 0 {
+		return "", errors.New("identity provider returned an invalid id token")
+	}
+
+	ts.idToken = token.IDToken
+	ts.expiry = time.Unix(claims.Exp, 0)
+
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		if err := ts.saveRefreshToken(token.RefreshToken); err != nil {
+			log.Warningf("save oidc refresh token to %s failed: %v", ts.conf.TokenCache, err)
+		}
+	}
+
+	return ts.idToken, nil
+}
+
+func (ts *TokenSource) refresh(refreshToken string) (*tokenResponse, error) {
+	var token tokenResponse
+	err := postForm(ts.meta.TokenEndpoint, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {ts.conf.ClientID},
+		"scope":         {strings.Join(ts.conf.Scopes, " ")},
+	}, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.IDToken == "" {
+		return nil, errors.New("no id token in refresh response")
+	}
+
+	return &token, nil
+}
+
+// deviceLogin 发起设备授权，提示用户在浏览器中登录，然后轮询令牌接口直到用户完成授权
+func (ts *TokenSource) deviceLogin() (*tokenResponse, error) {
+	var da DeviceAuthorization
+	if err := postForm(ts.meta.DeviceAuthorizationEndpoint, url.Values{
+		"client_id": {ts.conf.ClientID},
+		"scope":     {strings.Join(ts.conf.Scopes, " ")},
+	}, &da); err != nil {
+		return nil, fmt.Errorf("device authorization failed: %v", err)
+	}
+
+	ts.prompt(da)
+
+	interval := defaultPollInterval
+	if da.Interval > 0 {
+		interval = time.Duration(da.Interval) * time.Second
+	}
+
+	deadline := time.Now().Add(time.Duration(da.ExpiresIn) * time.Second)
+	for da.ExpiresIn <= 0 || time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		var token tokenResponse
+		err := postForm(ts.meta.TokenEndpoint, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {da.DeviceCode},
+			"client_id":   {ts.conf.ClientID},
+		}, &token)
+		if err == nil {
+			return &token, nil
+		}
+
+		var te *tokenError
+		if !errors.As(err, &te) {
+			return nil, fmt.Errorf("device authorization failed: %v", err)
+		}
+
+		switch te.Code {
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			// access_denied、expired_token 等错误无法继续
+			return nil, fmt.Errorf("device authorization failed: %w", te)
+		}
+	}
+
+	return nil, errors.New("device authorization failed: device code expired")
+}
+
+func (ts *TokenSource) loadRefreshToken() string {
+	if ts.conf.TokenCache == "" {
+		return ""
+	}
+
+	data, err := ioutil.ReadFile(ts.conf.TokenCache)
+	if err != nil {
+		return ""
+	}
+
+	var cache tokenCache
+	if err := json.Unmarshal(data, &cache); err != nil || cache.Issuer != ts.conf.Issuer || cache.ClientID != ts.conf.ClientID {
+		return ""
+	}
+
+	return cache.RefreshToken
+}
+
+func (ts *TokenSource) saveRefreshToken(refreshToken string) error {
+	if ts.conf.TokenCache == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(tokenCache{Issuer: ts.conf.Issuer, ClientID: ts.conf.ClientID, RefreshToken: refreshToken})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(ts.conf.TokenCache, data, 0600)
+}
@@ -0,0 +1,140 @@
+package oidc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+func init() {
+	defaultPollInterval = 10 * time.Millisecond
+}
+
+func newTestTokenSource(idp *testIdP, cache string, prompt func(da DeviceAuthorization)) *TokenSource {
+	ts := NewTokenSource(config.ClientOIDC{Issuer: idp.issuer(), ClientID: idp.clientID, TokenCache: cache})
+	ts.prompt = prompt
+	return ts
+}
+
+func TestDeviceLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	cache := filepath.Join(t.TempDir(), "oidc.json")
+
+	var prompted DeviceAuthorization
+	ts := newTestTokenSource(idp, cache, func(da DeviceAuthorization) {
+		prompted = da
+		// 模拟用户稍后在浏览器中完成授权
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			idp.approveAll()
+		}()
+	})
+
+	idToken, err := ts.IDToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prompted.UserCode != "ABCD-EFGH" || !strings.HasSuffix(prompted.VerificationURI, "/activate") {
+		t.Fatalf("unexpected device authorization: %+v", prompted)
+	}
+
+	if idp.requestCount("urn:ietf:params:oauth:grant-type:device_code") < 2 {
+		t.Fatal("token endpoint should be polled until authorized")
+	}
+
+	// 获取到的 ID Token 可以通过服务端校验
+	user, err := newTestAuth(idp).Login("alice", idToken)
+	if err != nil || user.Account != "alice" {
+		t.Fatalf("login with id token failed: %v", err)
+	}
+
+	// 未过期时直接使用缓存的 ID Token
+	if again, err := ts.IDToken(); err != nil || again != idToken {
+		t.Fatalf("id token should be reused: %v", err)
+	}
+
+	stat, err := os.Stat(cache)
+	if err != nil {
+		t.Fatalf("refresh token should be cached: %v", err)
+	}
+
+	if stat.Mode().Perm() != 0600 {
+		t.Fatalf("token cache should only be readable by owner, got %v", stat.Mode().Perm())
+	}
+}
+
+func TestRefreshCachedToken(t *testing.T) {
+	idp := newTestIdP(t)
+	cache := filepath.Join(t.TempDir(), "oidc.json")
+
+	first := newTestTokenSource(idp, cache, func(da DeviceAuthorization) { idp.approveAll() })
+	if _, err := first.IDToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 再次启动时使用缓存的刷新令牌，不需要重新授权
+	second := newTestTokenSource(idp, cache, func(da DeviceAuthorization) {
+		t.Error("device authorization should not be required")
+		idp.approveAll()
+	})
+	if _, err := second.IDToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	if idp.requestCount("refresh_token") != 1 || idp.requestCount("device") != 1 {
+		t.Fatalf("unexpected requests: %v", idp.requests)
+	}
+
+	// ID Token 即将过期时自动刷新，刷新令牌轮换后更新缓存
+	second.expiry = time.Now()
+	if _, err := second.IDToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	if idp.requestCount("refresh_token") != 2 {
+		t.Fatalf("expired id token should be refreshed: %v", idp.requests)
+	}
+}
+
+func TestRefreshRevokedToken(t *testing.T) {
+	idp := newTestIdP(t)
+	cache := filepath.Join(t.TempDir(), "oidc.json")
+
+	ts := newTestTokenSource(idp, cache, func(da DeviceAuthorization) { idp.approveAll() })
+	if _, err := ts.IDToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 刷新令牌被撤销后重新进行设备授权
+	idp.lock.Lock()
+	idp.refresh = make(map[string]bool)
+	idp.lock.Unlock()
+
+	ts = newTestTokenSource(idp, cache, func(da DeviceAuthorization) { idp.approveAll() })
+	if _, err := ts.IDToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	if idp.requestCount("device") != 2 {
+		t.Fatalf("device authorization should be required again: %v", idp.requests)
+	}
+}
+
+func TestDeviceLoginDenied(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.denied = true
+
+	ts := newTestTokenSource(idp, "", func(da DeviceAuthorization) {})
+	_, err := ts.IDToken()
+
+	var te *tokenError
+	if !errors.As(err, &te) || te.Code != "access_denied" {
+		t.Fatalf("expect access denied, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Metadata 身份提供方的 discovery 文档，只包含用到的字段
+type Metadata struct {
+	Issuer                      string `json:"issuer"`
+	JWKSURI                     string `json:"jwks_uri"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+// Discover 从 issuer/.well-known/openid-configuration 获取身份提供方的配置
+func Discover(issuer string) (*Metadata, error) {
+	var meta Metadata
+	if err := getJSON(strings.TrimRight(issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %v", err)
+	}
+
+	// 防止 discovery 文档被篡改后使用其它身份提供方的公钥
+	if meta.Issuer != issuer {
+		return nil, fmt.Errorf("oidc discovery failed: issuer mismatch, expect %s, got %s", issuer, meta.Issuer)
+	}
+
+	return &meta, nil
+}
+
+func getJSON(endpoint string, v interface{}) error {
+	resp, err := httpClient.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request %s failed: %s %s", endpoint, resp.Status, string(data))
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// tokenError OAuth 2.0 错误响应
+type tokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *tokenError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+
+	return e.Code
+}
+
+// postForm 提交表单并解析 JSON 响应，身份提供方返回 OAuth 错误时返回 *tokenError
+func postForm(endpoint string, form url.Values, v interface{}) error {
+	resp, err := httpClient.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var te tokenError
+		if err := json.Unmarshal(data, &te); err == nil && te.Code != "" {
+			return &te
+		}
+
+		return fmt.Errorf("request %s failed: %s %s", endpoint, resp.Status, string(data))
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,229 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP 进程内模拟的 OIDC 身份提供方，支持 discovery、JWKS、设备授权和刷新令牌
+type testIdP struct {
+	server   *httptest.Server
+	clientID string
+
+	lock     sync.Mutex
+	key      *rsa.PrivateKey
+	kid      string
+	claims   map[string]interface{} // 签发 ID Token 时附加的 claims
+	ttl      time.Duration
+	pending  map[string]bool // device_code -> 用户是否已在浏览器中授权
+	refresh  map[string]bool // 有效的刷新令牌
+	denied   bool
+	requests map[string]int
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{
+		clientID: "secure-tunnel",
+		claims:   map[string]interface{}{"preferred_username": "alice", "groups": []string{"dev", "ops"}},
+		ttl:      time.Hour,
+		pending:  make(map[string]bool),
+		refresh:  make(map[string]bool),
+		requests: make(map[string]int),
+	}
+	idp.rotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		idp.count("discovery")
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                        idp.issuer(),
+			"jwks_uri":                      idp.issuer() + "/jwks",
+			"token_endpoint":                idp.issuer() + "/token",
+			"device_authorization_endpoint": idp.issuer() + "/device",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.count("jwks")
+		idp.lock.Lock()
+		defer idp.lock.Unlock()
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		idp.count("device")
+		if r.PostFormValue("client_id") != idp.clientID {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		idp.lock.Lock()
+		code := fmt.Sprintf("device-%d", len(idp.pending))
+		idp.pending[code] = false
+		idp.lock.Unlock()
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"device_code":      code,
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": idp.issuer() + "/activate",
+			"expires_in":       60,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.count(r.PostFormValue("grant_type"))
+		idp.lock.Lock()
+		defer idp.lock.Unlock()
+
+		switch r.PostFormValue("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			approved, ok := idp.pending[r.PostFormValue("device_code")]
+			switch {
+			case !ok:
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expired_token"})
+			case idp.denied:
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "access_denied"})
+			case !approved:
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "authorization_pending"})
+			default:
+				delete(idp.pending, r.PostFormValue("device_code"))
+				writeJSON(w, http.StatusOK, idp.issueTokens(t))
+			}
+		case "refresh_token":
+			if !idp.refresh[r.PostFormValue("refresh_token")] {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+				return
+			}
+
+			// 刷新令牌只能使用一次
+			delete(idp.refresh, r.PostFormValue("refresh_token"))
+			writeJSON(w, http.StatusOK, idp.issueTokens(t))
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		}
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *testIdP) issuer() string {
+	return idp.server.URL
+}
+
+func (idp *testIdP) count(name string) {
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+	idp.requests[name]++
+}
+
+func (idp *testIdP) requestCount(name string) int {
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+	return idp.requests[name]
+}
+
+func (idp *testIdP) rotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+	idp.key = key
+	idp.kid = fmt.Sprintf("key-%d", time.Now().UnixNano())
+}
+
+// approveAll 模拟用户在浏览器中完成授权
+func (idp *testIdP) approveAll() {
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+	for code := range idp.pending {
+		idp.pending[code] = true
+	}
+}
+
+// issueTokens 签发 ID Token 和刷新令牌，调用方需要持有锁
+func (idp *testIdP) issueTokens(t *testing.T) map[string]string {
+	claims := map[string]interface{}{
+		"iss": idp.issuer(),
+		"aud": idp.clientID,
+		"sub": "user-1",
+		"exp": time.Now().Add(idp.ttl).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+
+	refreshToken := fmt.Sprintf("refresh-%d", time.Now().UnixNano())
+	idp.refresh[refreshToken] = true
+
+	return map[string]string{
+		"id_token":      signToken(t, idp.key, idp.kid, claims),
+		"refresh_token": refreshToken,
+		"token_type":    "Bearer",
+	}
+}
+
+// idToken 直接签发 ID Token，overrides 覆盖默认的 claims
+func (idp *testIdP) idToken(t *testing.T, overrides map[string]interface{}) string {
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+
+	claims := map[string]interface{}{
+		"iss": idp.issuer(),
+		"aud": idp.clientID,
+		"sub": "user-1",
+		"exp": time.Now().Add(idp.ttl).Unix(),
+	}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	for k, v := range overrides {
+		claims[k] = v
+	}
+
+	return signToken(t, idp.key, idp.kid, claims)
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,19 @@
+package oidc
+
+import (
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/go-utils/str"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+type Provider struct{}
+
+func (p Provider) Register(cc infra.Binder) {
+	cc.MustSingletonOverride(New)
+	log.Debugf("provider internal.auth.oidc loaded")
+}
+
+func (p Provider) ShouldLoad(config *config.Server) bool {
+	return str.InIgnoreCase(config.AuthType, []string{"oidc"})
+}
@@ -0,0 +1,368 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mylxsw/go-utils/str"
+)
+
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+// clockSkew 校验 exp、nbf 时允许的时钟误差
+const clockSkew = time.Minute
+
+// jwksRefreshInterval 遇到未知的 kid 时重新获取公钥的最小间隔，避免伪造的令牌频繁触发请求
+const jwksRefreshInterval = 30 * time.Second
+
+// Claims ID Token 中的 claims
+type Claims map[string]interface{}
+
+// String 字符串类型的 claim，不存在或类型不匹配时返回空字符串
+func (c Claims) String(name string) string {
+	v, _ := c.lookup(name).(string)
+	return v
+}
+
+// Strings 字符串数组类型的 claim，claim 为单个字符串时作为只有一个元素的数组
+func (c Claims) Strings(name string) []string {
+	switch v := c.lookup(name).(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+// lookup 查找 claim，嵌套的 claim 使用 . 分隔
+func (c Claims) lookup(name string) interface{} {
+	var cur interface{} = map[string]interface{}(c)
+	for _, key := range strings.Split(name, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		cur = m[key]
+	}
+
+	return cur
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(v), 0), true
+}
+
+// Verifier 校验身份提供方签发的 ID Token
+type Verifier struct {
+	issuer    string
+	audiences []string
+	jwksURL   string
+
+	lock      sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewVerifier 创建 ID Token 校验器，jwksURL 为空时从 issuer 的 discovery 文档中获取
+func NewVerifier(issuer, jwksURL string, audiences []string) *Verifier {
+	return &Verifier{issuer: issuer, jwksURL: jwksURL, audiences: audiences}
+}
+
+// Verify 校验 ID Token 的签名、签发者、受众和有效期，返回其中的 claims
+func (v *Verifier) Verify(rawIDToken string) (Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed jwt", ErrInvalidIDToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: invalid header: %v", ErrInvalidIDToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature: %v", ErrInvalidIDToken, err)
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid payload: %v", ErrInvalidIDToken, err)
+	}
+
+	if err := v.validate(claims, time.Now()); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) validate(claims Claims, now time.Time) error {
+	if iss := claims.String("iss"); iss != v.issuer {
+		return fmt.Errorf("unexpected issuer %s", iss)
+	}
+
+	aud := claims.Strings("aud")
+	matched := false
+	for _, a := range aud {
+		if str.In(a, v.audiences) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return fmt.Errorf("unexpected audience %v", aud)
+	}
+
+	// 令牌包含多个受众时，azp 为实际获取令牌的客户端
+	if azp := claims.String("azp"); azp != "" && !str.In(azp, v.audiences) {
+		return fmt.Errorf("unexpected authorized party %s", azp)
+	}
+
+	exp, ok := claims.time("exp")
+	if !ok {
+		return errors.New("exp is required")
+	}
+	if now.After(exp.Add(clockSkew)) {
+		return errors.New("token is expired")
+	}
+
+	if nbf, ok := claims.time("nbf"); ok && now.Add(clockSkew).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+
+	return nil
+}
+
+// key 查找签名公钥，找不到时重新获取公钥列表，以支持身份提供方轮换密钥
+func (v *Verifier) key(kid string) (crypto.PublicKey, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if key, ok := v.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	if !v.fetchedAt.IsZero() && time.Since(v.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key id %s", ErrInvalidIDToken, kid)
+	}
+
+	if err := v.fetchKeys(); err != nil {
+		return nil, err
+	}
+
+	if key, ok := v.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown key id %s", ErrInvalidIDToken, kid)
+}
+
+// lookupKey 令牌未指定 kid 时，只有一个公钥的情况下使用该公钥
+func (v *Verifier) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+func (v *Verifier) fetchKeys() error {
+	v.fetchedAt = time.Now()
+
+	if v.jwksURL == "" {
+		meta, err := Discover(v.issuer)
+		if err != nil {
+			return err
+		}
+
+		v.jwksURL = meta.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(v.jwksURL, &jwks); err != nil {
+		return fmt.Errorf("fetch jwks failed: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("invalid jwk %s: %v", k.Kid, err)
+		}
+
+		keys[k.Kid] = key
+	}
+
+	v.keys = keys
+	return nil
+}
+
+// jsonWebKey JWKS 中的公钥，支持 RSA 和 EC 公钥
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// verifySignature 校验 JWS 签名，只支持非对称签名算法
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s does not match rsa key", alg)
+		}
+
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		// ES 算法与曲线一一对应，不能使用其它曲线的公钥校验
+		curves := map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+		if curves[alg] != pub.Curve.Params().Name {
+			return fmt.Errorf("algorithm %s does not match ec key on curve %s", alg, pub.Curve.Params().Name)
+		}
+
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ecdsa signature length")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("ecdsa signature verification failed")
+		}
+
+		return nil
+	}
+
+	return errors.New("unsupported key")
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
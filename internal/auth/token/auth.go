@@ -0,0 +1,59 @@
+package token
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+)
+
+// Auth 在已有的认证方式之上支持个人访问令牌，密码以 Prefix 开头时按令牌校验，否则交给原有的认证方式
+type Auth struct {
+	auth.Author
+	logger log.Logger
+	store  *Store
+}
+
+func New(store *Store, author auth.Author) auth.Author {
+	return &Auth{Author: author, logger: log.Module("auth:token"), store: store}
+}
+
+// Login 使用令牌登录时用户名可以为空，不为空时必须与令牌所属的账号一致
+func (provider *Auth) Login(username, password string) (*auth.AuthedUser, error) {
+	if !strings.HasPrefix(password, Prefix) {
+		return provider.Author.Login(username, password)
+	}
+
+	t, err := provider.store.Verify(password)
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "" && username != t.Account {
+		provider.logger.Warningf("token %s of user %s used by %s", t.ID, t.Account, username)
+		return nil, ErrInvalidToken
+	}
+
+	// 每次登录都重新查询用户，账号被禁用或删除后令牌随之失效，用户组的变化也会生效
+	user, err := provider.Author.GetUser(t.Account)
+	if err != nil {
+		// OIDC 等认证方式在服务重启后、用户重新登录前查询不到用户，使用签发令牌时的用户信息
+		if !errors.Is(err, auth.ErrNoSuchUser) || t.User == nil || !loginOnly(provider.Author) {
+			return nil, err
+		}
+
+		snapshot := *t.User
+		user = &snapshot
+	}
+
+	user.TokenID = t.ID
+	user.Scopes = t.Scopes
+	return user, nil
+}
+
+// loginOnly 认证方式是否只能在用户登录时得到用户信息
+func loginOnly(author auth.Author) bool {
+	lo, ok := author.(auth.LoginOnly)
+	return ok && lo.LoginOnly()
+}
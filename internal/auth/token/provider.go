@@ -0,0 +1,59 @@
+package token
+
+import (
+	"context"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+type Provider struct{}
+
+// Priority 在其它认证方式之后加载，包装它们注册的 auth.Author
+func (p Provider) Priority() int {
+	return 1100
+}
+
+func (p Provider) Register(cc infra.Binder) {
+	cc.MustSingletonOverride(func(conf *config.Server) (*Store, error) {
+		return LoadStore(conf.TokenStore)
+	})
+
+	log.Debugf("provider internal.auth.token loaded")
+}
+
+// Boot 使用令牌认证包装 auth_type 对应的认证方式，非令牌的登录请求交给原有的认证方式处理
+func (p Provider) Boot(resolver infra.Resolver) {
+	resolver.MustResolve(func(binder infra.Binder, store *Store, author auth.Author) {
+		binder.MustSingletonOverride(func() auth.Author { return New(store, author) })
+	})
+}
+
+// Daemon 定期将令牌的最后使用时间写入文件，停机时再写入一次
+func (p Provider) Daemon(ctx context.Context, resolver infra.Resolver) {
+	resolver.MustResolve(func(store *Store, gf infra.Graceful) {
+		logger := log.Module("auth:token")
+		flush := func() {
+			if err := store.Flush(); err != nil {
+				logger.Errorf("save token store failed: %v", err)
+			}
+		}
+
+		gf.AddShutdownHandler(flush)
+
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				flush()
+			}
+		}
+	})
+}
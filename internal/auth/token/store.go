@@ -0,0 +1,250 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mylxsw/go-utils/file"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+)
+
+// Prefix 个人访问令牌的前缀，用于区分令牌和密码
+const Prefix = "stpat_"
+
+// flushInterval 令牌最后使用时间写入文件的间隔
+const flushInterval = time.Minute
+
+var (
+	ErrInvalidToken  = errors.New("invalid or expired token")
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+// Token 服务端签发的个人访问令牌，只保存令牌的 SHA-256 摘要
+type Token struct {
+	ID      string `json:"id"`
+	Account string `json:"account"`
+	Name    string `json:"name"`
+	// Scopes 令牌可以访问的后端，支持 * 和 ? 通配符，为空时与账号的权限相同
+	Scopes []string `json:"scopes,omitempty"`
+	// User 签发令牌时的用户信息，认证方式无法按账号查询用户时使用
+	User       *auth.AuthedUser `json:"user,omitempty"`
+	Hash       string           `json:"hash"`
+	CreatedAt  time.Time        `json:"created_at"`
+	ExpiresAt  time.Time        `json:"expires_at"`
+	LastUsedAt *time.Time       `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time       `json:"revoked_at,omitempty"`
+}
+
+// Valid 令牌是否未撤销且未过期
+func (t *Token) Valid(now time.Time) bool {
+	return t.RevokedAt == nil && now.Before(t.ExpiresAt)
+}
+
+// Public 不包含摘要的令牌信息，用于 API 输出
+func (t Token) Public() Token {
+	t.Hash = ""
+	return t
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store 持久化保存的个人访问令牌，签发和撤销后整体写入文件，最后使用时间定期写入
+type Store struct {
+	path   string
+	lock   sync.RWMutex
+	tokens map[string]*Token // hash -> token
+	dirty  bool              // 是否有未写入文件的最后使用时间
+}
+
+// LoadStore 从文件加载令牌，文件不存在时创建空的存储
+func LoadStore(filename string) (*Store, error) {
+	st := &Store{path: filename, tokens: make(map[string]*Token)}
+	if !file.Exist(filename) {
+		return st, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read token store %s failed: %v", filename, err)
+	}
+
+	var tokens []*Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("decode token store %s failed: %v", filename, err)
+	}
+
+	for _, t := range tokens {
+		st.tokens[t.Hash] = t
+	}
+
+	return st, nil
+}
+
+// save 写入临时文件后替换，调用方需要持有锁
+func (st *Store) save() error {
+	tokens := make([]*Token, 0, len(st.tokens))
+	for _, t := range st.tokens {
+		tokens = append(tokens, t)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := st.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write token store %s failed: %v", tmp, err)
+	}
+
+	if err := os.Rename(tmp, st.path); err != nil {
+		return err
+	}
+
+	st.dirty = false
+	return nil
+}
+
+// Flush 将未写入文件的最后使用时间写入文件
+func (st *Store) Flush() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if !st.dirty {
+		return nil
+	}
+
+	return st.save()
+}
+
+// Issue 为用户签发令牌，返回令牌信息和令牌明文，明文只在签发时返回一次
+func (st *Store) Issue(user *auth.AuthedUser, name string, scopes []string, ttl time.Duration) (*Token, string, error) {
+	if ttl <= 0 {
+		return nil, "", errors.New("token ttl must be positive")
+	}
+
+	for _, pattern := range scopes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, "", fmt.Errorf("invalid scope %s: %v", pattern, err)
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+
+	secret := Prefix + base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now()
+	t := &Token{
+		ID:      uuid.New().String(),
+		Account: user.Account,
+		Name:    name,
+		Scopes:  scopes,
+		User: &auth.AuthedUser{
+			Type:    user.Type,
+			UUID:    user.UUID,
+			Name:    user.Name,
+			Account: user.Account,
+			Groups:  user.Groups,
+			Status:  user.Status,
+		},
+		Hash:      hashToken(secret),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.tokens[t.Hash] = t
+	if err := st.save(); err != nil {
+		delete(st.tokens, t.Hash)
+		return nil, "", err
+	}
+
+	issued := t.Public()
+	return &issued, secret, nil
+}
+
+// Tokens 账号的所有令牌，按签发时间倒序排列
+func (st *Store) Tokens(account string) []Token {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	tokens := make([]Token, 0)
+	for _, t := range st.tokens {
+		if t.Account == account {
+			tokens = append(tokens, t.Public())
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens
+}
+
+// Revoke 撤销账号的令牌
+func (st *Store) Revoke(account, id string) (*Token, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	for _, t := range st.tokens {
+		if t.ID != id || t.Account != account {
+			continue
+		}
+
+		if t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+			if err := st.save(); err != nil {
+				t.RevokedAt = nil
+				return nil, err
+			}
+		}
+
+		revoked := t.Public()
+		return &revoked, nil
+	}
+
+	return nil, ErrTokenNotFound
+}
+
+// Verify 校验令牌明文，返回有效的令牌并记录使用时间，使用时间只在内存中更新，由 Flush 写入文件
+func (st *Store) Verify(secret string) (*Token, error) {
+	if !strings.HasPrefix(secret, Prefix) {
+		return nil, ErrInvalidToken
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	t, ok := st.tokens[hashToken(secret)]
+	now := time.Now()
+	if !ok || !t.Valid(now) {
+		return nil, ErrInvalidToken
+	}
+
+	t.LastUsedAt = &now
+	st.dirty = true
+
+	verified := t.Public()
+	return &verified, nil
+}
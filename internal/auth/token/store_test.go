@@ -0,0 +1,178 @@
+package token
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/auth/local"
+	"github.com/mylxsw/secure-tunnel/internal/auth/none"
+	"github.com/mylxsw/secure-tunnel/internal/auth/oidc"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+func TestStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.json")
+	st, err := LoadStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued, secret, err := st.Issue(&auth.AuthedUser{Account: "alice"}, "ci", []string{"mysql-*"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(secret, Prefix) || issued.Hash != "" {
+		t.Fatalf("unexpected token: %s %+v", secret, issued)
+	}
+
+	data, _ := ioutil.ReadFile(filename)
+	if strings.Contains(string(data), secret) {
+		t.Fatal("token secret should not be stored")
+	}
+
+	// 重新加载后令牌仍然有效
+	st, err = LoadStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := st.Verify(secret)
+	if err != nil || verified.ID != issued.ID || verified.LastUsedAt == nil {
+		t.Fatalf("verify token failed: %v", err)
+	}
+
+	if _, err := st.Verify(secret + "x"); err != ErrInvalidToken {
+		t.Fatalf("expect invalid token, got %v", err)
+	}
+
+	if _, err := st.Revoke("bob", issued.ID); err != ErrTokenNotFound {
+		t.Fatalf("expect token not found, got %v", err)
+	}
+
+	if _, err := st.Revoke("alice", issued.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Verify(secret); err != ErrInvalidToken {
+		t.Fatalf("revoked token should be invalid, got %v", err)
+	}
+
+	if _, _, err := st.Issue(&auth.AuthedUser{Account: "alice"}, "ci", []string{"["}, time.Hour); err == nil {
+		t.Fatal("invalid scope should be rejected")
+	}
+}
+
+func TestStoreExpired(t *testing.T) {
+	st, _ := LoadStore(filepath.Join(t.TempDir(), "tokens.json"))
+	_, secret, err := st.Issue(&auth.AuthedUser{Account: "alice"}, "ci", nil, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if _, err := st.Verify(secret); err != ErrInvalidToken {
+		t.Fatalf("expired token should be invalid, got %v", err)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	st, _ := LoadStore(filepath.Join(t.TempDir(), "tokens.json"))
+	issued, secret, _ := st.Issue(&auth.AuthedUser{Account: "alice"}, "ci", []string{"mysql-*"}, time.Hour)
+
+	author := New(st, none.New())
+	user, err := author.Login("", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Account != "alice" || user.TokenID != issued.ID {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	if !user.InScope("mysql-dev") || user.InScope("redis") {
+		t.Fatalf("unexpected scopes: %v", user.Scopes)
+	}
+
+	if _, err := author.Login("bob", secret); err != ErrInvalidToken {
+		t.Fatalf("token of another user should be rejected, got %v", err)
+	}
+
+	// 非令牌密码交给原有的认证方式
+	if user, err := author.Login("bob", "password"); err != nil || user.Account != "bob" || user.TokenID != "" {
+		t.Fatalf("password login failed: %v", err)
+	}
+}
+
+func TestStoreFlush(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.json")
+	st, _ := LoadStore(filename)
+	_, secret, err := st.Issue(&auth.AuthedUser{Account: "alice"}, "ci", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 校验令牌时只在内存中记录使用时间，不写入文件
+	if _, err := st.Verify(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(filename)
+	if strings.Contains(string(data), "last_used_at") {
+		t.Fatal("verify should not write token store")
+	}
+
+	if err := st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ = ioutil.ReadFile(filename)
+	if !strings.Contains(string(data), "last_used_at") {
+		t.Fatal("last used time should be written after flush")
+	}
+
+	// 写入失败时保留未写入的使用时间，之后再次写入
+	_, _ = st.Verify(secret)
+	st.path = filepath.Join(filename, "missing", "tokens.json")
+	if err := st.Flush(); err == nil {
+		t.Fatal("flush to invalid path should fail")
+	}
+
+	st.path = filename
+	if !st.dirty {
+		t.Fatal("failed flush should keep store dirty")
+	}
+
+	if err := st.Flush(); err != nil || st.dirty {
+		t.Fatalf("flush failed: %v", err)
+	}
+}
+
+func TestAuthLoginWithoutUserLookup(t *testing.T) {
+	st, _ := LoadStore(filepath.Join(t.TempDir(), "tokens.json"))
+	_, secret, err := st.Issue(&auth.AuthedUser{Type: "oidc", Account: "alice", Groups: []string{"dba"}}, "ci", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// OIDC 在服务重启后查询不到用户，使用签发令牌时的用户信息
+	author := New(st, oidc.New(&config.OIDC{Issuer: "https://idp.example.com", ClientID: "secure-tunnel"}))
+	user, err := author.Login("alice", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Account != "alice" || user.Type != "oidc" || len(user.Groups) != 1 || user.Groups[0] != "dba" || user.TokenID == "" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	// 可以查询用户的认证方式中账号不存在时令牌失效
+	author = New(st, local.New(&config.Users{}))
+	if _, err := author.Login("alice", secret); err != auth.ErrNoSuchUser {
+		t.Fatalf("token of deleted user should be rejected, got %v", err)
+	}
+}
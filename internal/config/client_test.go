@@ -0,0 +1,48 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func loadClientConf(t *testing.T, content string) *Client {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "client.yaml")
+	if err := ioutil.WriteFile(configPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := LoadClientConfFromFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conf
+}
+
+func TestClientTokenFromEnv(t *testing.T) {
+	t.Setenv("SECURE_TUNNEL_TOKEN", "stpat_env")
+
+	if conf := loadClientConf(t, "server: 127.0.0.1:8081\n"); conf.Token != "stpat_env" {
+		t.Fatalf("token should be read from env, got %q", conf.Token)
+	}
+
+	conf := loadClientConf(t, "username: admin\npassword: admin\n")
+	if conf.Token != "" || conf.Credential() != "admin" {
+		t.Fatalf("configured password should take precedence over env token, got token %q", conf.Token)
+	}
+
+	if conf := loadClientConf(t, "username: admin\n"); conf.Token != "" {
+		t.Fatalf("configured username should take precedence over env token, got %q", conf.Token)
+	}
+
+	if conf := loadClientConf(t, "token: stpat_file\n"); conf.Token != "stpat_file" {
+		t.Fatalf("configured token should take precedence over env token, got %q", conf.Token)
+	}
+
+	if conf := loadClientConf(t, "oidc:\n  issuer: https://sso.example.com\n  client_id: secure-tunnel\n"); conf.Token != "" {
+		t.Fatalf("oidc config should take precedence over env token, got %q", conf.Token)
+	}
+}
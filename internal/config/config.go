@@ -1,9 +1,22 @@
 package config
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/mylxsw/go-utils/str"
 )
 
+// UnixSocketPath 地址为 unix:/path 形式时返回 Unix socket 文件路径
+func UnixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(addr, "unix:"), true
+}
+
 // LDAP 域账号登录配置
 type LDAP struct {
 	URL         string `json:"url" yaml:"url,omitempty"`
@@ -15,11 +28,96 @@ type LDAP struct {
 	UserFilter  string `json:"user_filter" yaml:"user_filter,omitempty"`
 }
 
+// OIDC OpenID Connect 登录配置，客户端通过设备授权流程获取 ID Token，服务端校验后作为用户身份
+type OIDC struct {
+	Issuer string `json:"issuer" yaml:"issuer,omitempty"`
+	// ClientID 客户端在身份提供方注册的 ID，ID Token 的 aud 中必须包含 client_id 或 audiences 中的一个
+	ClientID  string   `json:"client_id" yaml:"client_id,omitempty"`
+	Audiences []string `json:"audiences,omitempty" yaml:"audiences,omitempty"`
+	// Scopes 客户端申请的 scope，默认为 openid profile email offline_access
+	Scopes []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	// JWKSURL 签名公钥地址，为空时从 issuer 的 discovery 文档中获取
+	JWKSURL string `json:"jwks_url,omitempty" yaml:"jwks_url,omitempty"`
+	// UsernameClaim 作为账号的 claim，默认为 preferred_username
+	UsernameClaim string `json:"username_claim,omitempty" yaml:"username_claim,omitempty"`
+	// GroupsClaim 作为用户组的 claim，默认为 groups，嵌套的 claim 使用 . 分隔，如 realm_access.roles
+	GroupsClaim string `json:"groups_claim,omitempty" yaml:"groups_claim,omitempty"`
+}
+
+// ClientConf 下发给客户端的 OIDC 配置
+func (conf OIDC) ClientConf() *ClientOIDC {
+	if conf.Issuer == "" {
+		return nil
+	}
+
+	return &ClientOIDC{Issuer: conf.Issuer, ClientID: conf.ClientID, Scopes: conf.Scopes}
+}
+
 // Users 用户配置
 type Users struct {
 	IgnoreAccountSuffix string      `json:"ignore_account_suffix" yaml:"ignore_account_suffix,omitempty"`
 	Local               []LocalUser `json:"local,omitempty" yaml:"local,omitempty"`
 	LDAP                []LDAPUser  `json:"ldap,omitempty" yaml:"ldap,omitempty"`
+	// RateLimits 按用户或用户组限制传输速率，同时匹配多条规则时全部生效
+	RateLimits []UserRateLimit `json:"rate_limits,omitempty" yaml:"rate_limits,omitempty"`
+}
+
+// RateLimit 令牌桶限速配置，上传和下载方向分别计算，速率格式如 512KB、10MB，单位为每秒字节数
+type RateLimit struct {
+	Rate string `json:"rate" yaml:"rate"`
+	// Burst 允许的突发流量，默认与 Rate 相同
+	Burst string `json:"burst,omitempty" yaml:"burst,omitempty"`
+}
+
+// Enabled 是否启用限速
+func (limit RateLimit) Enabled() bool {
+	return limit.Rate != ""
+}
+
+// Parse 解析速率和突发流量，单位为字节
+func (limit RateLimit) Parse() (rate int64, burst int64, err error) {
+	if rate, err = ParseByteSize(limit.Rate); err != nil {
+		return 0, 0, fmt.Errorf("invalid rate %s: %v", limit.Rate, err)
+	}
+
+	if limit.Burst == "" {
+		return rate, rate, nil
+	}
+
+	if burst, err = ParseByteSize(limit.Burst); err != nil {
+		return 0, 0, fmt.Errorf("invalid burst %s: %v", limit.Burst, err)
+	}
+
+	return rate, burst, nil
+}
+
+// UserRateLimit 用户限速规则，Account 匹配单个用户，该用户的所有隧道共享限额；Group 匹配用户组，组内所有用户共享限额
+type UserRateLimit struct {
+	Account   string `json:"account,omitempty" yaml:"account,omitempty"`
+	Group     string `json:"group,omitempty" yaml:"group,omitempty"`
+	RateLimit `yaml:",inline"`
+}
+
+// ParseByteSize 解析字节数，支持 B、KB、MB、GB 单位（1024 进制），不区分大小写
+func ParseByteSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	unit := int64(1)
+	for _, u := range []struct {
+		suffix string
+		unit   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.unit
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("must be a positive size such as 512KB or 10MB")
+	}
+
+	return int64(n * float64(unit)), nil
 }
 
 // LDAPUser ldap 用户配置
@@ -8,5 +8,6 @@ type ServerProvider struct{}
 
 func (pro ServerProvider) Register(binder infra.Binder) {
 	binder.MustSingletonOverride(func(conf *Server) *LDAP { return &conf.LDAP })
+	binder.MustSingletonOverride(func(conf *Server) *OIDC { return &conf.OIDC })
 	binder.MustSingletonOverride(func(conf *Server) *Users { return &conf.Users })
 }
@@ -4,6 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/mylxsw/go-utils/file"
 	"github.com/mylxsw/go-utils/str"
@@ -31,6 +35,26 @@ func LoadServerConfFromFile(configPath string) (*Server, error) {
 	}
 
 	conf = conf.populateDefault()
+	if conf.HostKey == "" {
+		conf.HostKey = filepath.Join(filepath.Dir(configPath), "secure-tunnel.host.key")
+	}
+
+	if conf.GrantStore == "" {
+		conf.GrantStore = filepath.Join(filepath.Dir(configPath), "secure-tunnel.grants.json")
+	}
+
+	if conf.AuditLog == "" {
+		conf.AuditLog = filepath.Join(filepath.Dir(configPath), "secure-tunnel.audit.log")
+	}
+
+	if conf.TokenStore == "" {
+		conf.TokenStore = filepath.Join(filepath.Dir(configPath), "secure-tunnel.tokens.json")
+	}
+
+	if conf.PolicyFile != "" && !filepath.IsAbs(conf.PolicyFile) {
+		conf.PolicyFile = filepath.Join(filepath.Dir(configPath), conf.PolicyFile)
+	}
+
 	if err := conf.validate(); err != nil {
 		return nil, err
 	}
@@ -43,20 +67,177 @@ type Server struct {
 	Listen     string          `json:"listen" yaml:"listen"`
 	Backends   []BackendServer `json:"backends" yaml:"backends"`
 	Secret     string          `json:"-" yaml:"secret"`
+	// Ciphers 允许使用的隧道加密算法，按优先级排序，rc4 仅用于兼容旧版本客户端，需要显式开启
+	Ciphers []string `json:"ciphers,omitempty" yaml:"ciphers,omitempty"`
+	// HostKey 服务端长期身份密钥文件，客户端通过它校验服务端身份，不存在时自动生成
+	HostKey string `json:"-" yaml:"host_key,omitempty"`
+	// TLS 隧道监听端口启用 TLS，证书为空时使用普通 TCP
+	TLS ServerTLS `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// WebSocket 在 http_listen 上提供隧道入口的路径，如 /tunnel，用于只允许 HTTP(S) 出口的网络，为空时不启用
+	WebSocket string `json:"websocket,omitempty" yaml:"websocket,omitempty"`
+	// QUICListen QUIC 隧道监听的 UDP 地址，为空时不启用，未配置 tls 证书时使用由 host_key 生成的自签名证书
+	QUICListen string `json:"quic_listen,omitempty" yaml:"quic_listen,omitempty"`
+	// HeartbeatTimeout 超过该时间未收到客户端心跳时断开隧道，QUIC 隧道不小于 QUIC 连接的空闲超时，默认 30s
+	HeartbeatTimeout time.Duration `json:"heartbeat_timeout" yaml:"heartbeat_timeout,omitempty"`
+	// IdleTimeout 隧道上没有 link 且超过该时间没有数据传输时断开隧道，为 0 时不限制
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty" yaml:"idle_timeout,omitempty"`
+	// PolicyFile 访问策略文件，相对路径相对于配置文件所在目录，为空时不启用
+	PolicyFile string `json:"policy_file,omitempty" yaml:"policy_file,omitempty"`
+	// Admins 管理员账号，AdminGroups 管理员用户组，可以试运行其他用户的访问策略，支持 * 和 ? 通配符
+	Admins      []string `json:"admins,omitempty" yaml:"admins,omitempty"`
+	AdminGroups []string `json:"admin_groups,omitempty" yaml:"admin_groups,omitempty"`
+	// GrantStore 临时访问申请和授权的存储文件，默认与配置文件位于同一目录
+	GrantStore string `json:"-" yaml:"grant_store,omitempty"`
+	// AuditLog 临时访问申请、审批和过期等审计事件的日志文件，每行一个 JSON 事件，默认与配置文件位于同一目录
+	AuditLog string `json:"-" yaml:"audit_log,omitempty"`
+	// TokenStore 个人访问令牌的存储文件，只保存令牌的摘要，默认与配置文件位于同一目录
+	TokenStore string `json:"-" yaml:"token_store,omitempty"`
+	// TokenMaxTTL 个人访问令牌的最长有效期，默认 90 天
+	TokenMaxTTL time.Duration `json:"token_max_ttl,omitempty" yaml:"token_max_ttl,omitempty"`
 
 	Verbose  bool   `json:"verbose" yaml:"verbose,omitempty"`
 	AuthType string `json:"auth_type" yaml:"auth_type"`
 	LogPath  string `json:"log_path" yaml:"log_path"`
 
 	LDAP  LDAP  `json:"ldap" yaml:"ldap,omitempty"`
+	OIDC  OIDC  `json:"oidc" yaml:"oidc,omitempty"`
 	Users Users `json:"users,omitempty" yaml:"users,omitempty"`
 }
 
+// ServerTLS 服务端 TLS 配置
+type ServerTLS struct {
+	Cert       string `json:"cert,omitempty" yaml:"cert,omitempty"`
+	Key        string `json:"-" yaml:"key,omitempty"`
+	MinVersion string `json:"min_version,omitempty" yaml:"min_version,omitempty"`
+	// ClientCA 用于校验客户端证书的 CA 证书
+	ClientCA string `json:"client_ca,omitempty" yaml:"client_ca,omitempty"`
+	// RequireClientCert 是否要求客户端必须提供证书
+	RequireClientCert bool `json:"require_client_cert,omitempty" yaml:"require_client_cert,omitempty"`
+	// CertAuth 使用客户端证书中的身份登录，无需密码
+	CertAuth bool `json:"cert_auth,omitempty" yaml:"cert_auth,omitempty"`
+	// CertUserField 客户端证书中作为账号的字段：cn|email|dns|uri
+	CertUserField string `json:"cert_user_field,omitempty" yaml:"cert_user_field,omitempty"`
+	// CertGroups 账号不存在于用户系统中时，使用客户端证书的 OU 作为用户组。开启后签发客户端证书的 CA 可以决定用户组，默认关闭
+	CertGroups bool `json:"cert_groups,omitempty" yaml:"cert_groups,omitempty"`
+}
+
+// Enabled 是否启用 TLS
+func (t ServerTLS) Enabled() bool {
+	return t.Cert != "" && t.Key != ""
+}
+
 type BackendServer struct {
+	// Addr 后端地址，unix:/path 表示连接 Unix socket 文件
 	Addr        string `json:"addr" yaml:"addr"`
 	Name        string `json:"name" yaml:"name"`
 	Protocol    string `json:"protocol" yaml:"protocol"`
 	BindSuggest string `json:"bind_suggest,omitempty" yaml:"bind_suggest,omitempty"`
+
+	// Compression 该后端允许使用的压缩算法：snappy|zstd，为空时不压缩，具体算法按客户端的优先级选择
+	Compression []string `json:"compression,omitempty" yaml:"compression,omitempty"`
+	// RateLimit 该后端所有连接共享的传输速率限制，为空时不限制
+	RateLimit RateLimit `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	// Priority 同一隧道中该后端的连接发送数据的优先级：high|normal|low，默认为 normal
+	Priority string `json:"priority,omitempty" yaml:"priority,omitempty"`
+
+	// AllowUsers、AllowGroups 允许访问该后端的账号和用户组，都为空时允许所有用户访问
+	// DenyUsers、DenyGroups 禁止访问该后端的账号和用户组，优先于允许规则，所有规则都支持 * 和 ? 通配符
+	AllowUsers  []string `json:"allow_users,omitempty" yaml:"allow_users,omitempty"`
+	AllowGroups []string `json:"allow_groups,omitempty" yaml:"allow_groups,omitempty"`
+	DenyUsers   []string `json:"deny_users,omitempty" yaml:"deny_users,omitempty"`
+	DenyGroups  []string `json:"deny_groups,omitempty" yaml:"deny_groups,omitempty"`
+
+	// JIT 临时访问授权，启用后用户需要申请并经过审批才能在授权期限内访问该后端，申请人需要满足访问控制规则
+	JIT JITAccess `json:"jit,omitempty" yaml:"jit,omitempty"`
+}
+
+// JITAccess 后端的临时访问授权配置
+type JITAccess struct {
+	// Approvers、ApproverGroups 可以审批访问申请的账号和用户组，都为空时不启用临时访问授权
+	Approvers      []string `json:"approvers,omitempty" yaml:"approvers,omitempty"`
+	ApproverGroups []string `json:"approver_groups,omitempty" yaml:"approver_groups,omitempty"`
+	// MaxDuration 单次授权的最长时间，默认 8h
+	MaxDuration time.Duration `json:"max_duration,omitempty" yaml:"max_duration,omitempty"`
+}
+
+// Enabled 是否启用临时访问授权
+func (jit JITAccess) Enabled() bool {
+	return len(jit.Approvers) > 0 || len(jit.ApproverGroups) > 0
+}
+
+// IsApprover 用户是否可以审批访问申请
+func (jit JITAccess) IsApprover(account string, groups []string) bool {
+	if matchAny(jit.Approvers, account) {
+		return true
+	}
+
+	for _, group := range groups {
+		if matchAny(jit.ApproverGroups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsAdmin 用户是否为管理员
+func (conf Server) IsAdmin(account string, groups []string) bool {
+	if matchAny(conf.Admins, account) {
+		return true
+	}
+
+	for _, group := range groups {
+		if matchAny(conf.AdminGroups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Restricted 是否配置了访问控制规则
+func (back BackendServer) Restricted() bool {
+	return len(back.AllowUsers) > 0 || len(back.AllowGroups) > 0 || len(back.DenyUsers) > 0 || len(back.DenyGroups) > 0
+}
+
+// Allowed 用户是否可以访问该后端，禁止规则优先，配置了允许规则时必须匹配其中之一
+func (back BackendServer) Allowed(account string, groups []string) bool {
+	if matchAny(back.DenyUsers, account) {
+		return false
+	}
+
+	for _, group := range groups {
+		if matchAny(back.DenyGroups, group) {
+			return false
+		}
+	}
+
+	if len(back.AllowUsers) == 0 && len(back.AllowGroups) == 0 {
+		return true
+	}
+
+	if matchAny(back.AllowUsers, account) {
+		return true
+	}
+
+	for _, group := range groups {
+		if matchAny(back.AllowGroups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchAny name 是否匹配 patterns 中的任意一个通配符规则
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
 }
 
 // populateDefault 填充默认值
@@ -65,6 +246,30 @@ func (conf Server) populateDefault() Server {
 		conf.AuthType = "misc"
 	}
 
+	if len(conf.Ciphers) == 0 {
+		conf.Ciphers = []string{"aes-256-gcm", "chacha20-poly1305"}
+	}
+
+	if conf.OIDC.UsernameClaim == "" {
+		conf.OIDC.UsernameClaim = "preferred_username"
+	}
+
+	if conf.OIDC.GroupsClaim == "" {
+		conf.OIDC.GroupsClaim = "groups"
+	}
+
+	if conf.HeartbeatTimeout == 0 {
+		conf.HeartbeatTimeout = 30 * time.Second
+	}
+
+	if conf.TokenMaxTTL == 0 {
+		conf.TokenMaxTTL = 90 * 24 * time.Hour
+	}
+
+	if conf.TLS.CertUserField == "" {
+		conf.TLS.CertUserField = "cn"
+	}
+
 	if conf.LDAP.DisplayName == "" {
 		conf.LDAP.DisplayName = "displayName"
 	}
@@ -86,6 +291,10 @@ func (conf Server) populateDefault() Server {
 			back.Protocol = "tcp"
 		}
 
+		if back.JIT.Enabled() && back.JIT.MaxDuration == 0 {
+			back.JIT.MaxDuration = 8 * time.Hour
+		}
+
 		conf.Backends[i] = back
 	}
 
@@ -94,8 +303,79 @@ func (conf Server) populateDefault() Server {
 
 // validate 配置合法性检查
 func (conf Server) validate() error {
-	if !str.In(conf.AuthType, []string{"misc", "ldap", "local"}) {
-		return fmt.Errorf("invalid auth_type: must be one of misc|local|ldap")
+	if !str.In(conf.AuthType, []string{"misc", "ldap", "local", "oidc"}) {
+		return fmt.Errorf("invalid auth_type: must be one of misc|local|ldap|oidc")
+	}
+
+	if conf.AuthType == "oidc" && (conf.OIDC.Issuer == "" || conf.OIDC.ClientID == "") {
+		return fmt.Errorf("oidc.issuer and oidc.client_id are required when auth_type is oidc")
+	}
+
+	if !str.In(conf.TLS.CertUserField, []string{"cn", "email", "dns", "uri"}) {
+		return fmt.Errorf("invalid tls.cert_user_field: must be one of cn|email|dns|uri")
+	}
+
+	if (conf.TLS.RequireClientCert || conf.TLS.CertAuth) && (!conf.TLS.Enabled() || conf.TLS.ClientCA == "") {
+		return fmt.Errorf("tls.cert, tls.key and tls.client_ca are required when client certificate is enabled")
+	}
+
+	if conf.HeartbeatTimeout < 3*time.Second || conf.IdleTimeout < 0 {
+		return fmt.Errorf("invalid heartbeat_timeout or idle_timeout: heartbeat_timeout must be at least 3s")
+	}
+
+	if conf.WebSocket != "" && !strings.HasPrefix(conf.WebSocket, "/") {
+		return fmt.Errorf("invalid websocket: path must start with /")
+	}
+
+	for _, back := range conf.Backends {
+		if path, ok := UnixSocketPath(back.Addr); ok && (path == "" || back.Protocol == "udp") {
+			return fmt.Errorf("invalid addr for backend %s: unix socket path is required and only tcp is supported", back.Name)
+		}
+
+		for _, patterns := range [][]string{back.AllowUsers, back.AllowGroups, back.DenyUsers, back.DenyGroups, back.JIT.Approvers, back.JIT.ApproverGroups} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid access rule %s for backend %s: %v", pattern, back.Name, err)
+				}
+			}
+		}
+
+		if !str.In(back.Priority, []string{"", "high", "normal", "low"}) {
+			return fmt.Errorf("invalid priority for backend %s: must be one of high|normal|low", back.Name)
+		}
+
+		if back.RateLimit.Enabled() {
+			if _, _, err := back.RateLimit.Parse(); err != nil {
+				return fmt.Errorf("invalid rate_limit for backend %s: %v", back.Name, err)
+			}
+		}
+
+		if back.JIT.Enabled() && back.JIT.MaxDuration < 0 {
+			return fmt.Errorf("invalid jit.max_duration for backend %s: must be positive", back.Name)
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, conf.Admins...), conf.AdminGroups...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid admin rule %s: %v", pattern, err)
+		}
+	}
+
+	rateLimitRules := make(map[string]bool)
+	for i, limit := range conf.Users.RateLimits {
+		if (limit.Account == "") == (limit.Group == "") {
+			return fmt.Errorf("invalid users.rate_limits[%d]: one of account or group is required", i)
+		}
+
+		key := "account:" + limit.Account + "group:" + limit.Group
+		if rateLimitRules[key] {
+			return fmt.Errorf("invalid users.rate_limits[%d]: duplicate rule for %s%s", i, limit.Account, limit.Group)
+		}
+		rateLimitRules[key] = true
+
+		if _, _, err := limit.Parse(); err != nil {
+			return fmt.Errorf("invalid users.rate_limits[%d]: %v", i, err)
+		}
 	}
 
 	for i, user := range conf.Users.Local {
@@ -0,0 +1,383 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type literalNode struct {
+	v value
+}
+
+func (n *literalNode) eval(vars map[string]value) (value, error) {
+	return n.v, nil
+}
+
+type variableNode struct {
+	name string
+}
+
+func (n *variableNode) eval(vars map[string]value) (value, error) {
+	v, ok := vars[n.name]
+	if !ok {
+		return nil, fmt.Errorf("variable %s is not set", n.name)
+	}
+	return v, nil
+}
+
+type listNode struct {
+	items []node
+}
+
+func (n *listNode) eval(vars map[string]value) (value, error) {
+	list := make([]value, 0, len(n.items))
+	for _, item := range n.items {
+		v, err := item.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(vars map[string]value) (value, error) {
+	v, err := evalBool(n.operand, vars, "!")
+	if err != nil {
+		return nil, err
+	}
+	return !v, nil
+}
+
+// logicalNode && 和 || 运算，左侧的结果可以确定结果时不再执行右侧
+type logicalNode struct {
+	or          bool
+	left, right node
+}
+
+func (n *logicalNode) eval(vars map[string]value) (value, error) {
+	op := "&&"
+	if n.or {
+		op = "||"
+	}
+
+	left, err := evalBool(n.left, vars, op)
+	if err != nil {
+		return nil, err
+	}
+
+	if left == n.or {
+		return left, nil
+	}
+
+	return evalBool(n.right, vars, op)
+}
+
+func evalBool(n node, vars map[string]value, op string) (bool, error) {
+	v, err := n.eval(vars)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("operand of %s must be bool, got %s", op, typeName(v))
+	}
+	return b, nil
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n *compareNode) eval(vars map[string]value) (value, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==", "!=":
+		eq, err := equal(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return eq == (n.op == "=="), nil
+	case "in":
+		return contains(right, left)
+	case "contains":
+		return contains(left, right)
+	}
+
+	// cmp 小于、等于、大于时分别为 -1、0、1
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("can not compare %s %s %s", typeName(left), n.op, typeName(right))
+		}
+
+		if l < r {
+			cmp = -1
+		} else if l > r {
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("can not compare %s %s %s", typeName(left), n.op, typeName(right))
+		}
+		cmp = strings.Compare(l, r)
+	default:
+		return nil, fmt.Errorf("can not compare %s %s %s", typeName(left), n.op, typeName(right))
+	}
+
+	switch n.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+// equal 比较两个标量是否相等，类型不同时返回错误，避免 "8" == 8 这类错误的规则一直不匹配
+func equal(left, right value) (bool, error) {
+	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return l == r, nil
+		}
+	case float64:
+		if r, ok := right.(float64); ok {
+			return l == r, nil
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			return l == r, nil
+		}
+	}
+
+	return false, fmt.Errorf("can not compare %s with %s", typeName(left), typeName(right))
+}
+
+// contains 列表是否包含元素，或字符串是否包含子串
+func contains(container, item value) (bool, error) {
+	switch c := container.(type) {
+	case []value:
+		for _, v := range c {
+			eq, err := equal(v, item)
+			if err != nil {
+				return false, err
+			}
+			if eq {
+				return true, nil
+			}
+		}
+		return false, nil
+	case string:
+		if s, ok := item.(string); ok {
+			return strings.Contains(c, s), nil
+		}
+	}
+
+	return false, fmt.Errorf("%s can not contain %s", typeName(container), typeName(item))
+}
+
+// matchNode 正则匹配，右侧为字符串字面量时在编译时预先编译正则表达式
+type matchNode struct {
+	left, right node
+	re          *regexp.Regexp
+}
+
+func newMatchNode(left, right node) (node, error) {
+	n := &matchNode{left: left, right: right}
+	if lit, ok := right.(*literalNode); ok {
+		pattern, ok := lit.v.(string)
+		if !ok {
+			return nil, fmt.Errorf("pattern of matches must be string, got %s", typeName(lit.v))
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+		n.re = re
+	}
+
+	return n, nil
+}
+
+func (n *matchNode) eval(vars map[string]value) (value, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := left.(string)
+	if !ok {
+		return nil, fmt.Errorf("operand of matches must be string, got %s", typeName(left))
+	}
+
+	re := n.re
+	if re == nil {
+		right, err := n.right.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+
+		pattern, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("pattern of matches must be string, got %s", typeName(right))
+		}
+
+		if re, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+	}
+
+	return re.MatchString(s), nil
+}
+
+// function 表达式中可以调用的函数，maxArgs 小于 0 表示不限制参数数量
+type function struct {
+	minArgs, maxArgs int
+	call             func(args []value) (value, error)
+}
+
+var functions = map[string]function{
+	// cidr(ip, network...) ip 是否属于任意一个网段
+	"cidr": {minArgs: 2, maxArgs: -1, call: func(args []value) (value, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("ip of cidr must be string, got %s", typeName(args[0]))
+		}
+
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return false, nil
+		}
+
+		for _, arg := range args[1:] {
+			network, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("network of cidr must be string, got %s", typeName(arg))
+			}
+
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %s: %v", network, err)
+			}
+
+			if ipNet.Contains(ip) {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}},
+	// glob(s, pattern) 字符串是否匹配通配符，s 为列表时任意一个元素匹配即可
+	"glob": {minArgs: 2, maxArgs: 2, call: func(args []value) (value, error) {
+		pattern, ok := args[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("pattern of glob must be string, got %s", typeName(args[1]))
+		}
+
+		names, ok := args[0].([]value)
+		if !ok {
+			names = []value{args[0]}
+		}
+
+		for _, name := range names {
+			s, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("operand of glob must be string, got %s", typeName(name))
+			}
+
+			matched, err := path.Match(pattern, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+			}
+
+			if matched {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}},
+	"lower": {minArgs: 1, maxArgs: 1, call: func(args []value) (value, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("operand of lower must be string, got %s", typeName(args[0]))
+		}
+		return strings.ToLower(s), nil
+	}},
+	"upper": {minArgs: 1, maxArgs: 1, call: func(args []value) (value, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("operand of upper must be string, got %s", typeName(args[0]))
+		}
+		return strings.ToUpper(s), nil
+	}},
+	"len": {minArgs: 1, maxArgs: 1, call: func(args []value) (value, error) {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []value:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("operand of len must be string or list, got %s", typeName(args[0]))
+	}},
+}
+
+type callNode struct {
+	name string
+	fn   function
+	args []node
+}
+
+func (n *callNode) eval(vars map[string]value) (value, error) {
+	args := make([]value, 0, len(n.args))
+	for _, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+
+	return n.fn.call(args)
+}
+
+func typeName(v value) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case []value:
+		return "list"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,364 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mylxsw/go-utils/str"
+)
+
+// value 表达式的值，类型为 string、float64、bool 或 []value
+type value interface{}
+
+// node 表达式语法树的节点
+type node interface {
+	eval(vars map[string]value) (value, error)
+}
+
+// Expr 编译后的访问策略表达式
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile 编译表达式，表达式中引用的变量和函数必须存在
+//
+// 支持的语法：
+//   - 字面量："str" 'str' 123 1.5 true false [a, b]
+//   - 变量：user.account backend.name client.os time.hour 等
+//   - 运算符：|| && ! == != < <= > >= in contains matches，in 与 contains 可用于列表和字符串，matches 的右侧为正则表达式
+//   - 函数：cidr(ip, network...) glob(s, pattern) lower(s) upper(s) len(x)
+func Compile(src string) (*Expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+
+	return &Expr{src: src, root: root}, nil
+}
+
+// String 表达式源码
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval 使用变量执行表达式，表达式的结果必须为 bool
+func (e *Expr) Eval(vars map[string]value) (bool, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression result must be bool, got %s", typeName(v))
+	}
+
+	return b, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (tok token) String() string {
+	switch tok.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(tok.text)
+	}
+	return fmt.Sprintf("'%s'", tok.text)
+}
+
+// operators 多字符运算符需要排在其前缀之前
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "!", "<", ">", "(", ")", "[", "]", ","}
+
+func tokenize(src string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			// 反斜线只转义引号和反斜线本身，正则表达式中的 \d 等保持原样
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) && (src[j+1] == c || src[j+1] == '\\') {
+					j++
+				}
+				sb.WriteByte(src[j])
+			}
+
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+
+			tokens = append(tokens, token{kind: tokString, text: sb.String(), pos: i})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:j], pos: i})
+			i = j
+		case isIdentChar(c) && c != '.':
+			j := i
+			for j < len(src) && isIdentChar(src[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[i:j], pos: i})
+			i = j
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return nil, fmt.Errorf("unexpected character '%c' at position %d", c, i)
+			}
+		}
+	}
+
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
+
+// parser 递归下降解析器，优先级从低到高：|| && ! 比较运算 基本表达式
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept 当前 token 为指定的运算符或关键字时前进一步
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if tok := p.peek(); tok.kind == kind && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(tokOp, text) {
+		tok := p.peek()
+		return fmt.Errorf("expect '%s' at position %d, got %s", text, tok.pos, tok)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokOp, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokOp, "&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.accept(tokOp, "!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	switch {
+	case tok.kind == tokOp && str.In(tok.text, []string{"==", "!=", "<", "<=", ">", ">="}),
+		tok.kind == tokIdent && str.In(tok.text, []string{"in", "contains", "matches"}):
+		p.next()
+	default:
+		return left, nil
+	}
+
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.text == "matches" {
+		return newMatchNode(left, right)
+	}
+
+	return &compareNode{op: tok.text, left: left, right: right}, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return &literalNode{v: tok.text}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at position %d", tok.text, tok.pos)
+		}
+		return &literalNode{v: f}, nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			return p.parseList()
+		}
+	case tokIdent:
+		switch tok.text {
+		case "true", "false":
+			return &literalNode{v: tok.text == "true"}, nil
+		}
+
+		if p.accept(tokOp, "(") {
+			return p.parseCall(tok)
+		}
+
+		if _, ok := variables[tok.text]; !ok {
+			return nil, fmt.Errorf("unknown variable %s at position %d", tok.text, tok.pos)
+		}
+		return &variableNode{name: tok.text}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+}
+
+func (p *parser) parseList() (node, error) {
+	list := &listNode{}
+	if p.accept(tokOp, "]") {
+		return list, nil
+	}
+
+	for {
+		item, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		list.items = append(list.items, item)
+
+		if p.accept(tokOp, "]") {
+			return list, nil
+		}
+
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s at position %d", name.text, name.pos)
+	}
+
+	call := &callNode{name: name.text, fn: fn}
+	if !p.accept(tokOp, ")") {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+
+			if p.accept(tokOp, ")") {
+				break
+			}
+
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(call.args) < fn.minArgs || (fn.maxArgs >= 0 && len(call.args) > fn.maxArgs) {
+		return nil, fmt.Errorf("invalid number of arguments for function %s at position %d", name.text, name.pos)
+	}
+
+	return call, nil
+}
@@ -0,0 +1,84 @@
+package policy
+
+import "testing"
+
+func TestExprEval(t *testing.T) {
+	vars := map[string]value{
+		"user.account": "alice",
+		"user.groups":  []value{"dba", "ops-east"},
+		"client.os":    "linux",
+		"remote.ip":    "10.1.2.3",
+		"time.hour":    float64(10),
+		"time.clock":   "09:30",
+	}
+
+	testCases := []struct {
+		expr   string
+		result bool
+	}{
+		{`"dba" in user.groups && client.os == "linux"`, true},
+		{`user.groups contains "admin" || user.account == "alice"`, true},
+		{`!(time.hour >= 9 && time.hour < 19)`, false},
+		{`time.clock >= "09:00" && time.clock < "19:00"`, true},
+		{`client.os in ["darwin", 'windows']`, false},
+		{`user.account matches "^ali\w+$"`, true},
+		{`"lin" in client.os`, true},
+		{`cidr(remote.ip, "192.168.0.0/16", "10.0.0.0/8")`, true},
+		{`glob(user.groups, "ops-*") && len(user.groups) == 2`, true},
+		{`upper(client.os) == "LINUX" && lower("A") != "a"`, false},
+		// 左侧已经可以确定结果时不执行右侧，右侧的类型错误不会报错
+		{`client.os == "windows" && time.hour == "10"`, false},
+	}
+
+	for _, tc := range testCases {
+		expr, err := Compile(tc.expr)
+		if err != nil {
+			t.Fatalf("compile %s failed: %v", tc.expr, err)
+		}
+
+		result, err := expr.Eval(vars)
+		if err != nil {
+			t.Fatalf("eval %s failed: %v", tc.expr, err)
+		}
+
+		if result != tc.result {
+			t.Errorf("expect %s to be %v", tc.expr, tc.result)
+		}
+	}
+}
+
+func TestExprCompileError(t *testing.T) {
+	for _, src := range []string{
+		`user.unknown == "a"`,
+		`unknown(user.account)`,
+		`cidr(remote.ip)`,
+		`user.account == "a`,
+		`(user.account == "a"`,
+		`user.account matches "("`,
+		`user.account == "a" client.os`,
+		`user.account @ "a"`,
+	} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("compile %s should fail", src)
+		}
+	}
+}
+
+func TestExprEvalError(t *testing.T) {
+	vars := map[string]value{"time.hour": float64(10), "user.account": "alice"}
+	for _, src := range []string{
+		`time.hour == "10"`,
+		`user.account`,
+		`user.account > 1`,
+		`!user.account`,
+	} {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Fatalf("compile %s failed: %v", src, err)
+		}
+
+		if _, err := expr.Eval(vars); err == nil {
+			t.Errorf("eval %s should fail", src)
+		}
+	}
+}
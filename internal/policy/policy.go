@@ -0,0 +1,327 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"gopkg.in/yaml.v3"
+)
+
+// Effect 规则命中后的处理方式：allow|deny
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// Backend 访问的后端
+type Backend struct {
+	Name     string `json:"name" yaml:"name"`
+	Addr     string `json:"addr,omitempty" yaml:"addr,omitempty"`
+	Protocol string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+}
+
+// Input 执行访问策略时的上下文
+type Input struct {
+	User    auth.AuthedUser   `json:"user" yaml:"user"`
+	Backend Backend           `json:"backend" yaml:"backend"`
+	Client  common.SystemInfo `json:"client" yaml:"client"`
+	// Remote 客户端地址，ip:port 或 ip
+	Remote string `json:"remote,omitempty" yaml:"remote,omitempty"`
+	// Time 访问时间，为空时使用当前时间
+	Time time.Time `json:"time,omitempty" yaml:"time,omitempty"`
+}
+
+// variables 表达式中可以使用的变量
+var variables = map[string]string{
+	"user.account":          "string",
+	"user.name":             "string",
+	"user.type":             "string",
+	"user.groups":           "list",
+	"backend.name":          "string",
+	"backend.addr":          "string",
+	"backend.protocol":      "string",
+	"client.version":        "string",
+	"client.os":             "string",
+	"client.arch":           "string",
+	"client.hostname":       "string",
+	"client.platform":       "string",
+	"client.kernel_version": "string",
+	"client.net_interfaces": "list",
+	"remote.addr":           "string",
+	"remote.ip":             "string",
+	"time.hour":             "number",
+	"time.minute":           "number",
+	"time.weekday":          "string", // Mon Tue Wed Thu Fri Sat Sun
+	"time.clock":            "string", // 15:04
+	"time.date":             "string", // 2006-01-02
+}
+
+func stringList(items []string) []value {
+	list := make([]value, 0, len(items))
+	for _, item := range items {
+		list = append(list, item)
+	}
+	return list
+}
+
+// vars 表达式变量的值，时间转换为策略的时区
+func (in Input) vars(loc *time.Location) map[string]value {
+	t := in.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	t = t.In(loc)
+
+	remoteIP := in.Remote
+	if host, _, err := net.SplitHostPort(in.Remote); err == nil {
+		remoteIP = host
+	}
+
+	return map[string]value{
+		"user.account":          in.User.Account,
+		"user.name":             in.User.Name,
+		"user.type":             in.User.Type,
+		"user.groups":           stringList(in.User.Groups),
+		"backend.name":          in.Backend.Name,
+		"backend.addr":          in.Backend.Addr,
+		"backend.protocol":      in.Backend.Protocol,
+		"client.version":        in.Client.Version,
+		"client.os":             in.Client.OS,
+		"client.arch":           in.Client.Arch,
+		"client.hostname":       in.Client.Hostname,
+		"client.platform":       in.Client.Platform,
+		"client.kernel_version": in.Client.KernelVersion,
+		"client.net_interfaces": stringList(in.Client.NetInterfaces),
+		"remote.addr":           in.Remote,
+		"remote.ip":             remoteIP,
+		"time.hour":             float64(t.Hour()),
+		"time.minute":           float64(t.Minute()),
+		"time.weekday":          t.Format("Mon"),
+		"time.clock":            t.Format("15:04"),
+		"time.date":             t.Format("2006-01-02"),
+	}
+}
+
+// Rule 访问策略规则
+type Rule struct {
+	Name string `json:"name" yaml:"name"`
+	// Backends 规则适用的后端，支持 * 和 ? 通配符，为空时适用于所有后端
+	Backends []string `json:"backends,omitempty" yaml:"backends,omitempty"`
+	// When 规则的条件表达式，为空时总是命中
+	When   string `json:"when,omitempty" yaml:"when,omitempty"`
+	Effect Effect `json:"effect" yaml:"effect"`
+
+	expr *Expr
+}
+
+// appliesTo 规则是否适用于后端
+func (rule *Rule) appliesTo(backend string) bool {
+	if len(rule.Backends) == 0 {
+		return true
+	}
+
+	for _, pattern := range rule.Backends {
+		if ok, _ := path.Match(pattern, backend); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TestCase 策略文件中的测试用例，加载策略时执行，保证规则的修改符合预期
+type TestCase struct {
+	Name   string `json:"name" yaml:"name"`
+	Input  Input  `json:"input" yaml:"input"`
+	Expect Effect `json:"expect" yaml:"expect"`
+	// Rule 期望命中的规则，为空时不检查
+	Rule string `json:"rule,omitempty" yaml:"rule,omitempty"`
+}
+
+// Policy 访问策略，规则按顺序执行，第一条命中的规则决定是否允许访问，都未命中时使用 Default
+type Policy struct {
+	// Timezone 时间相关变量使用的时区，为空时使用本地时区
+	Timezone string     `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	Default  Effect     `json:"default,omitempty" yaml:"default,omitempty"`
+	Rules    []*Rule    `json:"rules" yaml:"rules"`
+	Tests    []TestCase `json:"tests,omitempty" yaml:"tests,omitempty"`
+
+	loc *time.Location
+}
+
+// Decision 访问策略的执行结果
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Rule    string `json:"rule,omitempty"`  // 命中的规则，为空时表示使用默认策略
+	Error   string `json:"error,omitempty"` // 规则执行出错，此时拒绝访问
+}
+
+func (d Decision) String() string {
+	effect := Allow
+	if !d.Allowed {
+		effect = Deny
+	}
+
+	rule := d.Rule
+	if rule == "" {
+		rule = "default"
+	}
+
+	if d.Error != "" {
+		return fmt.Sprintf("%s by rule %s: %s", effect, rule, d.Error)
+	}
+
+	return fmt.Sprintf("%s by rule %s", effect, rule)
+}
+
+// LoadFile 从文件加载访问策略，并执行其中的测试用例
+func LoadFile(filename string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", filename, err)
+	}
+
+	if err := p.RunTests(); err != nil {
+		return nil, fmt.Errorf("policy file %s test failed: %v", filename, err)
+	}
+
+	return p, nil
+}
+
+// Parse 解析并编译访问策略
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (p *Policy) compile() error {
+	if p.Default == "" {
+		p.Default = Allow
+	}
+
+	if p.Default != Allow && p.Default != Deny {
+		return fmt.Errorf("invalid default effect %s: must be one of allow|deny", p.Default)
+	}
+
+	p.loc = time.Local
+	if p.Timezone != "" {
+		loc, err := time.LoadLocation(p.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %s: %v", p.Timezone, err)
+		}
+		p.loc = loc
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("name is required for rule #%d", i+1)
+		}
+
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if rule.Effect != Allow && rule.Effect != Deny {
+			return fmt.Errorf("invalid effect %s for rule %s: must be one of allow|deny", rule.Effect, rule.Name)
+		}
+
+		for _, pattern := range rule.Backends {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid backend pattern %s for rule %s: %v", pattern, rule.Name, err)
+			}
+		}
+
+		if strings.TrimSpace(rule.When) == "" {
+			continue
+		}
+
+		expr, err := Compile(rule.When)
+		if err != nil {
+			return fmt.Errorf("invalid expression for rule %s: %v", rule.Name, err)
+		}
+		rule.expr = expr
+	}
+
+	for _, tc := range p.Tests {
+		if tc.Expect != Allow && tc.Expect != Deny {
+			return fmt.Errorf("invalid expect %s for test %s: must be one of allow|deny", tc.Expect, tc.Name)
+		}
+
+		if tc.Rule != "" && !names[tc.Rule] {
+			return fmt.Errorf("test %s expects unknown rule %s", tc.Name, tc.Rule)
+		}
+	}
+
+	return nil
+}
+
+// Evaluate 执行访问策略，规则执行出错时拒绝访问
+func (p *Policy) Evaluate(in Input) Decision {
+	vars := in.vars(p.loc)
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(in.Backend.Name) {
+			continue
+		}
+
+		if rule.expr != nil {
+			matched, err := rule.expr.Eval(vars)
+			if err != nil {
+				return Decision{Allowed: false, Rule: rule.Name, Error: err.Error()}
+			}
+
+			if !matched {
+				continue
+			}
+		}
+
+		return Decision{Allowed: rule.Effect == Allow, Rule: rule.Name}
+	}
+
+	return Decision{Allowed: p.Default == Allow}
+}
+
+// RunTests 执行策略文件中的所有测试用例，返回所有失败的用例
+func (p *Policy) RunTests() error {
+	failures := make([]string, 0)
+	for _, tc := range p.Tests {
+		d := p.Evaluate(tc.Input)
+		if d.Allowed != (tc.Expect == Allow) || (tc.Rule != "" && d.Rule != tc.Rule) {
+			expect := string(tc.Expect)
+			if tc.Rule != "" {
+				expect = fmt.Sprintf("%s by rule %s", tc.Expect, tc.Rule)
+			}
+
+			failures = append(failures, fmt.Sprintf("%s: expect %s, got %s", tc.Name, expect, d))
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+)
+
+// TestExamplePolicy 执行示例策略文件中的测试用例
+func TestExamplePolicy(t *testing.T) {
+	p, err := LoadFile("../../policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Tests) == 0 {
+		t.Fatal("example policy should contain test cases")
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	p, err := Parse([]byte(`
+timezone: UTC
+default: deny
+rules:
+  - name: broken
+    backends: [broken]
+    effect: allow
+    when: user.account > 1
+  - name: night
+    effect: deny
+    when: time.hour < 6
+  - name: admin
+    effect: allow
+    when: '"admin" in user.groups'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := auth.AuthedUser{Account: "root", Groups: []string{"admin"}}
+	day := time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC)
+
+	if d := p.Evaluate(Input{User: admin, Backend: Backend{Name: "mysql"}, Time: day}); !d.Allowed || d.Rule != "admin" {
+		t.Fatalf("admin should be allowed by rule admin, got %s", d)
+	}
+
+	if d := p.Evaluate(Input{User: admin, Backend: Backend{Name: "mysql"}, Time: day.Add(-8 * time.Hour)}); d.Allowed || d.Rule != "night" {
+		t.Fatalf("access at night should be denied by rule night, got %s", d)
+	}
+
+	if d := p.Evaluate(Input{User: auth.AuthedUser{Account: "guest"}, Backend: Backend{Name: "mysql"}, Time: day}); d.Allowed || d.Rule != "" {
+		t.Fatalf("unmatched access should be denied by default, got %s", d)
+	}
+
+	// 规则执行出错时拒绝访问
+	if d := p.Evaluate(Input{User: admin, Backend: Backend{Name: "broken"}, Time: day}); d.Allowed || d.Error == "" {
+		t.Fatalf("access should be denied when rule failed, got %s", d)
+	}
+}
+
+func TestPolicyRunTests(t *testing.T) {
+	p, err := Parse([]byte(`
+rules:
+  - name: linux-only
+    effect: deny
+    when: client.os != "linux"
+tests:
+  - name: windows
+    input:
+      client: {os: windows}
+    expect: allow
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.RunTests(); err == nil {
+		t.Fatal("failed test case should be reported")
+	}
+
+	for _, data := range []string{
+		"default: maybe",
+		"rules: [{effect: allow}]",
+		"rules: [{name: a, effect: allow}, {name: a, effect: deny}]",
+		"rules: [{name: a, effect: allow, when: 'user.account =='}]",
+		"rules: [{name: a, effect: allow}]\ntests: [{name: t, expect: allow, rule: b}]",
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("invalid policy should be rejected: %s", data)
+		}
+	}
+}
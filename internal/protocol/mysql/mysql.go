@@ -250,7 +250,7 @@ func judgeStatusFlags(packet []byte) []GeneralPacketStatusFlag {
 		0x4000: SERVER_SESSION_STATE_CHANGED,
 	}
 
-	byte2 := int(packet[1]<<8 | packet[0])
+	byte2 := int(packet[1])<<8 | int(packet[0])
 
 	for k, v := range generalStatus {
 		if byte2&k == k {
@@ -319,7 +319,7 @@ func decodeLengthEncodedInt(packet []byte) (int, int) {
 		return 3, int(uint32(packet[3])<<16 | uint32(packet[2])<<8 | uint32(packet[1]))
 	case 0xfe:
 		return 8, int(
-			uint64(packet[8])<<56 | uint64(packet[7])<<48 | uint64(packet[6]<<40) |
+			uint64(packet[8])<<56 | uint64(packet[7])<<48 | uint64(packet[6])<<40 |
 				uint64(packet[5])<<32 | uint64(packet[4])<<24 | uint64(packet[3])<<16 |
 				uint64(packet[2])<<8 | uint64(packet[1]))
 	}
@@ -349,7 +349,7 @@ func decodeLengthEncodedString(packet []byte) (int, string) {
 		ilen = 8
 
 		slen = int(
-			uint64(packet[8])<<56 | uint64(packet[7])<<48 | uint64(packet[6]<<40) |
+			uint64(packet[8])<<56 | uint64(packet[7])<<48 | uint64(packet[6])<<40 |
 				uint64(packet[5])<<32 | uint64(packet[4])<<24 | uint64(packet[3])<<16 |
 				uint64(packet[2])<<8 | uint64(packet[1]))
 	}
@@ -696,8 +696,8 @@ func mapPacket(plen int, packet []byte) IMySQLPacket {
 		sid := int(uint32(packet[7]) | uint32(packet[8])<<8 | uint32(packet[9])<<16 | uint32(packet[10])<<24)
 		binlogFilenameLen := int(uint32(packet[11]) | uint32(packet[12])<<8 | uint32(packet[13])<<16 | uint32(packet[14])<<24)
 		offset := 15 + binlogFilenameLen
-		binlogPos := int(uint32(packet[offset]) | uint32(packet[offset+1])<<8 | uint32(packet[offset+2])<<16 | uint32(packet[offset+3])<<24 |
-			uint32(packet[offset+4])<<32 | uint32(packet[offset+5])<<40 | uint32(packet[offset+6])<<48 | uint32(packet[offset+7])<<56)
+		binlogPos := int(uint64(packet[offset]) | uint64(packet[offset+1])<<8 | uint64(packet[offset+2])<<16 | uint64(packet[offset+3])<<24 |
+			uint64(packet[offset+4])<<32 | uint64(packet[offset+5])<<40 | uint64(packet[offset+6])<<48 | uint64(packet[offset+7])<<56)
 		dataSize := 0
 		if plen > 19+binlogFilenameLen {
 			dataSize = int(uint32(packet[offset+8]) | uint32(packet[offset+9])<<8 | uint32(packet[offset+10])<<16 | uint32(packet[offset+11])<<24)
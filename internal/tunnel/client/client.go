@@ -3,15 +3,19 @@ package client
 import (
 	"container/heap"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/mylxsw/asteria/log"
 	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/go-utils/str"
 	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/auth/oidc"
 	"github.com/mylxsw/secure-tunnel/internal/config"
 	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
 	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,39 +26,115 @@ type Client struct {
 	conf             *config.Client
 	version          string
 
-	backend    config.BackendPortMapping
+	backends   []config.BackendPortMapping
 	serverAddr string
 	secret     string
 	tunnels    uint
+	ciphers    []common.CipherSuite
+	tlsConf    *tls.Config
+	knownHosts *knownHosts
+	dialer     *proxyDialer
 
-	alloc *idAllocator
-	cq    queue
-	lock  sync.Mutex
+	compressions []common.Compression // 客户端支持的压缩算法，按优先级排序
+	multiplex    bool                 // 所有后端共享隧道，创建 link 时指定目标后端
+
+	cq   queue
+	lock sync.Mutex
+
+	deniedOnce sync.Once
+	oidc       *oidc.TokenSource // 使用 OIDC 登录时获取 ID Token，为 nil 时使用配置中的密码或令牌
 }
 
-func NewClient(version string, serverAddr, secret string, backend config.BackendPortMapping, tunnels uint, conf *config.Client) (*Client, error) {
+// NewClient create a tunnel client, backends 包含多个后端时必须启用多路复用
+// tokens 为多个客户端共享的 OIDC 令牌获取器，不使用 OIDC 时为 nil
+func NewClient(version string, serverAddr, secret string, backends []config.BackendPortMapping, tunnels uint, conf *config.Client, tokens *oidc.TokenSource) (*Client, error) {
+	if len(backends) > 1 && !conf.Multiplex {
+		return nil, errors.New("multiple backends over one client requires multiplex")
+	}
+
+	var ciphers []common.CipherSuite
+	if conf.Cipher != "" {
+		suite, err := common.ParseCipherSuite(conf.Cipher)
+		if err != nil {
+			return nil, err
+		}
+
+		ciphers = []common.CipherSuite{suite}
+	} else {
+		ciphers = common.DefaultCipherSuites
+	}
+
+	compressions, err := common.PreferCompression(conf.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if isQUICAddr(serverAddr) && conf.Proxy != "" {
+		return nil, errors.New("quic can not be used with proxy")
+	}
+
+	dialer, err := newProxyDialer(conf.Proxy, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf, err := buildTLSConfig(conf.TLS, strings.TrimPrefix(serverAddr, quicScheme))
+	if err != nil {
+		return nil, err
+	}
+
 	client := &Client{
-		conf:       conf,
-		version:    version,
-		backend:    backend,
-		serverAddr: serverAddr,
-		secret:     secret,
-		tunnels:    tunnels,
-		alloc:      newIDAllocator(),
-		cq:         make(queue, tunnels)[0:0],
+		conf:         conf,
+		version:      version,
+		backends:     backends,
+		serverAddr:   serverAddr,
+		secret:       secret,
+		tunnels:      tunnels,
+		ciphers:      ciphers,
+		compressions: compressions,
+		multiplex:    conf.Multiplex,
+		tlsConf:      tlsConf,
+		knownHosts:   newKnownHosts(conf.KnownHosts),
+		dialer:       dialer,
+		cq:           make(queue, tunnels)[0:0],
+		oidc:         tokens,
 	}
 	return client, nil
 }
 
 func (cli *Client) dial() (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", cli.serverAddr, 5*time.Second)
+	if isWebSocketAddr(cli.serverAddr) {
+		return cli.dialWebSocket()
+	}
+
+	if isQUICAddr(cli.serverAddr) {
+		return cli.dialQUIC()
+	}
+
+	conn, err := cli.dialer.Dial("tcp", cli.serverAddr)
 	if err != nil {
 		return nil, err
 	}
-	tcpConn := conn.(*net.TCPConn)
-	_ = tcpConn.SetKeepAlive(true)
-	_ = tcpConn.SetKeepAlivePeriod(time.Second * 180)
-	return tcpConn, nil
+
+	// 通过代理连接时 conn 可能不是 *net.TCPConn
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetKeepAlive(true)
+		_ = tcpConn.SetKeepAlivePeriod(time.Second * 180)
+	}
+
+	if cli.tlsConf == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, cli.tlsConf)
+	_ = tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		_ = tlsConn.Close()
+		return nil, fmt.Errorf("tls handshake failed: %v", err)
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
 }
 
 func (cli *Client) createHub(gf infra.Graceful) (hubItem *queueItem, err error) {
@@ -69,6 +149,12 @@ func (cli *Client) createHub(gf infra.Graceful) (hubItem *queueItem, err error)
 	clientInfo := common.InspectSystemInfo()
 	clientInfo.Version = cli.version
 
+	// 在连接服务端之前获取凭据，使用 OIDC 时可能需要等待用户在浏览器中完成登录
+	password, err := cli.credential()
+	if err != nil {
+		panic(fmt.Errorf("get credential failed: %v", err))
+	}
+
 	conn, err := cli.dial()
 	if err != nil {
 		panic(fmt.Errorf("dial failed: %v", err))
@@ -84,50 +170,85 @@ func (cli *Client) createHub(gf infra.Graceful) (hubItem *queueItem, err error)
 	token, ok := a.ExchangeCipherBlock(challenge)
 	if !ok {
 		err = errors.New("exchange challenge failed")
-		panic(fmt.Errorf("exchange challenge failed(%v)", tun))
+		panic(fmt.Errorf("exchange challenge failed(%v): invalid or expired challenge, please check the secret and system clock", tun))
 	}
 
-	if err = tun.WritePacket(0, token); err != nil {
-		panic(fmt.Errorf("write token failed(%v):%s", tun, err))
+	legacy, err := cli.negotiateSession(tun, a, challenge, token)
+	if err != nil {
+		panic(fmt.Errorf("negotiate session failed(%v): %v", tun, explainHandshakeError(err)))
 	}
 
-	tun.SetCipherKey(a.GetRc4key())
-
-	// 上报客户端信息
-	if err = tun.WritePacket(0, clientInfo.Encode()); err != nil {
-		panic(fmt.Errorf("write client info to server failed(%v): %v", tun, err))
+	quicConn, isQUIC := conn.(*common.QUICConn)
+	var binding []byte
+	if isQUIC && !legacy {
+		if binding, err = quicConn.ChannelBinding(); err != nil {
+			panic(fmt.Errorf("export channel binding failed(%v): %v", tun, err))
+		}
 	}
 
-	_, clientInfoResp, err := tun.ReadPacket()
-	if err != nil {
-		panic(fmt.Errorf("read client info response failed(%v): %s", tun, err))
-	}
+	var capabilities common.Capability
+	var resp *common.AuthResponse
+	if legacy {
+		if cli.multiplex {
+			panic(fmt.Errorf("handshake failed(%v): multiplex is not supported by legacy protocol", tun))
+		}
 
-	if string(clientInfoResp) != "ok" {
-		panic(fmt.Errorf("client info exchange failed: %s", string(clientInfoResp)))
-	}
+		if isQUIC {
+			panic(fmt.Errorf("handshake failed(%v): quic is not supported by legacy protocol", tun))
+		}
+
+		err = cli.legacyHandshake(tun, clientInfo, password)
+	} else {
+		var hello *common.ServerHello
+		var compression common.Compression
+		if hello, resp, compression, err = cli.handshake(tun, clientInfo, password, binding); err == nil {
+			capabilities = hello.Capabilities & common.SupportedCapabilities
+			if hello.Version >= common.WideFrameVersion {
+				tun.EnableWideFrames()
+			}
+
+			err = tun.SetCompression(compression)
+		}
 
-	// 用户身份鉴权
-	if err = tun.WritePacket(0, common.BuildAuthPacket(cli.conf.Username, cli.conf.Password, cli.backend.Backend)); err != nil {
-		panic(fmt.Errorf("write username & password failed(%v):%v", tun, err))
+		if err == nil && cli.multiplex && !capabilities.Has(common.CapMultiplex) {
+			err = errors.New("server does not support multiplex, please upgrade the server or disable multiplex")
+		}
 	}
 
-	_, authedPacket, err := tun.ReadPacket()
 	if err != nil {
-		panic(fmt.Errorf("auth failed(%v):%s", tun, err))
+		panic(fmt.Errorf("handshake failed(%v): %v", tun, explainHandshakeError(err)))
 	}
 
-	if string(authedPacket) != "ok" {
-		panic(fmt.Errorf("auth failed: %s", string(authedPacket)))
+	h := newClientHub(tun, capabilities, quicConn)
+	if cli.multiplex && resp != nil && resp.Backends != nil {
+		h.denied = cli.deniedBackends(resp.Backends)
 	}
 
-	hubItem = &queueItem{
-		Hub: newClientHub(tun),
-	}
+	hubItem = &queueItem{Hub: h}
 
 	return
 }
 
+// deniedBackends 多路复用时本地配置中用户无权访问的后端，首次握手时输出警告
+func (cli *Client) deniedBackends(allowed []string) map[string]bool {
+	denied := make(map[string]bool)
+	for _, backend := range cli.backends {
+		if !str.In(backend.Backend, allowed) {
+			denied[backend.Backend] = true
+		}
+	}
+
+	cli.deniedOnce.Do(func() {
+		for _, backend := range cli.backends {
+			if denied[backend.Backend] {
+				log.Warningf("access to backend %s is denied for user %s, connections to %s will be rejected", backend.Backend, cli.conf.Username, backend.Listen)
+			}
+		}
+	})
+
+	return denied
+}
+
 func (cli *Client) addHub(item *queueItem) {
 	cli.lock.Lock()
 	heap.Push(&cli.cq, item)
@@ -160,41 +281,109 @@ func (cli *Client) dropHub(item *queueItem) {
 	cli.lock.Unlock()
 }
 
-func (cli *Client) handleConnection(item *queueItem, conn *net.TCPConn) {
+// String 客户端名称，用于日志输出
+func (cli *Client) String() string {
+	names := make([]string, 0, len(cli.backends))
+	for _, backend := range cli.backends {
+		names = append(names, backend.Backend)
+	}
+
+	return strings.Join(names, ",")
+}
+
+// credential 登录使用的凭据，使用 OIDC 时为 ID Token，即将过期时自动刷新
+func (cli *Client) credential() (string, error) {
+	if cli.oidc != nil {
+		return cli.oidc.IDToken()
+	}
+
+	return cli.conf.Credential(), nil
+}
+
+// authBackend 鉴权时绑定的后端，多路复用时为空
+func (cli *Client) authBackend() string {
+	if cli.multiplex {
+		return ""
+	}
+
+	return cli.backends[0].Backend
+}
+
+func (cli *Client) handleConnection(item *queueItem, conn hub.Conn, backend config.BackendPortMapping) {
 	defer common.ErrorHandler()
 	defer cli.dropHub(item)
 	defer func() {
 		_ = conn.Close()
 	}()
 
-	id := cli.alloc.Acquire()
-	defer cli.alloc.Release(id)
-
 	h := item.Hub
+	if h.denied[backend.Backend] {
+		log.Errorf("access to backend %s is denied for user %s", backend.Backend, cli.conf.Username)
+		return
+	}
+
+	id, ok := h.alloc.Acquire()
+	if !ok {
+		log.Errorf("no available link id over %s", h.TunnelName())
+		return
+	}
+	defer h.alloc.Release(id)
+
 	l := h.CreateLink(id)
 	defer h.DeleteLink(id)
 
-	h.SendCommand(id, hub.LinkCreate)
-	h.StartLink(l, conn, &auth.AuthedUser{Account: cli.conf.Username})
+	var target string
+	if cli.multiplex {
+		target = backend.Backend
+	}
+
+	authedUser := &auth.AuthedUser{Account: cli.conf.Username}
+	if h.streams != nil {
+		// QUIC 连接中每个 link 使用独立的数据流，流头部中包含 LinkCreate 所需的信息
+		stream, err := h.openStream(id, target)
+		if err != nil {
+			log.Errorf("link(%d) open stream over %s failed: %v", id, h.TunnelName(), err)
+			return
+		}
+
+		h.StartStreamLink(l, stream, conn, authedUser)
+		return
+	}
+
+	// 配置已校验过优先级，无法解析时使用默认优先级
+	priority, _ := hub.ParsePriority(backend.Priority)
+	h.SetLinkPriority(id, priority)
+
+	if cli.multiplex {
+		h.SendLinkCreate(id, target)
+	} else {
+		h.SendCommand(id, hub.LinkCreate)
+	}
+	h.StartLink(l, conn, authedUser)
 }
 
-func (cli *Client) listen(ctx context.Context, gf infra.Graceful) error {
-	ln, err := net.Listen("tcp", cli.backend.Listen)
+func (cli *Client) listen(ctx context.Context, gf infra.Graceful, backend config.BackendPortMapping) error {
+	var ln net.Listener
+	var err error
+	if path, ok := config.UnixSocketPath(backend.Listen); ok {
+		ln, err = listenUnix(path)
+	} else {
+		ln, err = net.Listen("tcp", backend.Listen)
+	}
 	if err != nil {
 		return err
 	}
 
 	defer func() { _ = ln.Close() }()
 
-	log.Debugf("listen on %s for %s ...", cli.backend.Listen, cli.backend.Backend)
+	log.Debugf("listen on %s for %s ...", backend.Listen, backend.Backend)
 
-	tcpListener := ln.(*net.TCPListener)
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
-			conn, err := tcpListener.AcceptTCP()
+			conn, err := ln.Accept()
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 					log.Warningf("accept failed temporary: %s", netErr.Error())
@@ -208,7 +397,7 @@ func (cli *Client) listen(ctx context.Context, gf infra.Graceful) error {
 			cli.initConnToRemote.Do(func() {
 				cli.initialize(ctx, gf)
 				// 第一次连接本地端口时，延迟3s先建立与服务端的连接
-				log.Debugf("connect to server %s...", cli.backend.Backend)
+				log.Debugf("connect to server %s...", cli)
 				time.Sleep(3 * time.Second)
 			})
 
@@ -219,16 +408,37 @@ func (cli *Client) listen(ctx context.Context, gf infra.Graceful) error {
 				continue
 			}
 
-			_ = conn.SetKeepAlive(true)
-			_ = conn.SetKeepAlivePeriod(time.Second * 60)
-			go cli.handleConnection(h, conn)
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				_ = tcpConn.SetKeepAlive(true)
+				_ = tcpConn.SetKeepAlivePeriod(time.Second * 60)
+			}
+			go cli.handleConnection(h, conn.(hub.Conn), backend)
 		}
 	}
 }
 
 // Start .
 func (cli *Client) Start(ctx context.Context, gf infra.Graceful) error {
-	return cli.listen(ctx, gf)
+	errs := make(chan error, len(cli.backends))
+	for _, backend := range cli.backends {
+		go func(backend config.BackendPortMapping) {
+			if backend.Protocol == "udp" {
+				errs <- cli.listenUDP(ctx, gf, backend)
+				return
+			}
+
+			errs <- cli.listen(ctx, gf, backend)
+		}(backend)
+	}
+
+	// 任意一个端口监听失败时返回错误
+	for range cli.backends {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (cli *Client) initialize(ctx context.Context, gf infra.Graceful) {
@@ -243,20 +453,31 @@ func (cli *Client) initialize(ctx context.Context, gf infra.Graceful) {
 				default:
 					h, err := cli.createHub(gf)
 					if err != nil {
-						log.Errorf("tunnel %d for %s reconnect failed", index, cli.backend.Backend)
+						log.Errorf("tunnel %d for %s reconnect failed", index, cli)
 						time.Sleep(time.Second * 15)
 						continue
 					}
 
 					func() {
-						log.Debugf("tunnel %d for %s connect succeed", index, cli.backend.Backend)
+						log.Debugf("tunnel %d for %s connect succeed", index, cli)
 						defer func() {
 							cli.removeHub(h)
-							log.Warningf("tunnel %d for %s disconnected", index, cli.backend.Backend)
+							log.Warningf("tunnel %d for %s disconnected", index, cli)
 						}()
 
 						cli.addHub(h)
-						h.Start()
+
+						done := make(chan struct{})
+						go func() {
+							defer close(done)
+							h.Start()
+						}()
+
+						// 服务端要求断开的隧道不再分配新的连接，已有连接结束后由 hub 自行关闭，同时建立新的隧道替代它
+						select {
+						case <-done:
+						case <-h.goAway:
+						}
 					}()
 				}
 			}
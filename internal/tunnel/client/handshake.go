@@ -0,0 +1,213 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"fmt"
+
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+)
+
+// negotiateSession 发送 token 并完成临时密钥交换和加密算法协商，只配置 rc4 时使用旧版本协议
+func (cli *Client) negotiateSession(tun *hub.Tunnel, a *common.EncryptAlgorithm, challenge []byte, token []byte) (legacy bool, err error) {
+	if len(cli.ciphers) == 1 && cli.ciphers[0] == common.CipherRC4 {
+		if err := tun.WritePacket(0, token); err != nil {
+			return true, fmt.Errorf("write token failed: %v", err)
+		}
+
+		tun.SetCipherKey(a.GetRc4key())
+		return true, nil
+	}
+
+	if err := a.GenerateKeyPair(); err != nil {
+		return false, err
+	}
+
+	nonce, err := common.GenerateNonce()
+	if err != nil {
+		return false, err
+	}
+
+	hello := append(token, nonce...)
+	hello = append(hello, a.PublicKey()...)
+	for _, suite := range cli.ciphers {
+		hello = append(hello, byte(suite))
+	}
+
+	a.Transcript(challenge, hello)
+	if err := tun.WritePacket(0, append(hello, a.SignTranscript()...)); err != nil {
+		return false, fmt.Errorf("write token failed: %v", err)
+	}
+
+	_, resp, err := tun.ReadPacket()
+	if err != nil {
+		return false, fmt.Errorf("read server hello failed: %v", err)
+	}
+
+	replySize := 1 + common.KeyExchangeSize + common.HostKeySize
+	if len(resp) != replySize+common.HostSignatureSize+common.HandshakeMacSize {
+		if herr, ok := common.DecodeHandshakeError(resp); ok {
+			return false, herr
+		}
+
+		return false, fmt.Errorf("invalid server hello: unexpected length %d", len(resp))
+	}
+
+	reply := resp[:replySize]
+	hostSign := resp[replySize : replySize+common.HostSignatureSize]
+	sign := resp[replySize+common.HostSignatureSize:]
+
+	// 校验服务端身份，防止持有 secret 的第三方冒充服务端
+	hostKey := ed25519.PublicKey(reply[1+common.KeyExchangeSize:])
+	a.Transcript(reply)
+	if !a.VerifyHostSignature(hostKey, hostSign) {
+		return false, fmt.Errorf("verify server identity signature failed")
+	}
+
+	if err := cli.knownHosts.Verify(cli.serverAddr, hostKey); err != nil {
+		return false, err
+	}
+
+	a.Transcript(hostSign)
+	if !a.VerifyTranscript(sign) {
+		return false, fmt.Errorf("verify server hello signature failed")
+	}
+
+	suite := common.CipherSuite(reply[0])
+	if !suite.IsAEAD() || !common.ContainsCipherSuite(cli.ciphers, suite) {
+		return false, fmt.Errorf("server selected unexpected cipher %s", suite)
+	}
+
+	if err := a.ExchangeKey(reply[1 : 1+common.KeyExchangeSize]); err != nil {
+		return false, err
+	}
+
+	clientKey, serverKey := a.SessionKeys(suite)
+	return false, tun.SetFrameCipher(suite, clientKey, serverKey)
+}
+
+// handshake 使用结构化的握手消息完成版本协商和身份认证，返回服务端握手响应、鉴权响应和服务端选择的压缩算法
+// binding 为 QUIC 连接的通道绑定值，其他传输方式为 nil
+func (cli *Client) handshake(tun *hub.Tunnel, clientInfo common.SystemInfo, password string, binding []byte) (*common.ServerHello, *common.AuthResponse, common.Compression, error) {
+	if err := tun.WritePacket(0, common.EncodeMessage(common.MsgClientHello, common.ClientHello{
+		Version:      common.ProtocolVersion,
+		Capabilities: common.SupportedCapabilities,
+		Client:       clientInfo,
+	})); err != nil {
+		return nil, nil, common.CompressionNone, fmt.Errorf("write client hello failed: %v", err)
+	}
+
+	_, data, err := tun.ReadPacket()
+	if err != nil {
+		return nil, nil, common.CompressionNone, fmt.Errorf("read server hello failed: %v", err)
+	}
+
+	var hello common.ServerHello
+	if err := common.DecodeMessage(data, common.MsgServerHello, &hello); err != nil {
+		return nil, nil, common.CompressionNone, err
+	}
+
+	if hello.Error != nil {
+		return nil, nil, common.CompressionNone, hello.Error
+	}
+
+	if hello.Version < common.MinProtocolVersion || hello.Version > common.ProtocolVersion {
+		return nil, nil, common.CompressionNone, fmt.Errorf("server selected unsupported protocol version %d", hello.Version)
+	}
+
+	// 用户身份鉴权
+	if err := tun.WritePacket(0, common.EncodeMessage(common.MsgAuthRequest, common.AuthRequest{
+		Username: cli.conf.Username,
+		Password: password,
+		Backend:  cli.authBackend(),
+
+		Compressions:   common.CompressionNames(cli.compressions),
+		ChannelBinding: binding,
+	})); err != nil {
+		return nil, nil, common.CompressionNone, fmt.Errorf("write auth request failed: %v", err)
+	}
+
+	_, data, err = tun.ReadPacket()
+	if err != nil {
+		return nil, nil, common.CompressionNone, fmt.Errorf("read auth response failed: %v", err)
+	}
+
+	var resp common.AuthResponse
+	if err := common.DecodeMessage(data, common.MsgAuthResponse, &resp); err != nil {
+		return nil, nil, common.CompressionNone, err
+	}
+
+	if resp.Error != nil {
+		return nil, nil, common.CompressionNone, resp.Error
+	}
+
+	if binding != nil && !hmac.Equal(resp.ChannelBinding, binding) {
+		return nil, nil, common.CompressionNone, fmt.Errorf("quic channel binding mismatch, the connection may be intercepted")
+	}
+
+	compression, err := common.ParseCompression(resp.Compression)
+	if err != nil || (compression != common.CompressionNone && !common.ContainsCompression(cli.compressions, compression)) {
+		return nil, nil, common.CompressionNone, fmt.Errorf("server selected unsupported compression %s", resp.Compression)
+	}
+
+	return &hello, &resp, compression, nil
+}
+
+// legacyHandshake 兼容旧版本服务端的握手流程
+func (cli *Client) legacyHandshake(tun *hub.Tunnel, clientInfo common.SystemInfo, password string) error {
+	// 上报客户端信息
+	if err := tun.WritePacket(0, clientInfo.Encode()); err != nil {
+		return fmt.Errorf("write client info to server failed: %v", err)
+	}
+
+	_, clientInfoResp, err := tun.ReadPacket()
+	if err != nil {
+		return fmt.Errorf("read client info response failed: %v", err)
+	}
+
+	if string(clientInfoResp) != "ok" {
+		return fmt.Errorf("client info exchange failed: %s", string(clientInfoResp))
+	}
+
+	// 用户身份鉴权
+	if err := tun.WritePacket(0, common.BuildAuthPacket(cli.conf.Username, password, cli.authBackend())); err != nil {
+		return fmt.Errorf("write username & password failed: %v", err)
+	}
+
+	_, authedPacket, err := tun.ReadPacket()
+	if err != nil {
+		return fmt.Errorf("auth failed: %v", err)
+	}
+
+	if string(authedPacket) != "ok" {
+		return fmt.Errorf("auth failed: %s", string(authedPacket))
+	}
+
+	return nil
+}
+
+// explainHandshakeError 根据握手错误码生成便于用户理解的错误信息
+func explainHandshakeError(err error) error {
+	herr, ok := err.(*common.HandshakeError)
+	if !ok {
+		return err
+	}
+
+	switch herr.Code {
+	case common.ErrCodeAuthFailed:
+		return fmt.Errorf("authentication failed for user %s: %s", herr.Fields["username"], herr.Message)
+	case common.ErrCodeUnknownBackend:
+		return fmt.Errorf("backend %s does not exist on server, please check your config", herr.Fields["backend"])
+	case common.ErrCodeAccessDenied:
+		return fmt.Errorf("user %s is not allowed to access backend %s (%s), please contact the administrator", herr.Fields["username"], herr.Fields["backend"], herr.Message)
+	case common.ErrCodeChannelBinding:
+		return fmt.Errorf("quic channel binding mismatch, the connection may be intercepted")
+	case common.ErrCodeNoCommonCipher:
+		return fmt.Errorf("no cipher in common with server (server supports %s), please check the cipher config", herr.Fields["supported"])
+	case common.ErrCodeUnsupportedVersion:
+		return fmt.Errorf("protocol version %d is not supported by server (supported %s-%s), please upgrade the client", common.ProtocolVersion, herr.Fields["min_version"], herr.Fields["max_version"])
+	}
+
+	return err
+}
@@ -2,7 +2,9 @@ package client
 
 import (
 	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
 	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+	"sync"
 	"time"
 )
 
@@ -15,15 +17,24 @@ const (
 // Hub manages client links
 type Hub struct {
 	*hub.Hub
+	alloc    *idAllocator
 	sent     uint16
 	received uint16
+
+	streams *common.QUICConn // QUIC 连接，link 使用独立的数据流，其他传输方式为 nil
+	timeout time.Duration    // 心跳超时时间
+
+	goAwayOnce sync.Once
+	goAway     chan struct{} // 收到服务端的 TunGoAway 后关闭
+
+	denied map[string]bool // 多路复用时用户无权访问的后端
 }
 
 func (h *Hub) heartbeat() {
 	ticker := time.NewTicker(Heartbeat)
 	defer ticker.Stop()
 
-	maxSpan := int(Timeout / Heartbeat)
+	maxSpan := int(h.timeout / Heartbeat)
 	if maxSpan <= TunnelMinSpan {
 		maxSpan = TunnelMinSpan
 	}
@@ -41,7 +52,7 @@ func (h *Hub) heartbeat() {
 		}
 
 		h.sent = h.sent + 1
-		if !h.SendCommand(h.sent, hub.TunHeartbeat) {
+		if !h.SendCommand(uint32(h.sent), hub.TunHeartbeat) {
 			break
 		}
 	}
@@ -51,15 +62,51 @@ func (h *Hub) onCtrl(cmd hub.Command) bool {
 	id := cmd.ID
 	switch cmd.Cmd {
 	case hub.TunHeartbeat:
-		h.received = id
+		h.received = uint16(id)
+		return true
+	case hub.TunPing:
+		h.SendCommand(id, hub.TunPong)
+		return true
+	case hub.TunGoAway:
+		h.goAwayOnce.Do(func() {
+			log.Warningf("%s is going away, %d links remaining", h.TunnelName(), h.LinkCount())
+			close(h.goAway)
+			go h.drain()
+		})
 		return true
 	}
 	return false
 }
 
-func newClientHub(tun *hub.Tunnel) *Hub {
+// drain 等待隧道上已有的 link 结束后关闭隧道
+func (h *Hub) drain() {
+	ticker := time.NewTicker(Heartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if h.LinkCount() == 0 {
+			h.Hub.Close()
+			return
+		}
+	}
+}
+
+func newClientHub(tun *hub.Tunnel, capabilities common.Capability, streams *common.QUICConn) *Hub {
 	h := &Hub{
-		Hub: hub.NewHub(tun),
+		Hub:     hub.NewHub(tun),
+		alloc:   newIDAllocator(tun.MaxLinkID()),
+		streams: streams,
+		timeout: Timeout,
+		goAway:  make(chan struct{}),
+	}
+
+	// 切换网络期间 QUIC 连接保持可用，心跳超时时间与 QUIC 连接的空闲超时保持一致
+	if streams != nil {
+		h.timeout = common.QUICIdleTimeout
+	}
+
+	if capabilities.Has(common.CapFlowControl) {
+		h.Hub.EnableFlowControl()
 	}
 	h.Hub.OnCtrlFilter = h.onCtrl
 	go h.heartbeat()
@@ -1,26 +1,43 @@
 package client
 
-const (
-	MaxID = ^uint16(0)
-)
+import "sync"
 
+// idAllocator link ID 分配器，按需递增分配新 ID，释放的 ID 按先进先出的顺序复用
 type idAllocator struct {
-	freeList chan uint16
+	lock     sync.Mutex
+	max      uint32
+	next     uint32 // 下一个从未分配过的 ID，为 0 表示已经超出 uint32 范围
+	freeList []uint32
 }
 
-func (alloc *idAllocator) Acquire() uint16 {
-	return <-alloc.freeList
+// Acquire 分配一个 link ID，ID 耗尽时返回 false
+func (alloc *idAllocator) Acquire() (uint32, bool) {
+	alloc.lock.Lock()
+	defer alloc.lock.Unlock()
+
+	if len(alloc.freeList) > 0 {
+		id := alloc.freeList[0]
+		alloc.freeList = alloc.freeList[1:]
+		return id, true
+	}
+
+	if alloc.next == 0 || alloc.next > alloc.max {
+		return 0, false
+	}
+
+	id := alloc.next
+	alloc.next++
+	return id, true
 }
 
-func (alloc *idAllocator) Release(id uint16) {
-	alloc.freeList <- id
+func (alloc *idAllocator) Release(id uint32) {
+	alloc.lock.Lock()
+	defer alloc.lock.Unlock()
+
+	alloc.freeList = append(alloc.freeList, id)
 }
 
-func newIDAllocator() *idAllocator {
-	freeList := make(chan uint16, MaxID)
-	var id uint16
-	for id = 1; id != MaxID; id++ {
-		freeList <- id
-	}
-	return &idAllocator{freeList: freeList}
+// newIDAllocator 创建 ID 分配器，分配的 ID 范围为 [1, max]，0 保留给控制命令
+func newIDAllocator(max uint32) *idAllocator {
+	return &idAllocator{max: max, next: 1}
 }
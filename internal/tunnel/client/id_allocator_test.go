@@ -0,0 +1,33 @@
+package client
+
+import "testing"
+
+func TestIDAllocator(t *testing.T) {
+	alloc := newIDAllocator(3)
+	for i := uint32(1); i <= 3; i++ {
+		id, ok := alloc.Acquire()
+		if !ok || id != i {
+			t.Fatalf("expect id %d, got %d", i, id)
+		}
+	}
+
+	if _, ok := alloc.Acquire(); ok {
+		t.Fatal("acquire should fail when ids exhausted")
+	}
+
+	alloc.Release(2)
+	alloc.Release(1)
+	if id, _ := alloc.Acquire(); id != 2 {
+		t.Fatalf("released ids should be reused in order, got %d", id)
+	}
+
+	alloc = newIDAllocator(^uint32(0))
+	alloc.next = ^uint32(0)
+	if id, ok := alloc.Acquire(); !ok || id != ^uint32(0) {
+		t.Fatalf("expect max id, got %d", id)
+	}
+
+	if _, ok := alloc.Acquire(); ok {
+		t.Fatal("acquire should fail after max id allocated")
+	}
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+)
+
+// knownHosts 服务端身份公钥信任列表，首次连接时记录服务端公钥，之后公钥发生变化时拒绝连接
+// 文件每行格式为：服务端地址 ed25519 base64(公钥)
+type knownHosts struct {
+	path string
+	lock sync.Mutex
+}
+
+func newKnownHosts(path string) *knownHosts {
+	return &knownHosts{path: path}
+}
+
+// Verify 校验服务端身份公钥
+func (kh *knownHosts) Verify(server string, key ed25519.PublicKey) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+
+	known, err := kh.lookup(server)
+	if err != nil {
+		return err
+	}
+
+	if known == nil {
+		if err := kh.add(server, key); err != nil {
+			return err
+		}
+
+		log.Warningf("permanently added server %s with key %s to %s", server, common.Fingerprint(key), kh.path)
+		return nil
+	}
+
+	if !known.Equal(key) {
+		return fmt.Errorf(
+			"server identity for %s has changed (expected %s, got %s), possible man-in-the-middle attack, remove the entry from %s if the server key was rotated",
+			server, common.Fingerprint(known), common.Fingerprint(key), kh.path,
+		)
+	}
+
+	return nil
+}
+
+func (kh *knownHosts) lookup(server string) (ed25519.PublicKey, error) {
+	f, err := os.Open(kh.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("open known hosts %s failed: %v", kh.path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") || fields[0] != server || fields[1] != "ed25519" {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid key for %s in %s", server, kh.path)
+		}
+
+		return key, nil
+	}
+
+	return nil, scanner.Err()
+}
+
+func (kh *knownHosts) add(server string, key ed25519.PublicKey) error {
+	f, err := os.OpenFile(kh.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open known hosts %s failed: %v", kh.path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	_, err = fmt.Fprintf(f, "%s ed25519 %s\n", server, base64.StdEncoding.EncodeToString(key))
+	return err
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newHostKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+
+	key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestKnownHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	kh := newKnownHosts(path)
+	key := newHostKey(t)
+
+	// 首次连接时记录服务端公钥
+	if err := kh.Verify("tunnel.example.com:8081", key); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "tunnel.example.com:8081 ed25519 " + base64.StdEncoding.EncodeToString(key) + "\n"
+	if string(data) != expect {
+		t.Fatalf("unexpected known hosts: %q", data)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Fatalf("expect known hosts mode 0600, got %v", stat.Mode().Perm())
+	}
+
+	// 公钥未变化时通过校验，不重复记录
+	if err := kh.Verify("tunnel.example.com:8081", key); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := ioutil.ReadFile(path); string(data) != expect {
+		t.Fatalf("known server should not be added again: %q", data)
+	}
+
+	// 公钥变化时拒绝连接，并提示如何处理
+	err = kh.Verify("tunnel.example.com:8081", newHostKey(t))
+	if err == nil {
+		t.Fatal("changed server key should be rejected")
+	}
+
+	if !strings.Contains(err.Error(), "has changed") || !strings.Contains(err.Error(), path) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 其它服务端单独记录
+	if err := kh.Verify("backup.example.com:8081", newHostKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := ioutil.ReadFile(path); strings.Count(string(data), "\n") != 2 {
+		t.Fatalf("expect 2 known servers, got %q", data)
+	}
+}
+
+func TestKnownHostsMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	key := newHostKey(t)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	content := strings.Join([]string{
+		"# tunnel.example.com:8081 ed25519 " + encoded,
+		"",
+		"garbage",
+		"tunnel.example.com:8081 rsa " + encoded,
+		"tunnel.example.com:8081 ed25519 " + encoded + " extra",
+		"broken.example.com:8081 ed25519 not-base64!",
+		"short.example.com:8081 ed25519 " + base64.StdEncoding.EncodeToString(key[:16]),
+		"tunnel.example.com:8081 ed25519 " + encoded,
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kh := newKnownHosts(path)
+
+	// 注释、格式不正确和其它算法的行被忽略
+	if err := kh.Verify("tunnel.example.com:8081", key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kh.Verify("tunnel.example.com:8081", newHostKey(t)); err == nil {
+		t.Fatal("changed server key should be rejected")
+	}
+
+	// 服务端的公钥无法解析时拒绝连接，不能当作首次连接覆盖记录
+	for _, server := range []string{"broken.example.com:8081", "short.example.com:8081"} {
+		err := kh.Verify(server, key)
+		if err == nil || !strings.Contains(err.Error(), "invalid key") {
+			t.Fatalf("invalid key of %s should be rejected, got %v", server, err)
+		}
+	}
+
+	if data, _ := ioutil.ReadFile(path); string(data) != content {
+		t.Fatalf("known hosts should not be changed: %q", data)
+	}
+}
@@ -0,0 +1,351 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyDialer 连接服务端，配置了代理时通过 HTTP CONNECT 或 SOCKS5 代理建立连接
+type proxyDialer struct {
+	proxy   *url.URL // 配置文件中指定的代理，为空时使用 HTTPS_PROXY/NO_PROXY 环境变量
+	timeout time.Duration
+}
+
+func newProxyDialer(proxy string, timeout time.Duration) (*proxyDialer, error) {
+	d := &proxyDialer{timeout: timeout}
+	if proxy == "" {
+		return d, nil
+	}
+
+	proxyURL, err := parseProxyURL(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	d.proxy = proxyURL
+	return d, nil
+}
+
+// parseProxyURL 解析代理地址，支持 http 和 socks5，未指定端口时使用默认端口
+func parseProxyURL(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %v", proxy, err)
+	}
+
+	var defaultPort string
+	switch proxyURL.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	default:
+		return nil, fmt.Errorf("invalid proxy %s: unsupported scheme %s, must be one of http|socks5", proxy, proxyURL.Scheme)
+	}
+
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %s: host is required", proxy)
+	}
+
+	if proxyURL.Port() == "" {
+		proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), defaultPort)
+	}
+
+	return proxyURL, nil
+}
+
+// proxyFor 返回连接 addr 时使用的代理，不使用代理时返回 nil
+func (d *proxyDialer) proxyFor(addr string) (*url.URL, error) {
+	if d.proxy != nil {
+		return d.proxy, nil
+	}
+
+	proxy := getEnv("HTTPS_PROXY", "https_proxy")
+	if proxy == "" {
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	if matchNoProxy(getEnv("NO_PROXY", "no_proxy"), host) {
+		return nil, nil
+	}
+
+	// 环境变量中的代理地址可以省略 scheme
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+
+	return parseProxyURL(proxy)
+}
+
+// Dial 建立到 addr 的 TCP 连接
+func (d *proxyDialer) Dial(network, addr string) (net.Conn, error) {
+	proxyURL, err := d.proxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL == nil {
+		return net.DialTimeout(network, addr, d.timeout)
+	}
+
+	conn, err := net.DialTimeout(network, proxyURL.Host, d.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect to proxy %s failed: %v", proxyURL.Host, err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(d.timeout))
+	if proxyURL.Scheme == "http" {
+		conn, err = httpConnect(conn, proxyURL, addr)
+	} else {
+		err = socks5Connect(conn, proxyURL, addr)
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("connect to %s via proxy %s failed: %v", addr, proxyURL.Host, err)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// bufferedConn 读取代理响应时可能预读了服务端发送的数据，需要先返回缓冲区中的数据
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// httpConnect 通过 HTTP CONNECT 方法建立隧道
+func httpConnect(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy responded %s", resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5CmdConnect   = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+)
+
+// socks5Connect 通过 SOCKS5 代理建立连接，配置了账号时使用用户名密码认证（RFC 1929）
+func socks5Connect(conn net.Conn, proxyURL *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+
+	method := byte(socks5AuthNone)
+	if proxyURL.User != nil {
+		method = socks5AuthPassword
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unexpected socks version %d", buf[0])
+	}
+
+	if buf[1] != method {
+		return errors.New("no acceptable socks authentication method")
+	}
+
+	if method == socks5AuthPassword {
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks username or password too long")
+		}
+
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+
+		if buf[1] != 0x00 {
+			return errors.New("socks authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host %s too long", host)
+		}
+
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[1] != 0x00 {
+		return fmt.Errorf("socks connect failed with code %d", header[1])
+	}
+
+	var addrLen int
+	switch header[3] {
+	case socks5AddrIPv4:
+		addrLen = net.IPv4len
+	case socks5AddrIPv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		addrLen = int(buf[0])
+	default:
+		return fmt.Errorf("unexpected socks address type %d", header[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+func getEnv(names ...string) string {
+	for _, name := range names {
+		if val := os.Getenv(name); val != "" {
+			return val
+		}
+	}
+
+	return ""
+}
+
+// matchNoProxy 判断 host 是否匹配 NO_PROXY，支持 *、域名后缀、IP 和 CIDR
+func matchNoProxy(noProxy string, host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, item := range strings.Split(noProxy, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+
+		if item == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(item); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		// 去掉端口，NO_PROXY 中的端口不参与匹配
+		if h, _, err := net.SplitHostPort(item); err == nil {
+			item = h
+		}
+
+		if ip != nil {
+			if itemIP := net.ParseIP(item); itemIP != nil && itemIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		item = strings.TrimPrefix(item, "*")
+		if strings.HasPrefix(item, ".") {
+			if strings.HasSuffix(host, item) || host == item[1:] {
+				return true
+			}
+			continue
+		}
+
+		if host == item || strings.HasSuffix(host, "."+item) {
+			return true
+		}
+	}
+
+	return false
+}
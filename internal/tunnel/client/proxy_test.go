@@ -0,0 +1,282 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen 在本地随机端口上监听，每个连接交给 handle 处理
+func listen(t *testing.T, handle func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = conn.Close() }()
+				handle(conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// startEchoServer 与隧道服务端一样，连接建立后立即发送数据，然后原样返回收到的数据
+func startEchoServer(t *testing.T) string {
+	return listen(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("hello"))
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+// relay 连接到 target 并在两个连接之间转发数据
+func relay(conn net.Conn, target string) {
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer func() { _ = upstream.Close() }()
+
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		_ = upstream.Close()
+	}()
+	_, _ = io.Copy(conn, upstream)
+}
+
+// startHTTPProxy 支持 CONNECT 方法和 Basic 认证的 HTTP 代理
+func startHTTPProxy(t *testing.T, username, password string, requests chan<- string) string {
+	return listen(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+
+		requests <- req.Host
+		if user, pass, ok := parseProxyAuth(req); username != "" && (!ok || user != username || pass != password) {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		relay(conn, req.Host)
+	})
+}
+
+func parseProxyAuth(req *http.Request) (string, string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+
+	r := &http.Request{Header: http.Header{"Authorization": []string{auth}}}
+	return r.BasicAuth()
+}
+
+// startSocks5Proxy 支持用户名密码认证的 SOCKS5 代理
+func startSocks5Proxy(t *testing.T, username, password string, requests chan<- string) string {
+	return listen(t, func(conn net.Conn) {
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+
+		methods := buf[2 : 2+int(buf[1])]
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+
+		if username != "" {
+			_, _ = conn.Write([]byte{socks5Version, socks5AuthPassword})
+
+			_, _ = io.ReadFull(conn, buf[:2])
+			user := make([]byte, buf[1])
+			_, _ = io.ReadFull(conn, user)
+			_, _ = io.ReadFull(conn, buf[:1])
+			pass := make([]byte, buf[0])
+			_, _ = io.ReadFull(conn, pass)
+
+			if string(user) != username || string(pass) != password {
+				_, _ = conn.Write([]byte{0x01, 0x01})
+				return
+			}
+			_, _ = conn.Write([]byte{0x01, 0x00})
+		} else {
+			_, _ = conn.Write([]byte{socks5Version, socks5AuthNone})
+		}
+
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+
+		var host string
+		switch buf[3] {
+		case socks5AddrIPv4:
+			_, _ = io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case socks5AddrDomain:
+			_, _ = io.ReadFull(conn, buf[:1])
+			name := make([]byte, buf[0])
+			_, _ = io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+
+		_, _ = io.ReadFull(conn, buf[:2])
+		target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+		requests <- target
+
+		_, _ = conn.Write([]byte{socks5Version, 0x00, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		relay(conn, target)
+	})
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "hello world" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+	target := startEchoServer(t)
+	requests := make(chan string, 10)
+
+	httpProxy := startHTTPProxy(t, "user", "p@ss", requests)
+	socksProxy := startSocks5Proxy(t, "user", "p@ss", requests)
+
+	for _, proxy := range []string{
+		"http://user:p%40ss@" + httpProxy,
+		"socks5://user:p%40ss@" + socksProxy,
+	} {
+		d, err := newProxyDialer(proxy, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := d.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("%s: %v", proxy, err)
+		}
+
+		if req := <-requests; req != target {
+			t.Fatalf("%s: unexpected proxy request %s", proxy, req)
+		}
+
+		assertEcho(t, conn)
+	}
+
+	for _, proxy := range []string{
+		"http://user:wrong@" + httpProxy,
+		"socks5://user:wrong@" + socksProxy,
+	} {
+		d, err := newProxyDialer(proxy, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := d.Dial("tcp", target); err == nil {
+			t.Fatalf("%s: dial with wrong credential should fail", proxy)
+		}
+	}
+
+	// HTTP 代理在返回 407 前已经记录了请求，SOCKS5 代理认证失败时不会记录
+	select {
+	case <-requests:
+	default:
+	}
+
+	if _, err := newProxyDialer("https://"+httpProxy, time.Second); err == nil {
+		t.Fatal("unsupported proxy scheme should be rejected")
+	}
+}
+
+func TestProxyDialerFromEnv(t *testing.T) {
+	target := startEchoServer(t)
+	requests := make(chan string, 10)
+	t.Setenv("HTTPS_PROXY", startHTTPProxy(t, "", "", requests))
+
+	d, err := newProxyDialer("", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("NO_PROXY", "example.com")
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req := <-requests; req != target {
+		t.Fatalf("unexpected proxy request %s", req)
+	}
+	assertEcho(t, conn)
+
+	t.Setenv("NO_PROXY", "127.0.0.0/8")
+	conn, err = d.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	select {
+	case req := <-requests:
+		t.Fatalf("address in NO_PROXY should not use proxy, got %s", req)
+	default:
+	}
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	testCases := []struct {
+		noProxy string
+		host    string
+		match   bool
+	}{
+		{"", "example.com", false},
+		{"*", "example.com", true},
+		{"example.com", "example.com", true},
+		{"example.com", "tunnel.example.com", true},
+		{"example.com", "badexample.com", false},
+		{".example.com", "tunnel.example.com", true},
+		{".example.com", "example.com", true},
+		{"*.example.com", "tunnel.example.com", true},
+		{"foo.com, example.com:443", "example.com", true},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "192.168.1.1", false},
+		{"192.168.1.1", "192.168.1.1", true},
+		{"::1", "::1", true},
+	}
+
+	for _, tc := range testCases {
+		if got := matchNoProxy(tc.noProxy, tc.host); got != tc.match {
+			t.Errorf("matchNoProxy(%q, %q) = %v, want %v", tc.noProxy, tc.host, got, tc.match)
+		}
+	}
+}
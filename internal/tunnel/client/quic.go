@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+	"github.com/quic-go/quic-go"
+)
+
+const quicScheme = "quic://"
+
+// isQUICAddr 服务端地址是否为 quic://host:port 形式的 QUIC 地址
+func isQUICAddr(addr string) bool {
+	return strings.HasPrefix(addr, quicScheme)
+}
+
+// quicTLSConfig QUIC 连接使用的 TLS 配置，未启用 tls 时不校验服务端证书，
+// 服务端身份由握手中的身份签名校验，并通过通道绑定确认 QUIC 连接没有被中间人劫持
+func quicTLSConfig(tlsConf *tls.Config) *tls.Config {
+	if tlsConf == nil {
+		tlsConf = &tls.Config{InsecureSkipVerify: true}
+	} else {
+		tlsConf = tlsConf.Clone()
+	}
+
+	tlsConf.MinVersion = tls.VersionTLS13
+	tlsConf.NextProtos = []string{common.QUICProtocol}
+	return tlsConf
+}
+
+// dialQUIC 建立 QUIC 连接并打开隧道流，客户端切换网络后 QUIC 连接会迁移到新的地址上
+func (cli *Client) dialQUIC() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, strings.TrimPrefix(cli.serverAddr, quicScheme), quicTLSConfig(cli.tlsConf), common.NewQUICConfig())
+	if err != nil {
+		return nil, fmt.Errorf("quic handshake failed: %v", err)
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		_ = conn.CloseWithError(0, "")
+		return nil, fmt.Errorf("open tunnel stream failed: %v", err)
+	}
+
+	// 服务端在收到数据后才能接收到新打开的流
+	if _, err := stream.Write([]byte{hub.StreamTunnel}); err != nil {
+		_ = conn.CloseWithError(0, "")
+		return nil, fmt.Errorf("open tunnel stream failed: %v", err)
+	}
+
+	return common.NewQUICConn(conn, stream), nil
+}
+
+// openStream 打开 link 独占的 QUIC 数据流并写入流头部
+func (h *Hub) openStream(id uint32, target string) (hub.Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := h.streams.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hub.WriteStreamHeader(stream, id, target); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
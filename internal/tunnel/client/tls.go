@@ -0,0 +1,51 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+)
+
+// buildTLSConfig 根据配置创建客户端 TLS 配置，未启用 TLS 时返回 nil
+func buildTLSConfig(conf config.ClientTLS, serverAddr string) (*tls.Config, error) {
+	if !conf.Enable {
+		return nil, nil
+	}
+
+	minVersion, err := common.ParseTLSVersion(conf.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf := &tls.Config{
+		MinVersion:         minVersion,
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+
+	if tlsConf.ServerName == "" {
+		if host, _, err := net.SplitHostPort(serverAddr); err == nil {
+			tlsConf.ServerName = host
+		}
+	}
+
+	if conf.CA != "" {
+		if tlsConf.RootCAs, err = common.LoadCertPool(conf.CA); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load tls client certificate failed: %v", err)
+		}
+
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConf, nil
+}
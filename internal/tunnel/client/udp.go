@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+)
+
+// udpFlow 本地 UDP 端口上来自同一个源地址的数据报组成的会话，每个会话对应一个 link
+type udpFlow struct {
+	ln     *net.UDPConn
+	addr   *net.UDPAddr
+	remove func()
+
+	packets chan []byte
+
+	lock     sync.Mutex
+	deadline time.Time
+	wake     chan struct{} // 修改读取超时时间时唤醒等待中的 Read
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newUDPFlow(ln *net.UDPConn, addr *net.UDPAddr, remove func()) *udpFlow {
+	return &udpFlow{
+		ln:      ln,
+		addr:    addr,
+		remove:  remove,
+		packets: make(chan []byte, 64),
+		wake:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// deliver 投递本地收到的数据报，会话处理不过来时丢弃
+func (f *udpFlow) deliver(packet []byte) {
+	select {
+	case f.packets <- packet:
+	case <-f.closed:
+	default:
+		log.Warningf("udp flow %s is busy, packet dropped", f.addr)
+	}
+}
+
+func (f *udpFlow) Read(b []byte) (int, error) {
+	for {
+		f.lock.Lock()
+		deadline, wake := f.deadline, f.wake
+		f.lock.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		n, err, retry := 0, error(nil), false
+		select {
+		case packet := <-f.packets:
+			n = copy(b, packet)
+		case <-f.closed:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-wake:
+			retry = true
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if !retry {
+			return n, err
+		}
+	}
+}
+
+func (f *udpFlow) Write(b []byte) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	return f.ln.WriteToUDP(b, f.addr)
+}
+
+func (f *udpFlow) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		f.remove()
+	})
+	return nil
+}
+
+func (f *udpFlow) LocalAddr() net.Addr  { return f.ln.LocalAddr() }
+func (f *udpFlow) RemoteAddr() net.Addr { return f.addr }
+
+func (f *udpFlow) SetDeadline(t time.Time) error {
+	return f.SetReadDeadline(t)
+}
+
+func (f *udpFlow) SetReadDeadline(t time.Time) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.deadline = t
+	close(f.wake)
+	f.wake = make(chan struct{})
+	return nil
+}
+
+func (f *udpFlow) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// listenUDP 监听本地 UDP 端口，按源地址区分会话，每个会话通过一个 link 转发到后端，空闲超时后关闭
+func (cli *Client) listenUDP(ctx context.Context, gf infra.Graceful, backend config.BackendPortMapping) error {
+	addr, err := net.ResolveUDPAddr("udp", backend.Listen)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	log.Debugf("listen on udp %s for %s ...", backend.Listen, backend.Backend)
+
+	return serveUDP(ln, func(flow *udpFlow) {
+		log.Debugf("new udp flow from %v", flow.addr)
+
+		cli.initConnToRemote.Do(func() {
+			cli.initialize(ctx, gf)
+			log.Debugf("connect to server %s...", cli)
+			time.Sleep(3 * time.Second)
+		})
+
+		h := cli.fetchHub()
+		if h == nil {
+			log.Errorf("no active hub")
+			_ = flow.Close()
+			return
+		}
+
+		go cli.handleConnection(h, hub.NewDatagramConn(flow, hub.DatagramIdleTimeout), backend)
+	})
+}
+
+// serveUDP 读取本地 UDP 端口收到的数据报，按源地址投递到对应的会话，新会话交给 onFlow 处理，监听关闭后返回
+func serveUDP(ln *net.UDPConn, onFlow func(flow *udpFlow)) error {
+	var lock sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	buf := make([]byte, hub.MaxDatagramSize)
+	for {
+		n, raddr, err := ln.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Warningf("read udp failed temporary: %s", netErr.Error())
+				continue
+			}
+			return err
+		}
+
+		packet := append([]byte(nil), buf[:n]...)
+		key := raddr.String()
+
+		lock.Lock()
+		flow, ok := flows[key]
+		if !ok {
+			flow = newUDPFlow(ln, raddr, func() {
+				lock.Lock()
+				defer lock.Unlock()
+				delete(flows, key)
+			})
+			flows[key] = flow
+		}
+		lock.Unlock()
+
+		flow.deliver(packet)
+		if !ok {
+			onFlow(flow)
+		}
+	}
+}
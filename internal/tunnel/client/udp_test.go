@@ -0,0 +1,226 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+)
+
+// startUDPServer 在本地随机端口上监听 UDP，新会话通过返回的 channel 输出
+func startUDPServer(t *testing.T) (*net.UDPConn, <-chan *udpFlow) {
+	t.Helper()
+
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flows := make(chan *udpFlow, 8)
+	stopped := make(chan error, 1)
+	go func() { stopped <- serveUDP(ln, func(flow *udpFlow) { flows <- flow }) }()
+
+	t.Cleanup(func() {
+		_ = ln.Close()
+		if err := <-stopped; err != nil {
+			t.Errorf("serve udp failed: %v", err)
+		}
+	})
+
+	return ln, flows
+}
+
+func dialUDP(t *testing.T, ln *net.UDPConn) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.DialUDP("udp", nil, ln.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func send(t *testing.T, conn *net.UDPConn, data string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextFlow(t *testing.T, flows <-chan *udpFlow) *udpFlow {
+	t.Helper()
+
+	select {
+	case flow := <-flows:
+		return flow
+	case <-time.After(2 * time.Second):
+		t.Fatal("expect new udp flow")
+		return nil
+	}
+}
+
+func assertRead(t *testing.T, conn net.Conn, expect string) {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, hub.MaxDatagramSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:n]) != expect {
+		t.Fatalf("expect %q, got %q", expect, buf[:n])
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	ln, flows := startUDPServer(t)
+	alice, bob := dialUDP(t, ln), dialUDP(t, ln)
+
+	// 同一个源地址的数据报属于同一个会话
+	send(t, alice, "alice-1")
+	aliceFlow := nextFlow(t, flows)
+	send(t, alice, "alice-2")
+	send(t, bob, "bob-1")
+	bobFlow := nextFlow(t, flows)
+
+	if aliceFlow.RemoteAddr().String() != alice.LocalAddr().String() || bobFlow.RemoteAddr().String() != bob.LocalAddr().String() {
+		t.Fatalf("unexpected flows: %v, %v", aliceFlow.RemoteAddr(), bobFlow.RemoteAddr())
+	}
+
+	assertRead(t, aliceFlow, "alice-1")
+	assertRead(t, aliceFlow, "alice-2")
+	assertRead(t, bobFlow, "bob-1")
+
+	// 会话写入的数据报发回对应的源地址
+	if _, err := aliceFlow.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	assertRead(t, alice, "reply")
+
+	select {
+	case flow := <-flows:
+		t.Fatalf("unexpected flow from %v", flow.RemoteAddr())
+	default:
+	}
+
+	// 会话关闭后从映射中移除，同一个源地址再次发送时创建新的会话
+	_ = aliceFlow.Close()
+	if _, err := aliceFlow.Write([]byte("reply")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write to closed flow should fail, got %v", err)
+	}
+
+	send(t, alice, "alice-3")
+	if flow := nextFlow(t, flows); flow == aliceFlow {
+		t.Fatal("closed flow should not be reused")
+	} else {
+		assertRead(t, flow, "alice-3")
+	}
+
+	// 空闲超时后会话关闭
+	conn := hub.NewDatagramConn(bobFlow, 100*time.Millisecond)
+	if _, err := conn.Read(make([]byte, 64)); err != io.EOF {
+		t.Fatalf("idle flow should be closed, got %v", err)
+	}
+	_ = conn.Close()
+
+	send(t, bob, "bob-2")
+	assertRead(t, nextFlow(t, flows), "bob-2")
+}
+
+func TestUDPFlowRead(t *testing.T) {
+	removed := 0
+	flow := newUDPFlow(nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}, func() { removed++ })
+
+	// 已过期的读取超时立即返回
+	_ = flow.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := flow.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	// 等待中的 Read 使用新设置的读取超时
+	_ = flow.SetReadDeadline(time.Time{})
+	result := make(chan error, 1)
+	go func() {
+		_, err := flow.Read(make([]byte, 64))
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	_ = flow.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expect deadline exceeded, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked read should be woken up by new deadline")
+	}
+
+	// 数据报比缓冲区大时截断
+	_ = flow.SetReadDeadline(time.Time{})
+	flow.deliver([]byte("hello world"))
+	buf := make([]byte, 5)
+	if n, err := flow.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+
+	// 关闭后 Read 返回，只从映射中移除一次
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = flow.Close()
+	}()
+	if _, err := flow.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect closed, got %v", err)
+	}
+
+	_ = flow.Close()
+	if removed != 1 {
+		t.Fatalf("flow should be removed once, got %d", removed)
+	}
+}
+
+func TestUDPFlowBusy(t *testing.T) {
+	flow := newUDPFlow(nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}, func() {})
+	size := cap(flow.packets)
+
+	// 会话处理不过来时丢弃多出的数据报，不阻塞监听
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < size+10; i++ {
+			flow.deliver([]byte{byte(i)})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("deliver should not block when flow is busy")
+	}
+
+	buf := make([]byte, 1)
+	for i := 0; i < size; i++ {
+		if n, err := flow.Read(buf); err != nil || n != 1 || buf[0] != byte(i) {
+			t.Fatalf("unexpected packet %d: %v, %v", i, buf[:n], err)
+		}
+	}
+
+	_ = flow.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := flow.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("packets over the queue should be dropped, got %v", err)
+	}
+
+	// 关闭后投递的数据报直接丢弃
+	_ = flow.Close()
+	flow.deliver([]byte{0})
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// listenUnix 监听本地 Unix socket 文件，socket 文件只允许当前用户访问
+func listenUnix(path string) (net.Listener, error) {
+	// 上次异常退出时遗留的 socket 文件需要先删除，仍在使用中的不能删除
+	if stat, err := os.Lstat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("unix socket %s is in use", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
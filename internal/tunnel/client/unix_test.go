@@ -0,0 +1,44 @@
+package client
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+
+	ln, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Fatalf("expect socket mode 0600, got %v", stat.Mode().Perm())
+	}
+
+	if _, err := listenUnix(path); err == nil {
+		t.Fatal("socket in use should not be replaced")
+	}
+	_ = ln.Close()
+
+	// 模拟异常退出遗留的 socket 文件
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err = listenUnix(path)
+	if err != nil {
+		t.Fatalf("stale socket should be replaced: %v", err)
+	}
+	_ = ln.Close()
+}
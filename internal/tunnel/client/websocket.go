@@ -0,0 +1,40 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+)
+
+// isWebSocketAddr 服务端地址是否为 ws:// 或 wss:// 形式的 WebSocket 地址
+func isWebSocketAddr(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+// dialWebSocket 通过 WebSocket 连接服务端，与 TCP 连接使用相同的代理配置，
+// wss:// 地址使用 tls 配置校验服务端证书，未启用时使用系统证书
+func (cli *Client) dialWebSocket() (net.Conn, error) {
+	dialer := websocket.Dialer{
+		NetDial:          cli.dialer.Dial,
+		HandshakeTimeout: 10 * time.Second,
+		ReadBufferSize:   hub.PacketSize,
+		WriteBufferSize:  hub.PacketSize,
+		TLSClientConfig:  cli.tlsConf,
+	}
+
+	ws, resp, err := dialer.Dial(cli.serverAddr, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket handshake failed: %v (%s)", err, resp.Status)
+		}
+
+		return nil, fmt.Errorf("websocket handshake failed: %v", err)
+	}
+
+	return common.NewWebSocketConn(ws), nil
+}
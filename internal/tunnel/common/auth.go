@@ -6,19 +6,24 @@ import (
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"hash"
-	"math/rand"
-	"strings"
+	"io"
 	"time"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 const (
 	TaaTokenSize     int = aes.BlockSize
 	TaaSignatureSize int = md5.Size
 	TaaBlockSize     int = TaaTokenSize + TaaSignatureSize
+
+	// SessionKeySize AEAD 会话密钥长度
+	SessionKeySize int = 32
 )
 
 type authToken struct {
@@ -56,9 +61,16 @@ func (t authToken) isComplementary(t1 authToken) bool {
 
 // EncryptAlgorithm auth algorithm
 type EncryptAlgorithm struct {
-	block cipher.Block
-	mac   hash.Hash
-	token authToken
+	block  cipher.Block
+	mac    hash.Hash
+	token  authToken
+	secret [sha256.Size]byte
+
+	// 临时 X25519 密钥交换状态
+	private    []byte
+	public     []byte
+	shared     []byte
+	transcript hash.Hash
 }
 
 func NewEncryptAlgorithm(key string) *EncryptAlgorithm {
@@ -66,21 +78,33 @@ func NewEncryptAlgorithm(key string) *EncryptAlgorithm {
 	block, _ := aes.NewCipher(token[:TaaTokenSize])
 	mac := hmac.New(md5.New, token[TaaTokenSize:])
 	return &EncryptAlgorithm{
-		block: block,
-		mac:   mac,
+		block:      block,
+		mac:        mac,
+		secret:     token,
+		transcript: sha256.New(),
 	}
 }
 
-func init() {
-	rand.Seed(time.Now().Unix())
-}
+// MaxTokenAge token 有效期，超出有效期的 token 视为重放，同时用于容忍客户端与服务端之间的时钟偏差
+var MaxTokenAge = 5 * time.Minute
 
 // GenerateToken generate new token
 func (a *EncryptAlgorithm) GenerateToken() {
-	a.token.challenge = uint64(rand.Int63())
+	var buf [8]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		panic(fmt.Errorf("generate token failed: %v", err))
+	}
+
+	a.token.challenge = binary.LittleEndian.Uint64(buf[:])
 	a.token.timestamp = uint64(time.Now().UnixNano())
 }
 
+// isFresh token 时间戳是否在有效期内
+func (t authToken) isFresh() bool {
+	age := time.Since(time.Unix(0, int64(t.timestamp)))
+	return age <= MaxTokenAge && age >= -MaxTokenAge
+}
+
 // GenerateCipherBlock generate cipher block
 func (a *EncryptAlgorithm) GenerateCipherBlock(token *authToken) []byte {
 	if token == nil {
@@ -118,6 +142,11 @@ func (a *EncryptAlgorithm) ExchangeCipherBlock(src []byte) ([]byte, bool) {
 	a.block.Decrypt(dst, src)
 	(&a.token).fromBytes(dst)
 
+	// 拒绝过期的 challenge，防止被重放的 challenge 冒充服务端
+	if !a.token.isFresh() {
+		return nil, false
+	}
+
 	// complement challenge
 	token := a.token.complement()
 	return a.GenerateCipherBlock(&token), true
@@ -137,22 +166,24 @@ func (a *EncryptAlgorithm) VerifyCipherBlock(src []byte) bool {
 	dst := make([]byte, TaaTokenSize)
 	a.block.Decrypt(dst, src)
 	(&token).fromBytes(dst)
-	return a.token.isComplementary(token)
+	return a.token.isComplementary(token) && a.token.isFresh()
 }
 
 func (a *EncryptAlgorithm) GetRc4key() []byte {
 	return bytes.Repeat(a.token.toBytes(), 8)
 }
 
-func BuildAuthPacket(username, password, backend string) []byte {
-	return []byte(fmt.Sprintf("%s:%s@%s", username, password, backend))
-}
+// SessionKeys 根据协商的加密算法派生会话密钥，clientKey 用于客户端发送方向，serverKey 用于服务端发送方向
+// 完成 X25519 密钥交换后，会话密钥由临时共享密钥和握手记录派生，泄露 secret 不影响已建立的会话
+func (a *EncryptAlgorithm) SessionKeys(suite CipherSuite) (clientKey, serverKey []byte) {
+	ikm := append(a.token.toBytes(), a.shared...)
+	info := append([]byte("secure-tunnel "+suite.String()), a.transcript.Sum(nil)...)
+	kdf := hkdf.New(sha256.New, ikm, a.secret[:], info)
 
-func ParseAuthPacket(data []byte) (username, password, backend string) {
-	segs := strings.Split(string(data), "@")
-	userInfos := strings.SplitN(strings.Join(segs[:len(segs)-1], "@"), ":", 2)
+	keys := make([]byte, SessionKeySize*2)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		panic(fmt.Errorf("derive session keys failed: %v", err))
+	}
 
-	backend = segs[len(segs)-1]
-	username, password = userInfos[0], userInfos[1]
-	return
+	return keys[:SessionKeySize], keys[SessionKeySize:]
 }
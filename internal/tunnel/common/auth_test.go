@@ -1,6 +1,10 @@
 package common
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+	"time"
+)
 
 func TestAuth(t *testing.T) {
 	key := "a test key"
@@ -24,3 +28,99 @@ func TestAuth(t *testing.T) {
 		t.Fatal("verify exchanged block failed")
 	}
 }
+
+func TestSessionKeys(t *testing.T) {
+	key := "a test key"
+	a1 := NewEncryptAlgorithm(key)
+	a2 := NewEncryptAlgorithm(key)
+
+	a1.GenerateToken()
+	b2, ok := a2.ExchangeCipherBlock(a1.GenerateCipherBlock(nil))
+	if !ok || !a1.VerifyCipherBlock(b2) {
+		t.Fatal("exchange block failed")
+	}
+
+	c1, s1 := a1.SessionKeys(CipherAES256GCM)
+	c2, s2 := a2.SessionKeys(CipherAES256GCM)
+	if !bytes.Equal(c1, c2) || !bytes.Equal(s1, s2) {
+		t.Fatal("session keys mismatch")
+	}
+
+	if bytes.Equal(c1, s1) {
+		t.Fatal("client key and server key should be different")
+	}
+
+	c3, _ := a1.SessionKeys(CipherChaCha20Poly1305)
+	if bytes.Equal(c1, c3) {
+		t.Fatal("session keys should be bound to cipher suite")
+	}
+}
+
+func TestKeyExchange(t *testing.T) {
+	key := "a test key"
+	server := NewEncryptAlgorithm(key)
+	client := NewEncryptAlgorithm(key)
+
+	server.GenerateToken()
+	challenge := server.GenerateCipherBlock(nil)
+	token, ok := client.ExchangeCipherBlock(challenge)
+	if !ok || !server.VerifyCipherBlock(token) {
+		t.Fatal("exchange block failed")
+	}
+
+	if err := client.GenerateKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	hello := append(token, client.PublicKey()...)
+	client.Transcript(challenge, hello)
+	server.Transcript(challenge, hello)
+	if !server.VerifyTranscript(client.SignTranscript()) {
+		t.Fatal("verify client hello failed")
+	}
+
+	if err := server.GenerateKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ExchangeKey(client.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	reply := server.PublicKey()
+	server.Transcript(reply)
+	client.Transcript(reply)
+	if !client.VerifyTranscript(server.SignTranscript()) {
+		t.Fatal("verify server hello failed")
+	}
+	if err := client.ExchangeKey(reply); err != nil {
+		t.Fatal(err)
+	}
+
+	c1, s1 := client.SessionKeys(CipherAES256GCM)
+	c2, s2 := server.SessionKeys(CipherAES256GCM)
+	if !bytes.Equal(c1, c2) || !bytes.Equal(s1, s2) {
+		t.Fatal("session keys mismatch")
+	}
+
+	other := NewEncryptAlgorithm("another key")
+	other.Transcript(challenge, hello, reply)
+	if client.VerifyTranscript(other.SignTranscript()) {
+		t.Fatal("transcript signed with another key should be rejected")
+	}
+}
+
+func TestStaleToken(t *testing.T) {
+	key := "a test key"
+	a1 := NewEncryptAlgorithm(key)
+	a2 := NewEncryptAlgorithm(key)
+
+	a1.GenerateToken()
+	a1.token.timestamp = uint64(time.Now().Add(-2 * MaxTokenAge).UnixNano())
+
+	if _, ok := a2.ExchangeCipherBlock(a1.GenerateCipherBlock(nil)); ok {
+		t.Fatal("stale challenge should be rejected")
+	}
+
+	stale := a1.token.complement()
+	if a1.VerifyCipherBlock(a1.GenerateCipherBlock(&stale)) {
+		t.Fatal("stale token should be rejected")
+	}
+}
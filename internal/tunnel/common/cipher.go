@@ -0,0 +1,108 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CipherSuite 隧道数据加密算法
+type CipherSuite uint8
+
+const (
+	// CipherRC4 RC4 流加密，没有完整性校验，仅用于兼容旧版本客户端
+	CipherRC4 CipherSuite = iota
+	// CipherAES256GCM AES-256-GCM 帧加密
+	CipherAES256GCM
+	// CipherChaCha20Poly1305 ChaCha20-Poly1305 帧加密
+	CipherChaCha20Poly1305
+)
+
+var cipherSuiteNames = map[CipherSuite]string{
+	CipherRC4:              "rc4",
+	CipherAES256GCM:        "aes-256-gcm",
+	CipherChaCha20Poly1305: "chacha20-poly1305",
+}
+
+// DefaultCipherSuites 默认启用的加密算法，按优先级排序
+var DefaultCipherSuites = []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305}
+
+func (s CipherSuite) String() string {
+	if name, ok := cipherSuiteNames[s]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// IsAEAD 是否为带完整性校验的 AEAD 加密算法
+func (s CipherSuite) IsAEAD() bool {
+	return s == CipherAES256GCM || s == CipherChaCha20Poly1305
+}
+
+// ParseCipherSuite 根据名称解析加密算法
+func ParseCipherSuite(name string) (CipherSuite, error) {
+	for suite, n := range cipherSuiteNames {
+		if strings.EqualFold(n, strings.TrimSpace(name)) {
+			return suite, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unsupported cipher: %s", name)
+}
+
+// ParseCipherSuites 根据名称列表解析加密算法，列表为空时返回默认算法
+func ParseCipherSuites(names []string) ([]CipherSuite, error) {
+	if len(names) == 0 {
+		return DefaultCipherSuites, nil
+	}
+
+	suites := make([]CipherSuite, 0, len(names))
+	for _, name := range names {
+		suite, err := ParseCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+
+		suites = append(suites, suite)
+	}
+
+	return suites, nil
+}
+
+// NegotiateCipherSuite 从客户端提供的算法中选择服务端优先级最高的 AEAD 算法
+func NegotiateCipherSuite(offered []byte, allowed []CipherSuite) (CipherSuite, bool) {
+	for _, suite := range allowed {
+		if !suite.IsAEAD() {
+			continue
+		}
+
+		for _, o := range offered {
+			if CipherSuite(o) == suite {
+				return suite, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// ContainsCipherSuite 判断算法列表中是否包含指定算法
+func ContainsCipherSuite(suites []CipherSuite, suite CipherSuite) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CipherSuiteNames 加密算法名称列表
+func CipherSuiteNames(suites []CipherSuite) []string {
+	names := make([]string, 0, len(suites))
+	for _, s := range suites {
+		names = append(names, s.String())
+	}
+
+	return names
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Compression 隧道数据帧压缩算法
+type Compression uint8
+
+const (
+	// CompressionNone 不压缩
+	CompressionNone Compression = iota
+	// CompressionSnappy snappy 压缩，速度快，压缩率较低
+	CompressionSnappy
+	// CompressionZstd zstd 压缩，压缩率高，适合低带宽链路
+	CompressionZstd
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone:   "none",
+	CompressionSnappy: "snappy",
+	CompressionZstd:   "zstd",
+}
+
+// DefaultCompressions 客户端默认支持的压缩算法，按优先级排序
+var DefaultCompressions = []Compression{CompressionZstd, CompressionSnappy}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// ParseCompression 根据名称解析压缩算法，名称为空时返回 CompressionNone
+func ParseCompression(name string) (Compression, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return CompressionNone, nil
+	}
+
+	for c, n := range compressionNames {
+		if strings.EqualFold(n, name) {
+			return c, nil
+		}
+	}
+
+	return CompressionNone, fmt.Errorf("unsupported compression: %s", name)
+}
+
+// ParseCompressions 根据名称列表解析压缩算法，忽略 none
+func ParseCompressions(names []string) ([]Compression, error) {
+	compressions := make([]Compression, 0, len(names))
+	for _, name := range names {
+		c, err := ParseCompression(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if c != CompressionNone {
+			compressions = append(compressions, c)
+		}
+	}
+
+	return compressions, nil
+}
+
+// PreferCompression 客户端支持的压缩算法列表，preferred 排在最前面，为 none 时不启用压缩
+func PreferCompression(preferred string) ([]Compression, error) {
+	c, err := ParseCompression(preferred)
+	if err != nil {
+		return nil, err
+	}
+
+	if preferred == "" {
+		return DefaultCompressions, nil
+	}
+
+	if c == CompressionNone {
+		return nil, nil
+	}
+
+	compressions := []Compression{c}
+	for _, d := range DefaultCompressions {
+		if d != c {
+			compressions = append(compressions, d)
+		}
+	}
+
+	return compressions, nil
+}
+
+// CompressionNames 压缩算法名称列表
+func CompressionNames(compressions []Compression) []string {
+	names := make([]string, 0, len(compressions))
+	for _, c := range compressions {
+		names = append(names, c.String())
+	}
+
+	return names
+}
+
+// NegotiateCompression 按客户端的优先级选择后端允许的压缩算法，客户端提供的未知算法直接忽略
+func NegotiateCompression(offered []string, allowed []Compression) Compression {
+	for _, name := range offered {
+		c, err := ParseCompression(name)
+		if err != nil || c == CompressionNone {
+			continue
+		}
+
+		for _, a := range allowed {
+			if a == c {
+				return c
+			}
+		}
+	}
+
+	return CompressionNone
+}
+
+// ContainsCompression 判断算法列表中是否包含指定算法
+func ContainsCompression(compressions []Compression, c Compression) bool {
+	for _, item := range compressions {
+		if item == c {
+			return true
+		}
+	}
+
+	return false
+}
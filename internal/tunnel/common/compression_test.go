@@ -0,0 +1,27 @@
+package common
+
+import "testing"
+
+func TestNegotiateCompression(t *testing.T) {
+	offered, err := PreferCompression("snappy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := CompressionNames(offered)
+	if len(names) != 2 || names[0] != "snappy" || names[1] != "zstd" {
+		t.Fatalf("unexpected preference: %v", names)
+	}
+
+	if c := NegotiateCompression(append([]string{"lz4"}, names...), []Compression{CompressionZstd, CompressionSnappy}); c != CompressionSnappy {
+		t.Fatalf("client preference should be respected, got %s", c)
+	}
+
+	if c := NegotiateCompression(names, nil); c != CompressionNone {
+		t.Fatalf("compression should be disabled for backend without compression, got %s", c)
+	}
+
+	if offered, _ := PreferCompression("none"); len(offered) != 0 {
+		t.Fatal("none should disable compression")
+	}
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// KeyExchangeSize X25519 公钥长度
+	KeyExchangeSize int = curve25519.PointSize
+	// HandshakeMacSize 握手记录签名长度
+	HandshakeMacSize int = sha256.Size
+	// ClientNonceSize 客户端随机数长度，服务端用于识别重放的握手
+	ClientNonceSize int = 16
+)
+
+// GenerateNonce 生成客户端随机数
+func GenerateNonce() ([]byte, error) {
+	nonce := make([]byte, ClientNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce failed: %v", err)
+	}
+
+	return nonce, nil
+}
+
+// GenerateKeyPair 生成本次握手使用的临时 X25519 密钥对
+func (a *EncryptAlgorithm) GenerateKeyPair() error {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return fmt.Errorf("generate key pair failed: %v", err)
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return fmt.Errorf("generate key pair failed: %v", err)
+	}
+
+	a.private, a.public = private, public
+	return nil
+}
+
+// PublicKey 返回临时公钥
+func (a *EncryptAlgorithm) PublicKey() []byte {
+	return a.public
+}
+
+// ExchangeKey 使用对端临时公钥计算共享密钥，计算完成后丢弃临时私钥
+func (a *EncryptAlgorithm) ExchangeKey(peerPublic []byte) error {
+	if a.private == nil {
+		return fmt.Errorf("key pair not generated")
+	}
+
+	shared, err := curve25519.X25519(a.private, peerPublic)
+	if err != nil {
+		return fmt.Errorf("exchange key failed: %v", err)
+	}
+
+	a.shared = shared
+	a.private = nil
+	return nil
+}
+
+// Transcript 将握手消息写入握手记录，握手记录用于签名和会话密钥派生
+func (a *EncryptAlgorithm) Transcript(messages ...[]byte) {
+	for _, msg := range messages {
+		_, _ = a.transcript.Write(msg)
+	}
+}
+
+// SignTranscript 使用共享 secret 对当前握手记录签名，防止临时公钥被中间人替换
+func (a *EncryptAlgorithm) SignTranscript() []byte {
+	mac := hmac.New(sha256.New, a.handshakeMacKey())
+	_, _ = mac.Write(a.transcript.Sum(nil))
+	return mac.Sum(nil)
+}
+
+// VerifyTranscript 校验对端对握手记录的签名
+func (a *EncryptAlgorithm) VerifyTranscript(sign []byte) bool {
+	return hmac.Equal(sign, a.SignTranscript())
+}
+
+func (a *EncryptAlgorithm) handshakeMacKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, a.secret[:], nil, []byte("secure-tunnel handshake")), key); err != nil {
+		panic(fmt.Errorf("derive handshake key failed: %v", err))
+	}
+
+	return key
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ProtocolVersion 当前握手协议版本
+	ProtocolVersion uint16 = 2
+	// MinProtocolVersion 支持的最低握手协议版本
+	MinProtocolVersion uint16 = 1
+	// WideFrameVersion 从该版本开始，握手完成后使用 32 位 link ID 和 32 位长度的帧格式
+	WideFrameVersion uint16 = 2
+)
+
+// MessageType 握手消息类型，握手消息格式为 1 字节消息类型 + JSON 消息体
+type MessageType uint8
+
+const (
+	MsgClientHello MessageType = iota + 1
+	MsgServerHello
+	MsgAuthRequest
+	MsgAuthResponse
+	// MsgHandshakeError 加密算法协商阶段的错误，此时还没有开始交换 ServerHello
+	MsgHandshakeError
+)
+
+// Capability 协议能力标识，双方通过握手协商共同支持的能力
+type Capability uint32
+
+const (
+	// CapFlowControl link 级别基于额度的流量控制
+	CapFlowControl Capability = 1 << iota
+	// CapMultiplex 一个隧道承载多个后端的连接，LinkCreate 命令中携带目标后端
+	CapMultiplex
+	// CapHeartbeatProbe 客户端回应服务端发起的 TunPing 探测，服务端据此测量往返时间
+	CapHeartbeatProbe
+	// CapGoAway 客户端收到 TunGoAway 后不再在该隧道上创建 link，并建立新的隧道替代它
+	CapGoAway
+)
+
+// SupportedCapabilities 当前版本支持的全部能力
+const SupportedCapabilities = CapFlowControl | CapMultiplex | CapHeartbeatProbe | CapGoAway
+
+// Has 是否包含指定能力
+func (c Capability) Has(capability Capability) bool {
+	return c&capability == capability
+}
+
+// ErrorCode 握手错误码
+type ErrorCode string
+
+const (
+	ErrCodeInternal           ErrorCode = "internal_error"
+	ErrCodeInvalidMessage     ErrorCode = "invalid_message"
+	ErrCodeUnsupportedVersion ErrorCode = "unsupported_version"
+	ErrCodeAuthFailed         ErrorCode = "auth_failed"
+	ErrCodeUnknownBackend     ErrorCode = "unknown_backend"
+	ErrCodeChannelBinding     ErrorCode = "channel_binding_mismatch"
+	ErrCodeAccessDenied       ErrorCode = "access_denied"
+	ErrCodeNoCommonCipher     ErrorCode = "no_common_cipher"
+)
+
+// HandshakeError 握手错误，Fields 中包含与错误相关的字段，如用户名、后端名称等
+type HandshakeError struct {
+	Code    ErrorCode         `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// NewHandshakeError create a new handshake error
+func NewHandshakeError(code ErrorCode, message string, fields map[string]string) *HandshakeError {
+	return &HandshakeError{Code: code, Message: message, Fields: fields}
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ClientHello 客户端握手消息，上报协议版本、支持的能力和客户端信息
+type ClientHello struct {
+	Version      uint16     `json:"version"`
+	Capabilities Capability `json:"capabilities"`
+	Client       SystemInfo `json:"client"`
+}
+
+// ServerHello 服务端握手响应，返回协商后的协议版本和双方共同支持的能力
+type ServerHello struct {
+	Version      uint16          `json:"version"`
+	Capabilities Capability      `json:"capabilities"`
+	Error        *HandshakeError `json:"error,omitempty"`
+}
+
+// AuthRequest 客户端身份认证请求
+type AuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Backend 隧道绑定的后端，多路复用的隧道为空，由每个 link 单独指定
+	Backend string `json:"backend"`
+	// Compressions 客户端支持的压缩算法，按优先级排序
+	Compressions []string `json:"compressions,omitempty"`
+	// ChannelBinding QUIC 连接的 TLS 通道绑定值，其他传输方式为空
+	ChannelBinding []byte `json:"channel_binding,omitempty"`
+	// Backends 多路复用的隧道中用户可以访问的后端，旧版本服务端不返回该字段
+	Backends []string `json:"backends"`
+}
+
+// AuthResponse 服务端身份认证响应
+type AuthResponse struct {
+	Account string          `json:"account,omitempty"`
+	Error   *HandshakeError `json:"error,omitempty"`
+	// Compression 服务端根据后端配置选择的压缩算法，为空时不压缩
+	Compression string `json:"compression,omitempty"`
+	// ChannelBinding QUIC 连接的 TLS 通道绑定值，其他传输方式为空
+	ChannelBinding []byte `json:"channel_binding,omitempty"`
+	// Backends 多路复用的隧道中用户可以访问的后端，旧版本服务端不返回该字段
+	Backends []string `json:"backends"`
+}
+
+// EncodeMessage 编码握手消息
+func EncodeMessage(typ MessageType, msg interface{}) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic(fmt.Errorf("encode handshake message failed: %v", err))
+	}
+
+	return append([]byte{byte(typ)}, data...)
+}
+
+// DecodeMessage 解码握手消息，消息类型不匹配时返回错误
+func DecodeMessage(data []byte, typ MessageType, msg interface{}) error {
+	if len(data) == 0 || MessageType(data[0]) != typ {
+		return NewHandshakeError(ErrCodeInvalidMessage, fmt.Sprintf("expect message type %d", typ), nil)
+	}
+
+	if err := json.Unmarshal(data[1:], msg); err != nil {
+		return NewHandshakeError(ErrCodeInvalidMessage, fmt.Sprintf("decode message failed: %v", err), nil)
+	}
+
+	return nil
+}
+
+// DecodeHandshakeError 解码加密算法协商阶段服务端返回的错误，不是错误消息时返回 false
+func DecodeHandshakeError(data []byte) (*HandshakeError, bool) {
+	var herr HandshakeError
+	if err := DecodeMessage(data, MsgHandshakeError, &herr); err != nil || herr.Code == "" {
+		return nil, false
+	}
+
+	return &herr, true
+}
+
+// NegotiateVersion 协商协议版本
+func NegotiateVersion(clientVersion uint16) (uint16, bool) {
+	if clientVersion < MinProtocolVersion {
+		return 0, false
+	}
+
+	if clientVersion > ProtocolVersion {
+		return ProtocolVersion, true
+	}
+
+	return clientVersion, true
+}
+
+// BuildAuthPacket 构建旧版本协议的认证消息
+func BuildAuthPacket(username, password, backend string) []byte {
+	return []byte(fmt.Sprintf("%s:%s@%s", username, password, backend))
+}
+
+// ParseAuthPacket 解析旧版本协议的认证消息，格式为 username:password@backend
+// 用户名中不能包含 ':'，后端名称中不能包含 '@'，密码不受限制
+func ParseAuthPacket(data []byte) (username, password, backend string, err error) {
+	packet := string(data)
+
+	at := strings.LastIndex(packet, "@")
+	if at < 0 {
+		return "", "", "", fmt.Errorf("invalid auth packet: backend is required")
+	}
+
+	userInfos := strings.SplitN(packet[:at], ":", 2)
+	if len(userInfos) != 2 {
+		return "", "", "", fmt.Errorf("invalid auth packet: password is required")
+	}
+
+	return userInfos[0], userInfos[1], packet[at+1:], nil
+}
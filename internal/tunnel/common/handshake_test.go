@@ -0,0 +1,57 @@
+package common
+
+import "testing"
+
+func TestParseAuthPacket(t *testing.T) {
+	username, password, backend, err := ParseAuthPacket(BuildAuthPacket("admin", "p@ss:word", "mysql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if username != "admin" || password != "p@ss:word" || backend != "mysql" {
+		t.Fatalf("unexpected result: %s, %s, %s", username, password, backend)
+	}
+
+	if _, _, _, err := ParseAuthPacket([]byte("admin:password")); err == nil {
+		t.Fatal("packet without backend should be rejected")
+	}
+
+	if _, _, _, err := ParseAuthPacket([]byte("admin@mysql")); err == nil {
+		t.Fatal("packet without password should be rejected")
+	}
+}
+
+func TestHandshakeMessage(t *testing.T) {
+	data := EncodeMessage(MsgAuthResponse, AuthResponse{Error: NewHandshakeError(ErrCodeAuthFailed, "invalid password", map[string]string{"username": "admin"})})
+
+	var hello ServerHello
+	if err := DecodeMessage(data, MsgServerHello, &hello); err == nil {
+		t.Fatal("message type mismatch should be rejected")
+	}
+
+	var resp AuthResponse
+	if err := DecodeMessage(data, MsgAuthResponse, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Error == nil || resp.Error.Code != ErrCodeAuthFailed || resp.Error.Fields["username"] != "admin" {
+		t.Fatalf("unexpected error: %v", resp.Error)
+	}
+
+	herr, ok := DecodeHandshakeError(EncodeMessage(MsgHandshakeError, NewHandshakeError(ErrCodeNoCommonCipher, "no supported cipher", map[string]string{"supported": "aes-256-gcm"})))
+	if !ok || herr.Code != ErrCodeNoCommonCipher || herr.Fields["supported"] != "aes-256-gcm" {
+		t.Fatalf("unexpected handshake error: %v", herr)
+	}
+
+	if _, ok := DecodeHandshakeError(data); ok {
+		t.Fatal("non handshake error message should be rejected")
+	}
+
+	if _, ok := NegotiateVersion(MinProtocolVersion - 1); ok {
+		t.Fatal("version lower than min version should be rejected")
+	}
+
+	if v, ok := NegotiateVersion(ProtocolVersion + 1); !ok || v != ProtocolVersion {
+		t.Fatal("newer client version should be downgraded to server version")
+	}
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/mylxsw/go-utils/file"
+)
+
+const (
+	// HostKeySize 服务端身份公钥长度
+	HostKeySize int = ed25519.PublicKeySize
+	// HostSignatureSize 服务端身份签名长度
+	HostSignatureSize int = ed25519.SignatureSize
+)
+
+// LoadOrCreateHostKey 加载服务端长期身份密钥，文件不存在时自动生成
+func LoadOrCreateHostKey(path string) (ed25519.PrivateKey, error) {
+	if !file.Exist(path) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate host key failed: %v", err)
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("marshal host key failed: %v", err)
+		}
+
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, fmt.Errorf("save host key to %s failed: %v", path, err)
+		}
+
+		return key, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read host key %s failed: %v", path, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid host key %s: no pem block", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key %s: %v", path, err)
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid host key %s: not an ed25519 key", path)
+	}
+
+	return edKey, nil
+}
+
+// Fingerprint 服务端身份公钥指纹
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// SignTranscriptWithHostKey 使用服务端长期身份密钥对当前握手记录签名，供客户端校验服务端身份
+func (a *EncryptAlgorithm) SignTranscriptWithHostKey(key ed25519.PrivateKey) []byte {
+	return ed25519.Sign(key, a.hostSignMessage())
+}
+
+// VerifyHostSignature 校验服务端身份签名
+func (a *EncryptAlgorithm) VerifyHostSignature(key ed25519.PublicKey, sign []byte) bool {
+	if len(key) != HostKeySize {
+		return false
+	}
+
+	return ed25519.Verify(key, a.hostSignMessage(), sign)
+}
+
+func (a *EncryptAlgorithm) hostSignMessage() []byte {
+	return append([]byte("secure-tunnel host signature "), a.transcript.Sum(nil)...)
+}
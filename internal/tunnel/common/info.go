@@ -11,13 +11,13 @@ import (
 )
 
 type SystemInfo struct {
-	Version       string   `json:"version"`
-	Arch          string   `json:"arch"`
-	OS            string   `json:"os"`
-	Hostname      string   `json:"hostname"`
-	NetInterfaces []string `json:"net_interfaces"`
-	Platform      string   `json:"platform"`
-	KernelVersion string   `json:"kernel_version"`
+	Version       string   `json:"version" yaml:"version,omitempty"`
+	Arch          string   `json:"arch" yaml:"arch,omitempty"`
+	OS            string   `json:"os" yaml:"os,omitempty"`
+	Hostname      string   `json:"hostname" yaml:"hostname,omitempty"`
+	NetInterfaces []string `json:"net_interfaces" yaml:"net_interfaces,omitempty"`
+	Platform      string   `json:"platform" yaml:"platform,omitempty"`
+	KernelVersion string   `json:"kernel_version" yaml:"kernel_version,omitempty"`
 }
 
 func (info SystemInfo) Encode() []byte {
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// QUICProtocol QUIC 连接使用的 ALPN 协议名称
+	QUICProtocol = "secure-tunnel"
+	// QUICIdleTimeout QUIC 连接的空闲超时时间，客户端切换网络期间连接在该时间内保持可用
+	QUICIdleTimeout = 60 * time.Second
+
+	channelBindingLabel = "EXPORTER-secure-tunnel-channel-binding"
+	channelBindingSize  = 32
+)
+
+// NewQUICConfig 客户端和服务端共用的 QUIC 配置
+func NewQUICConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:     QUICIdleTimeout,
+		KeepAlivePeriod:    10 * time.Second,
+		MaxIncomingStreams: 1 << 16,
+	}
+}
+
+// QUICConn 将 QUIC 连接中的隧道流包装为 net.Conn，同一连接上的其他流由各个 link 独占
+type QUICConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// NewQUICConn 使用 QUIC 连接及其隧道流创建 QUICConn
+func NewQUICConn(conn *quic.Conn, stream *quic.Stream) *QUICConn {
+	return &QUICConn{Stream: stream, conn: conn}
+}
+
+// LocalAddr 客户端切换网络后地址会发生变化
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr 客户端切换网络后地址会发生变化
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close 关闭整个 QUIC 连接，连接上所有 link 的数据流同时关闭
+func (c *QUICConn) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
+
+// ConnectionState QUIC 连接的 TLS 状态
+func (c *QUICConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// ChannelBinding 从 TLS 会话导出的通道绑定值，中间人分别与双方建立的 TLS 会话导出的值不同
+// link 数据流只由 QUIC 自身的 TLS 加密，双方需要在加密的握手消息中交换该值以确认不存在中间人
+func (c *QUICConn) ChannelBinding() ([]byte, error) {
+	state := c.ConnectionState()
+	return state.ExportKeyingMaterial(channelBindingLabel, nil, channelBindingSize)
+}
+
+// OpenStream 打开新的数据流
+func (c *QUICConn) OpenStream(ctx context.Context) (*QUICStream, error) {
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QUICStream{Stream: stream}, nil
+}
+
+// AcceptStream 接收对端打开的数据流
+func (c *QUICConn) AcceptStream(ctx context.Context) (*QUICStream, error) {
+	stream, err := c.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QUICStream{Stream: stream}, nil
+}
+
+// QUICStream 支持半关闭的 QUIC 数据流
+type QUICStream struct {
+	*quic.Stream
+}
+
+// CloseRead 停止接收数据
+func (s *QUICStream) CloseRead() error {
+	s.Stream.CancelRead(0)
+	return nil
+}
+
+// CloseWrite 数据发送完毕，对端读取完后收到 EOF
+func (s *QUICStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close 关闭数据流的两个方向
+func (s *QUICStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func newTestQUICListener(t *testing.T) *quic.Listener {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{QUICProtocol},
+	}, NewQUICConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	return ln
+}
+
+func TestQUICConn(t *testing.T) {
+	ln := newTestQUICListener(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bindings := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			return
+		}
+
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+
+		qc := NewQUICConn(conn, stream)
+		binding, _ := qc.ChannelBinding()
+		bindings <- binding
+
+		// 数据流读取到 EOF 后仍然可以继续发送数据
+		s, err := qc.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+
+		data, _ := io.ReadAll(s)
+		_, _ = s.Write(append([]byte("echo: "), data...))
+		_ = s.CloseWrite()
+	}()
+
+	conn, err := quic.DialAddr(ctx, ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QUICProtocol}}, NewQUICConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qc := NewQUICConn(conn, stream)
+	defer func() { _ = qc.Close() }()
+
+	if _, err := qc.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	binding, err := qc.ChannelBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer := <-bindings; len(binding) != channelBindingSize || !bytes.Equal(peer, binding) {
+		t.Fatalf("channel binding mismatch: %x != %x", binding, peer)
+	}
+
+	s, err := qc.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.CloseWrite()
+
+	data, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "echo: hello" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenBucket 令牌桶限速器，令牌按 rate 字节每秒生成，最多积累 burst 字节
+// 令牌不足时预支令牌并等待补足，因此单次请求可以超过 burst，等待顺序与请求顺序一致
+type TokenBucket struct {
+	rate  float64
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+
+	waiting   int32 // 正在等待令牌的请求数
+	throttled int64 // 累计等待时间，纳秒
+}
+
+// NewTokenBucket 创建令牌桶，初始时令牌是满的
+func NewTokenBucket(rate, burst int64) *TokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Rate 每秒生成的令牌数（字节）
+func (b *TokenBucket) Rate() int64 {
+	return int64(b.rate)
+}
+
+// reserve 预支 n 个令牌，返回需要等待的时间
+func (b *TokenBucket) reserve(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait 阻塞直到允许传输 n 字节，返回等待的时间
+func (b *TokenBucket) Wait(n int) time.Duration {
+	return WaitTokens([]*TokenBucket{b}, n)
+}
+
+// WaitTokens 同时从多个令牌桶预支 n 个令牌，阻塞直到所有令牌桶都允许传输，返回等待的时间
+func WaitTokens(buckets []*TokenBucket, n int) time.Duration {
+	var wait time.Duration
+	waits := make([]time.Duration, len(buckets))
+	for i, b := range buckets {
+		waits[i] = b.reserve(n)
+		if waits[i] > wait {
+			wait = waits[i]
+		}
+	}
+
+	if wait <= 0 {
+		return 0
+	}
+
+	for i, b := range buckets {
+		if waits[i] > 0 {
+			atomic.AddInt32(&b.waiting, 1)
+		}
+	}
+
+	time.Sleep(wait)
+
+	for i, b := range buckets {
+		if waits[i] > 0 {
+			atomic.AddInt32(&b.waiting, -1)
+			atomic.AddInt64(&b.throttled, int64(waits[i]))
+		}
+	}
+
+	return wait
+}
+
+// Waiting 正在等待令牌的请求数，大于 0 表示正在限速
+func (b *TokenBucket) Waiting() int {
+	return int(atomic.LoadInt32(&b.waiting))
+}
+
+// Throttled 累计因限速等待的时间
+func (b *TokenBucket) Throttled() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.throttled))
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(100*1024, 100*1024)
+
+	// 初始的令牌可以直接使用
+	if wait := b.Wait(100 * 1024); wait != 0 {
+		t.Fatalf("burst should not wait, waited %s", wait)
+	}
+
+	start := time.Now()
+	b.Wait(20 * 1024)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expect waiting about 200ms, waited %s", elapsed)
+	}
+
+	if b.Throttled() <= 0 || b.Waiting() != 0 {
+		t.Fatalf("unexpected stats, throttled %s, waiting %d", b.Throttled(), b.Waiting())
+	}
+}
+
+func TestWaitTokens(t *testing.T) {
+	fast := NewTokenBucket(1024*1024, 1024*1024)
+	slow := NewTokenBucket(10*1024, 10*1024)
+
+	// 等待时间取决于最慢的令牌桶
+	wait := WaitTokens([]*TokenBucket{fast, slow}, 11*1024)
+	if wait < 80*time.Millisecond || wait > 120*time.Millisecond {
+		t.Fatalf("expect waiting about 100ms, waited %s", wait)
+	}
+
+	if fast.Throttled() != 0 || slow.Throttled() != wait {
+		t.Fatalf("only slow bucket should be throttled, fast %s, slow %s", fast.Throttled(), slow.Throttled())
+	}
+}
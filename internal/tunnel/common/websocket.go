@@ -0,0 +1,71 @@
+package common
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn 将 WebSocket 连接包装为 net.Conn，隧道数据使用二进制消息传输，消息边界与数据帧无关
+type wsConn struct {
+	*websocket.Conn
+
+	reader    io.Reader
+	writeLock sync.Mutex
+}
+
+// NewWebSocketConn 将 WebSocket 连接包装为 net.Conn
+func NewWebSocketConn(conn *websocket.Conn) net.Conn {
+	return &wsConn{Conn: conn}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			typ, reader, err := c.Conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.Conn.SetWriteDeadline(t)
+}
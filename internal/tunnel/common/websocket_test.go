@@ -0,0 +1,52 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketConn(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		// 文本消息应当被忽略，二进制消息按字节流拼接
+		_ = ws.WriteMessage(websocket.TextMessage, []byte("ignored"))
+		_ = ws.WriteMessage(websocket.BinaryMessage, []byte("hello "))
+		_ = ws.WriteMessage(websocket.BinaryMessage, []byte{})
+
+		conn := NewWebSocketConn(ws)
+		_, _ = io.Copy(conn, conn)
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := NewWebSocketConn(ws)
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, []byte("hello world")) {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+}
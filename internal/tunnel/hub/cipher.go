@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// frameCipher AEAD 帧加密，每个方向使用独立的密钥和递增的 nonce 计数器
+type frameCipher struct {
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+}
+
+func newFrameCipher(suite common.CipherSuite, key []byte) (*frameCipher, error) {
+	var aead cipher.AEAD
+	var err error
+
+	switch suite {
+	case common.CipherAES256GCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err != nil {
+			return nil, err
+		}
+		aead, err = cipher.NewGCM(block)
+	case common.CipherChaCha20Poly1305:
+		aead, err = chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("cipher %s is not an aead cipher", suite)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &frameCipher{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+// nextNonce 生成下一个 nonce，同一密钥下 nonce 永不重复
+func (c *frameCipher) nextNonce() []byte {
+	binary.LittleEndian.PutUint64(c.nonce, c.counter)
+	c.counter++
+	return c.nonce
+}
+
+func (c *frameCipher) seal(dst, plaintext, additionalData []byte) []byte {
+	return c.aead.Seal(dst, c.nextNonce(), plaintext, additionalData)
+}
+
+func (c *frameCipher) open(dst, ciphertext, additionalData []byte) ([]byte, error) {
+	return c.aead.Open(dst, c.nextNonce(), ciphertext, additionalData)
+}
+
+func (c *frameCipher) overhead() int {
+	return c.aead.Overhead()
+}
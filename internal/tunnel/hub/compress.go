@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+)
+
+const (
+	// minCompressSize 小于该长度的数据包不压缩
+	minCompressSize = 256
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// initZstd 初始化全局共享的 zstd 编解码器，EncodeAll 和 DecodeAll 可以并发调用
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithLowerEncoderMem(true))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecodeAllCapLimit(true))
+	})
+}
+
+// frameCompressor 数据帧压缩
+type frameCompressor interface {
+	compress(dst, src []byte) []byte
+	// decodedLen 解压后的数据长度
+	decodedLen(src []byte) (int, error)
+	decompress(dst, src []byte) ([]byte, error)
+}
+
+func newFrameCompressor(c common.Compression) (frameCompressor, error) {
+	switch c {
+	case common.CompressionNone:
+		return nil, nil
+	case common.CompressionSnappy:
+		return snappyCompressor{}, nil
+	case common.CompressionZstd:
+		initZstd()
+		return zstdCompressor{}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported compression: %s", c)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) compress(dst, src []byte) []byte {
+	return snappy.Encode(dst[:cap(dst)], src)
+}
+
+func (snappyCompressor) decodedLen(src []byte) (int, error) {
+	return snappy.DecodedLen(src)
+}
+
+func (snappyCompressor) decompress(dst, src []byte) ([]byte, error) {
+	return snappy.Decode(dst[:cap(dst)], src)
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) compress(dst, src []byte) []byte {
+	return zstdEncoder.EncodeAll(src, dst[:0])
+}
+
+func (zstdCompressor) decodedLen(src []byte) (int, error) {
+	var h zstd.Header
+	if err := h.Decode(src); err != nil {
+		return 0, err
+	}
+
+	if !h.HasFCS {
+		return 0, ErrInvalidFrame
+	}
+
+	return int(h.FrameContentSize), nil
+}
+
+func (zstdCompressor) decompress(dst, src []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(src, dst[:0])
+}
+
+// CompressionStats 压缩统计信息，只统计启用压缩后收发的数据帧
+type CompressionStats struct {
+	Compression     common.Compression
+	RawBytes        int64 // 压缩前的数据量
+	CompressedBytes int64 // 压缩后实际传输的数据量
+}
+
+// Ratio 压缩率，压缩前的数据量与实际传输的数据量之比
+func (s CompressionStats) Ratio() float64 {
+	if s.CompressedBytes == 0 {
+		return 1
+	}
+
+	return float64(s.RawBytes) / float64(s.CompressedBytes)
+}
@@ -3,15 +3,27 @@ package hub
 import (
 	"bufio"
 	"crypto/rc4"
+	"encoding/binary"
+	"io"
 	"net"
+
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
 )
 
+// sealedLenSize AEAD 帧长度前缀大小
+const sealedLenSize = 4
+
 type Connection struct {
 	net.Conn
 	reader *bufio.Reader
 	writer *bufio.Writer
 	enc    *rc4.Cipher
 	dec    *rc4.Cipher
+
+	sealer *frameCipher // AEAD 发送方向
+	opener *frameCipher // AEAD 接收方向
+	sbuf   []byte       // 发送方向密文缓冲区，只由当前写入方使用
+	rbuf   []byte       // 接收方向密文缓冲区，只在读 goroutine 中使用
 }
 
 func newConnection(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer, enc *rc4.Cipher, dec *rc4.Cipher) *Connection {
@@ -24,11 +36,35 @@ func newConnection(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer, en
 	}
 }
 
+// SetCipherKey 启用 RC4 流加密，仅用于兼容旧版本客户端
 func (conn *Connection) SetCipherKey(key []byte) {
 	conn.enc, _ = rc4.NewCipher(key)
 	conn.dec, _ = rc4.NewCipher(key)
 }
 
+// SetFrameCipher 启用 AEAD 帧加密，sendKey 用于发送方向，recvKey 用于接收方向
+func (conn *Connection) SetFrameCipher(suite common.CipherSuite, sendKey, recvKey []byte) error {
+	sealer, err := newFrameCipher(suite, sendKey)
+	if err != nil {
+		return err
+	}
+
+	opener, err := newFrameCipher(suite, recvKey)
+	if err != nil {
+		return err
+	}
+
+	conn.sealer, conn.opener = sealer, opener
+	conn.sbuf = make([]byte, 0, sealedLenSize+maxFrameSize+sealer.overhead())
+	conn.rbuf = make([]byte, maxFrameSize+opener.overhead())
+	return nil
+}
+
+// sealed 是否启用了 AEAD 帧加密
+func (conn *Connection) sealed() bool {
+	return conn.sealer != nil
+}
+
 func (conn *Connection) Read(b []byte) (int, error) {
 	n, err := conn.reader.Read(b)
 	if n > 0 && conn.dec != nil {
@@ -44,6 +80,44 @@ func (conn *Connection) Write(b []byte) (int, error) {
 	return conn.writer.Write(b)
 }
 
+// writeSealed 加密并写入一个完整帧，帧格式为 4 字节长度前缀 + 密文，长度前缀作为附加数据参与认证
+func (conn *Connection) writeSealed(frame []byte) error {
+	var lenPrefix [sealedLenSize]byte
+	binary.LittleEndian.PutUint32(lenPrefix[:], uint32(len(frame)+conn.sealer.overhead()))
+
+	buf := append(conn.sbuf[:0], lenPrefix[:]...)
+	buf = conn.sealer.seal(buf, frame, lenPrefix[:])
+	// v2 帧格式的帧可能超过 v1 的 maxFrameSize，保留扩容后的缓冲区，避免每次写入都重新分配
+	conn.sbuf = buf[:0]
+
+	_, err := conn.writer.Write(buf)
+	return err
+}
+
+// readSealed 读取并解密一个完整帧，帧的明文长度不能超过 maxSize，返回的数据在下一次调用前有效
+func (conn *Connection) readSealed(maxSize int) ([]byte, error) {
+	var lenPrefix [sealedLenSize]byte
+	if _, err := io.ReadFull(conn.reader, lenPrefix[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(lenPrefix[:])
+	if size > uint32(maxSize+conn.opener.overhead()) {
+		return nil, ErrTooLarge
+	}
+
+	if size > uint32(len(conn.rbuf)) {
+		conn.rbuf = make([]byte, size)
+	}
+
+	ciphertext := conn.rbuf[:size]
+	if _, err := io.ReadFull(conn.reader, ciphertext); err != nil {
+		return nil, err
+	}
+
+	return conn.opener.open(ciphertext[:0], ciphertext, lenPrefix[:])
+}
+
 func (conn *Connection) Flush() error {
 	return conn.writer.Flush()
 }
@@ -0,0 +1,137 @@
+package hub
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DatagramIdleTimeout UDP 会话的空闲超时时间，两个方向都没有数据时会话关闭
+	DatagramIdleTimeout = 60 * time.Second
+	// MaxDatagramSize 单个数据报的最大长度
+	MaxDatagramSize = 65535
+
+	datagramHeaderSize = 2
+)
+
+// DatagramConn 将按数据报收发的 UDP 会话包装为字节流，供 link 在隧道中传输
+// 每个数据报编码为 Len uint16 | Data，隧道和 QUIC 数据流都不保证数据包边界，由接收方重新切分
+type DatagramConn struct {
+	net.Conn
+	idle time.Duration
+
+	rbuf    []byte // 读取数据报的缓冲区
+	pending []byte // 已编码但还未被读取的数据
+	wbuf    []byte // 还不完整的数据报
+
+	lastActive int64 // 最后一次收发数据报的时间，UnixNano
+
+	lock        sync.Mutex
+	readClosed  bool
+	writeClosed bool
+}
+
+// NewDatagramConn 包装 UDP 会话，conn 的每次 Read/Write 对应一个数据报，idle 时间内没有数据时读取返回 io.EOF
+func NewDatagramConn(conn net.Conn, idle time.Duration) *DatagramConn {
+	return &DatagramConn{
+		Conn:       conn,
+		idle:       idle,
+		rbuf:       make([]byte, datagramHeaderSize+MaxDatagramSize),
+		lastActive: time.Now().UnixNano(),
+	}
+}
+
+func (c *DatagramConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// Read 读取编码后的数据报，数据报比 b 大时分多次返回
+func (c *DatagramConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		deadline := time.Unix(0, atomic.LoadInt64(&c.lastActive)).Add(c.idle)
+		if !time.Now().Before(deadline) {
+			return 0, io.EOF
+		}
+
+		_ = c.Conn.SetReadDeadline(deadline)
+		n, err := c.Conn.Read(c.rbuf[datagramHeaderSize:])
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !c.isReadClosed() {
+				// 超时期间可能发送过数据，重新计算空闲时间
+				continue
+			}
+
+			if c.isReadClosed() {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+
+		c.touch()
+		binary.LittleEndian.PutUint16(c.rbuf, uint16(n))
+		c.pending = c.rbuf[:datagramHeaderSize+n]
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write 写入编码后的数据报，凑齐完整的数据报后发送
+func (c *DatagramConn) Write(b []byte) (int, error) {
+	c.wbuf = append(c.wbuf, b...)
+
+	offset := 0
+	for len(c.wbuf)-offset >= datagramHeaderSize {
+		size := int(binary.LittleEndian.Uint16(c.wbuf[offset:]))
+		if len(c.wbuf)-offset < datagramHeaderSize+size {
+			break
+		}
+
+		// UDP 发送失败（如对端端口不可达）不影响会话中的后续数据报
+		_, _ = c.Conn.Write(c.wbuf[offset+datagramHeaderSize : offset+datagramHeaderSize+size])
+		c.touch()
+		offset += datagramHeaderSize + size
+	}
+
+	c.wbuf = append(c.wbuf[:0], c.wbuf[offset:]...)
+	return len(b), nil
+}
+
+func (c *DatagramConn) isReadClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.readClosed
+}
+
+// CloseRead 停止读取数据报，两个方向都关闭后关闭 UDP 会话
+func (c *DatagramConn) CloseRead() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readClosed = true
+	if c.writeClosed {
+		return c.Conn.Close()
+	}
+
+	return c.Conn.SetReadDeadline(time.Now())
+}
+
+// CloseWrite 停止发送数据报，两个方向都关闭后关闭 UDP 会话
+func (c *DatagramConn) CloseWrite() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeClosed = true
+	if c.readClosed {
+		return c.Conn.Close()
+	}
+
+	return nil
+}
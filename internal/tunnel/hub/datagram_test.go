@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDatagramConn(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	udpConn, err := net.DialUDP("udp", nil, backend.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := NewDatagramConn(udpConn, 200*time.Millisecond)
+	defer conn.Close()
+
+	// 编码后的数据报被拆分写入，凑齐后才发送
+	encoded := []byte{5, 0, 'h', 'e', 'l', 'l', 'o', 3, 0, 'f', 'o', 'o'}
+	for _, part := range [][]byte{encoded[:1], encoded[1:4], encoded[4:]} {
+		if _, err := conn.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 1024)
+	var peer *net.UDPAddr
+	for _, expect := range []string{"hello", "foo"} {
+		_ = backend.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := backend.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != expect {
+			t.Fatalf("expect datagram %q, got %q", expect, buf[:n])
+		}
+		peer = addr
+	}
+
+	if _, err := backend.WriteToUDP([]byte("world"), peer); err != nil {
+		t.Fatal(err)
+	}
+
+	// 数据报比读取缓冲区大时分多次返回
+	var got []byte
+	small := make([]byte, 3)
+	for len(got) < 7 {
+		n, err := conn.Read(small)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, small[:n]...)
+	}
+	if string(got) != "\x05\x00world" {
+		t.Fatalf("unexpected encoded datagram %q", got)
+	}
+
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("idle session should return io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	// InitialWindowSize 每个 link 的初始发送窗口（字节），发送方最多有这么多数据未被对端消费
+	InitialWindowSize = 32 * PacketSize
+	// windowUpdateThreshold 接收方累计消费超过该值后向对端归还额度
+	windowUpdateThreshold = InitialWindowSize / 2
+)
+
+var ErrWindowExceeded = errors.New("ErrWindowExceeded")
+
+// sendWindow link 发送窗口，额度不足时阻塞发送方，直到对端归还额度或 link 关闭
+type sendWindow struct {
+	cond   *sync.Cond
+	size   int
+	closed bool
+}
+
+func newSendWindow(size int) *sendWindow {
+	return &sendWindow{cond: sync.NewCond(&sync.Mutex{}), size: size}
+}
+
+// acquire 申请 n 字节发送额度，link 关闭时返回 false
+func (w *sendWindow) acquire(n int) bool {
+	w.cond.L.Lock()
+	defer w.cond.L.Unlock()
+
+	for w.size < n && !w.closed {
+		w.cond.Wait()
+	}
+
+	if w.closed {
+		return false
+	}
+
+	w.size -= n
+	return true
+}
+
+// release 对端归还发送额度
+func (w *sendWindow) release(n int) {
+	w.cond.L.Lock()
+	defer w.cond.L.Unlock()
+
+	w.size += n
+	w.cond.Broadcast()
+}
+
+func (w *sendWindow) close() {
+	w.cond.L.Lock()
+	defer w.cond.L.Unlock()
+
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// recvWindow link 接收窗口，记录已接收未消费和已消费未归还的数据量
+type recvWindow struct {
+	lock     sync.Mutex
+	buffered int
+	consumed int
+}
+
+// receive 收到对端 n 字节数据，对端发送的数据超出窗口时返回 false
+func (w *recvWindow) receive(n int) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.buffered+n > InitialWindowSize {
+		return false
+	}
+
+	w.buffered += n
+	return true
+}
+
+// consume 已将 n 字节数据写入本地连接，返回需要归还给对端的额度，为 0 时不需要通知对端
+func (w *recvWindow) consume(n int) uint32 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buffered -= n
+	w.consumed += n
+	if w.consumed < windowUpdateThreshold {
+		return 0
+	}
+
+	credit := w.consumed
+	w.consumed = 0
+	return uint32(credit)
+}
+
+// compact 数据长度不足缓冲区容量一半时拷贝到独立的缓冲区并归还 mPool 缓冲区，避免大量小包占用完整的缓冲区
+func compact(data []byte) []byte {
+	if len(data) >= cap(data)/2 {
+		return data
+	}
+
+	b := make([]byte, len(data))
+	copy(b, data)
+	mPool.Put(data)
+	return b
+}
@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendWindow(t *testing.T) {
+	w := newSendWindow(PacketSize)
+	if !w.acquire(PacketSize) {
+		t.Fatal("acquire within window should succeed")
+	}
+
+	acquired := make(chan bool)
+	go func() { acquired <- w.acquire(1) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquire should block when window is exhausted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.release(1)
+	if !<-acquired {
+		t.Fatal("acquire should succeed after release")
+	}
+
+	go func() { acquired <- w.acquire(1) }()
+	w.close()
+	if <-acquired {
+		t.Fatal("acquire should fail after window closed")
+	}
+}
+
+func TestRecvWindow(t *testing.T) {
+	var w recvWindow
+	if !w.receive(InitialWindowSize) {
+		t.Fatal("receive within window should succeed")
+	}
+
+	if w.receive(1) {
+		t.Fatal("receive beyond window should be rejected")
+	}
+
+	if credit := w.consume(windowUpdateThreshold - 1); credit != 0 {
+		t.Fatalf("credit should not be returned before threshold, got %d", credit)
+	}
+
+	if credit := w.consume(1); credit != windowUpdateThreshold {
+		t.Fatalf("expect credit %d, got %d", windowUpdateThreshold, credit)
+	}
+
+	if !w.receive(windowUpdateThreshold) {
+		t.Fatal("receive should succeed after data consumed")
+	}
+}
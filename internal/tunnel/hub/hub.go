@@ -1,18 +1,19 @@
 package hub
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"github.com/mylxsw/secure-tunnel/internal/auth"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mylxsw/asteria/log"
 )
 
 var ErrPeerClosed = errors.New("ErrPeerClosed")
+var ErrInvalidCommand = errors.New("ErrInvalidCommand")
 
 const (
 	LinkData uint8 = iota
@@ -21,46 +22,142 @@ const (
 	LinkCloseRecv
 	LinkCloseSend
 	TunHeartbeat
+	LinkWindowUpdate // 归还发送额度，Command 之后紧跟 uint32 额度（字节），仅在启用流量控制时使用
+	TunPing          // 服务端发起的心跳探测，ID 为探测序号，仅在协商了 CapHeartbeatProbe 时使用
+	TunPong          // 对 TunPing 的回应，ID 与 TunPing 相同
+	TunGoAway        // 服务端即将关闭隧道，已有 link 继续传输直到结束，仅在协商了 CapGoAway 时使用
 )
 
+// Command 控制命令，v1 帧格式中 ID 编码为 uint16，v2 帧格式中编码为 uint32
 type Command struct {
 	Cmd uint8  // control command
-	ID  uint16 // ID
+	ID  uint32 // ID
+
+	// Target LinkCreate 命令的目标后端，只在多路复用的隧道中使用，编码在命令之后
+	Target string
 }
 
 type Hub struct {
 	tunnel *Tunnel
 
 	linksLock sync.RWMutex // protect links
-	links     map[uint16]*Link
+	links     map[uint32]*Link
+
+	flowControl bool // 是否启用 link 级别的流量控制，需要双方在握手时协商
+
+	lastActive int64 // 最后一次收到 link 数据或 link 关闭的时间，UnixNano
 
 	OnCtrlFilter func(cmd Command) bool
 	OnDataFilter func(isResp bool, link *Link, data []byte)
 }
 
 func NewHub(tunnel *Tunnel) *Hub {
+	tunnel.startWriter()
 	return &Hub{
-		tunnel: tunnel,
-		links:  make(map[uint16]*Link),
+		tunnel:     tunnel,
+		links:      make(map[uint32]*Link),
+		lastActive: time.Now().UnixNano(),
 	}
 }
 
+// LastActive 最后一次收到 link 数据或 link 关闭的时间，心跳不计入
+func (h *Hub) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&h.lastActive))
+}
+
+func (h *Hub) touch() {
+	atomic.StoreInt64(&h.lastActive, time.Now().UnixNano())
+}
+
+// LinkCount 当前 link 数量
+func (h *Hub) LinkCount() int {
+	h.linksLock.RLock()
+	defer h.linksLock.RUnlock()
+	return len(h.links)
+}
+
+// EnableFlowControl 启用 link 级别的基于额度的流量控制，必须在创建 link 之前调用
+func (h *Hub) EnableFlowControl() {
+	h.flowControl = true
+}
+
 func (h *Hub) TunnelName() string {
 	return h.tunnel.String()
 }
 
-func (h *Hub) SendCommand(id uint16, cmd uint8) bool {
-	buf := bytes.NewBuffer(mPool.Get()[0:0])
-	c := Command{
-		Cmd: cmd,
-		ID:  id,
+// MaxLinkID 当前隧道支持的最大 link ID
+func (h *Hub) MaxLinkID() uint32 {
+	return h.tunnel.MaxLinkID()
+}
+
+func (h *Hub) SendCommand(id uint32, cmd uint8) bool {
+	buf := h.appendCommand(mPool.Get()[0:0], Command{Cmd: cmd, ID: id})
+
+	// link 的关闭命令不能越过该 link 尚未发送的数据，否则对端关闭写入后会丢弃剩余的数据
+	if cmd == LinkClose || cmd == LinkCloseSend || cmd == LinkCloseRecv {
+		if err := h.tunnel.writeLinkCommand(id, buf); err != nil {
+			log.Errorf("link(%d) write command to %s failed: %s", id, h.tunnel, err.Error())
+			return false
+		}
+		return true
+	}
+
+	return h.send(0, buf)
+}
+
+// resetLink 对端超出接收窗口时重置 link，在读 goroutine 中调用，不能等待 link 的发送队列
+func (h *Hub) resetLink(id uint32) {
+	buf := h.appendCommand(mPool.Get()[0:0], Command{Cmd: LinkClose, ID: id})
+	if err := h.tunnel.resetLink(id, buf); err != nil {
+		log.Errorf("link(%d) write reset to %s failed: %s", id, h.tunnel, err.Error())
+	}
+}
+
+// SendLinkCreate 创建连接到指定后端的 link，用于多路复用的隧道
+func (h *Hub) SendLinkCreate(id uint32, target string) bool {
+	buf := h.appendCommand(mPool.Get()[0:0], Command{Cmd: LinkCreate, ID: id})
+	buf = append(buf, target...)
+	return h.send(0, buf)
+}
+
+// SendWindowUpdate 向对端归还 link 的发送额度
+func (h *Hub) SendWindowUpdate(id uint32, credit uint32) bool {
+	buf := h.appendCommand(mPool.Get()[0:0], Command{Cmd: LinkWindowUpdate, ID: id})
+	buf = binary.LittleEndian.AppendUint32(buf, credit)
+	return h.send(0, buf)
+}
+
+// appendCommand 编码控制命令
+func (h *Hub) appendCommand(dst []byte, cmd Command) []byte {
+	dst = append(dst, cmd.Cmd)
+	if h.tunnel.wide {
+		return binary.LittleEndian.AppendUint32(dst, cmd.ID)
+	}
+	return binary.LittleEndian.AppendUint16(dst, uint16(cmd.ID))
+}
+
+// parseCommand 解析控制命令，返回命令之后的附加数据
+func (h *Hub) parseCommand(data []byte) (cmd Command, extra []byte, err error) {
+	idSize := 2
+	if h.tunnel.wide {
+		idSize = 4
+	}
+
+	if len(data) < 1+idSize {
+		return cmd, nil, ErrInvalidCommand
 	}
-	_ = binary.Write(buf, binary.LittleEndian, &c)
 
-	return h.send(0, buf.Bytes())
+	cmd.Cmd = data[0]
+	if h.tunnel.wide {
+		cmd.ID = binary.LittleEndian.Uint32(data[1:])
+	} else {
+		cmd.ID = uint32(binary.LittleEndian.Uint16(data[1:]))
+	}
+
+	return cmd, data[1+idSize:], nil
 }
 
-func (h *Hub) send(id uint16, data []byte) bool {
+func (h *Hub) send(id uint32, data []byte) bool {
 	if err := h.tunnel.WritePacket(id, data); err != nil {
 		log.Errorf("link(%d) write to %s failed: %s", id, h.tunnel, err.Error())
 		return false
@@ -68,8 +165,17 @@ func (h *Hub) send(id uint16, data []byte) bool {
 	return true
 }
 
+func (h *Hub) onWindowUpdate(id uint32, credit uint32) {
+	l := h.GetLink(id)
+	if l == nil {
+		return
+	}
+
+	l.release(credit)
+}
+
 func (h *Hub) onCtrl(cmd Command) {
-	if cmd.Cmd != TunHeartbeat {
+	if cmd.Cmd != TunHeartbeat && cmd.Cmd != TunPing && cmd.Cmd != TunPong {
 		log.Debugf("link(%d) recv cmd: %d", cmd.ID, cmd.Cmd)
 	}
 
@@ -96,7 +202,7 @@ func (h *Hub) onCtrl(cmd Command) {
 	}
 }
 
-func (h *Hub) onData(id uint16, data []byte) {
+func (h *Hub) onData(id uint32, data []byte) {
 	link := h.GetLink(id)
 	if link == nil {
 		mPool.Put(data)
@@ -104,13 +210,19 @@ func (h *Hub) onData(id uint16, data []byte) {
 		return
 	}
 
+	h.touch()
+
+	data = link.compact(data)
 	if h.OnDataFilter != nil {
 		h.OnDataFilter(false, link, data)
 	}
 
-	if !link.write(data) {
-		mPool.Put(data)
-		log.Errorf("link(%d) put data failed", id)
+	if err := link.write(data); err != nil {
+		log.Errorf("link(%d) put data failed: %v", id, err)
+		if err == ErrWindowExceeded {
+			link.close()
+			h.resetLink(id)
+		}
 	}
 }
 
@@ -125,15 +237,29 @@ func (h *Hub) Start() {
 		}
 
 		if id == 0 {
-			var cmd Command
-			buf := bytes.NewBuffer(data)
-			err := binary.Read(buf, binary.LittleEndian, &cmd)
+			var credit uint32
+			cmd, extra, err := h.parseCommand(data)
+			if err == nil && cmd.Cmd == LinkWindowUpdate {
+				if len(extra) < 4 {
+					err = ErrInvalidCommand
+				} else {
+					credit = binary.LittleEndian.Uint32(extra)
+				}
+			}
+			if err == nil && cmd.Cmd == LinkCreate {
+				cmd.Target = string(extra)
+			}
 			mPool.Put(data)
 			if err != nil {
 				log.Errorf("parse message failed: %s, break dispatch", err.Error())
 				break
 			}
-			h.onCtrl(cmd)
+
+			if cmd.Cmd == LinkWindowUpdate {
+				h.onWindowUpdate(cmd.ID, credit)
+			} else {
+				h.onCtrl(cmd)
+			}
 		} else {
 			h.onData(id, data)
 		}
@@ -151,7 +277,7 @@ func (h *Hub) Close() {
 func (h *Hub) Status() {
 	h.linksLock.RLock()
 	defer h.linksLock.RUnlock()
-	var links []uint16
+	var links []uint32
 	for id := range h.links {
 		links = append(links, id)
 	}
@@ -164,25 +290,33 @@ func (h *Hub) ResetAllLink() {
 
 	log.Errorf("reset all %d links", len(h.links))
 	for _, l := range h.links {
-		l.close()
+		l.reset()
 	}
 }
 
 // GetLink hub function
-func (h *Hub) GetLink(id uint16) *Link {
+func (h *Hub) GetLink(id uint32) *Link {
 	h.linksLock.RLock()
 	defer h.linksLock.RUnlock()
 	return h.links[id]
 }
 
-func (h *Hub) DeleteLink(id uint16) {
+func (h *Hub) DeleteLink(id uint32) {
 	log.Debugf("link(%d) delete", id)
 	h.linksLock.Lock()
 	defer h.linksLock.Unlock()
 	delete(h.links, id)
+	h.tunnel.setLinkPriority(id, PriorityNormal)
+	h.touch()
 }
 
-func (h *Hub) CreateLink(id uint16) *Link {
+// SetLinkPriority 设置 link 发送数据时的调度优先级，同一隧道中优先级高的 link 分得更多的带宽
+// QUIC 中的 link 使用独立的数据流，由 QUIC 负责调度，不受此影响
+func (h *Hub) SetLinkPriority(id uint32, p Priority) {
+	h.tunnel.setLinkPriority(id, p)
+}
+
+func (h *Hub) CreateLink(id uint32) *Link {
 	log.Debugf("link(%d) new link over %s", id, h.tunnel)
 
 	h.linksLock.Lock()
@@ -193,15 +327,17 @@ func (h *Hub) CreateLink(id uint16) *Link {
 		return nil
 	}
 
-	l := newLink(id)
+	l := newLink(id, h.tunnel.PacketSize(), h.flowControl)
 	h.links[id] = l
 
 	return l
 }
 
-func (h *Hub) StartLink(link *Link, conn *net.TCPConn, authedUser *auth.AuthedUser) {
-	_ = conn.SetKeepAlive(true)
-	_ = conn.SetKeepAlivePeriod(time.Second * 60)
+func (h *Hub) StartLink(link *Link, conn Conn, authedUser *auth.AuthedUser) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetKeepAlive(true)
+		_ = tcpConn.SetKeepAlivePeriod(time.Second * 60)
+	}
 	link.setConn(conn)
 
 	log.With(authedUser).Debugf("link(%d) start %v", link.ID, conn.RemoteAddr())
@@ -224,6 +360,14 @@ func (h *Hub) StartLink(link *Link, conn *net.TCPConn, authedUser *auth.AuthedUs
 				h.OnDataFilter(true, link, data)
 			}
 
+			link.waitOutbound(len(data))
+
+			// 对端未及时消费数据时在此阻塞，只影响当前 link
+			if !link.acquire(len(data)) {
+				mPool.Put(data)
+				break
+			}
+
 			h.send(link.ID, data)
 		}
 	}()
@@ -233,11 +377,14 @@ func (h *Hub) StartLink(link *Link, conn *net.TCPConn, authedUser *auth.AuthedUs
 		defer wg.Done()
 		defer func() { _ = link.conn.CloseWrite() }()
 
-		err := link._write()
+		err := link._write(func(credit uint32) {
+			h.SendWindowUpdate(link.ID, credit)
+		})
 		if err != ErrPeerClosed {
 			h.SendCommand(link.ID, LinkCloseRecv)
 		}
 	}()
 	wg.Wait()
+	_ = link.conn.Close()
 	log.Debugf("link(%d) close", link.ID)
 }
@@ -0,0 +1,176 @@
+package hub
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHubLinkCreateTarget(t *testing.T) {
+	for _, wide := range []bool{false, true} {
+		local, remote := newTunnelPair(t)
+		if wide {
+			local.EnableWideFrames()
+			remote.EnableWideFrames()
+		}
+
+		commands := make(chan Command, 2)
+		server := NewHub(remote)
+		server.OnCtrlFilter = func(cmd Command) bool {
+			commands <- cmd
+			return true
+		}
+		go server.Start()
+
+		client := NewHub(local)
+		client.SendCommand(1, LinkCreate)
+		client.SendLinkCreate(2, "mysql-dev")
+
+		for _, expect := range []Command{{Cmd: LinkCreate, ID: 1}, {Cmd: LinkCreate, ID: 2, Target: "mysql-dev"}} {
+			if cmd := <-commands; cmd != expect {
+				t.Fatalf("expect %+v, got %+v", expect, cmd)
+			}
+		}
+	}
+}
+
+func TestHubResetLinksOnTunnelClose(t *testing.T) {
+	local, remote := newTunnelPair(t)
+	defer func() { _ = remote.Close() }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := <-accepted
+	defer func() { _ = backend.Close() }()
+
+	h := NewHub(local)
+	stopped := make(chan struct{})
+	go func() {
+		h.Start()
+		close(stopped)
+	}()
+
+	link := h.CreateLink(1)
+	linkStopped := make(chan struct{})
+	go func() {
+		h.StartLink(link, conn, nil)
+		close(linkStopped)
+	}()
+
+	if h.LinkCount() != 1 {
+		t.Fatalf("expect 1 link, got %d", h.LinkCount())
+	}
+
+	// 隧道断开后，本地连接需要被关闭，不能等待对端关闭
+	h.Close()
+	<-stopped
+
+	select {
+	case <-linkStopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("link should stop after tunnel closed")
+	}
+
+	_ = backend.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := backend.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("backend connection should be closed, got %v", err)
+	}
+}
+
+func TestHubResetLinkWithFullQueue(t *testing.T) {
+	// net.Pipe 没有缓冲，对端不读取时 hub 的写 goroutine 阻塞，link 的发送队列会被填满
+	hubConn, peerConn := net.Pipe()
+	hubTun, peer := NewTunnel(hubConn), NewTunnel(peerConn)
+	defer func() { _ = hubTun.Close(); _ = peer.Close() }()
+
+	commands := make(chan Command, 1)
+	h := NewHub(hubTun)
+	h.EnableFlowControl()
+	h.OnCtrlFilter = func(cmd Command) bool {
+		commands <- cmd
+		return true
+	}
+	h.CreateLink(1)
+	go h.Start()
+
+	go func() {
+		for i := 0; i < 2*linkQueueSize; i++ {
+			if err := hubTun.WritePacket(1, mPool.Get()[:PacketSize]); err != nil {
+				return
+			}
+		}
+	}()
+
+	queued := func() int {
+		hubTun.sched.lock.Lock()
+		defer hubTun.sched.lock.Unlock()
+		if q := hubTun.sched.queues[1]; q != nil {
+			return len(q.packets)
+		}
+		return 0
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for queued() < linkQueueSize {
+		if time.Now().After(deadline) {
+			t.Fatal("link queue should be full")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 对端超出接收窗口后继续发送命令，hub 的读 goroutine 不能阻塞在 link 的发送队列上
+	go func() {
+		for sent := 0; sent <= InitialWindowSize; sent += PacketSize {
+			if err := peer.WritePacket(1, make([]byte, PacketSize)); err != nil {
+				return
+			}
+		}
+		_ = peer.WritePacket(0, h.appendCommand(nil, Command{Cmd: LinkCreate, ID: 2}))
+	}()
+
+	select {
+	case cmd := <-commands:
+		if cmd.Cmd != LinkCreate || cmd.ID != 2 {
+			t.Fatalf("unexpected command: %+v", cmd)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("hub should keep reading after link window exceeded")
+	}
+
+	// 重置命令从控制队列发送，不排在 link 尚未发送的数据之后
+	received := 0
+	for {
+		id, data, err := peer.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id != 0 {
+			received++
+			continue
+		}
+
+		if cmd, _, err := h.parseCommand(data); err != nil || cmd.Cmd != LinkClose || cmd.ID != 1 {
+			t.Fatalf("expect LinkClose of link 1, got %+v, %v", cmd, err)
+		}
+		break
+	}
+
+	if received >= linkQueueSize {
+		t.Fatalf("queued data of the reset link should be dropped, received %d packets before reset", received)
+	}
+}
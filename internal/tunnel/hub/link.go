@@ -7,20 +7,68 @@ import (
 	"sync"
 )
 
+// Conn link 的本地连接，TCP 连接或 UDP 会话
+type Conn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
 type Link struct {
-	ID          uint16
-	conn        *net.TCPConn
+	ID          uint32
+	conn        Conn
 	writeBuffer *common.Buffer // write buffer
+	packetSize  int            // 每次从连接中读取的最大数据量
+
+	lock      sync.Mutex // protects below fields
+	err       error      // if read closed, error to give reads
+	reclaimed bool       // 隧道断开时已被回收，之后设置的连接直接关闭
+
+	sendWindow *sendWindow // 未启用流量控制时为 nil
+	recvWindow *recvWindow // 未启用流量控制时为 nil
 
-	lock sync.Mutex // protects below fields
-	err  error      // if read closed, error to give reads
+	inbound  RateLimiter // 限制写入本地连接的速率，为 nil 时不限制
+	outbound RateLimiter // 限制从本地连接读取的速率，为 nil 时不限制
 }
 
-func newLink(id uint16) *Link {
-	return &Link{
+// RateLimiter 限制 link 的传输速率，Wait 阻塞直到允许传输 n 字节
+type RateLimiter interface {
+	Wait(n int)
+}
+
+// SetRateLimiters 设置 link 两个方向的限速器，必须在 link 启动之前调用
+func (l *Link) SetRateLimiters(inbound, outbound RateLimiter) {
+	l.inbound = inbound
+	l.outbound = outbound
+}
+
+// waitInbound 等待写入本地连接的额度
+func (l *Link) waitInbound(n int) {
+	if l.inbound != nil {
+		l.inbound.Wait(n)
+	}
+}
+
+// waitOutbound 等待从本地连接读取的数据发往对端的额度
+func (l *Link) waitOutbound(n int) {
+	if l.outbound != nil {
+		l.outbound.Wait(n)
+	}
+}
+
+func newLink(id uint32, packetSize int, flowControl bool) *Link {
+	l := &Link{
 		ID:          id,
 		writeBuffer: common.NewBuffer(16),
+		packetSize:  packetSize,
+	}
+
+	if flowControl {
+		l.sendWindow = newSendWindow(InitialWindowSize)
+		l.recvWindow = &recvWindow{}
 	}
+
+	return l
 }
 
 // set err
@@ -38,6 +86,9 @@ func (l *Link) setError(err error) bool {
 
 // closeRead stop read data from Link
 func (l *Link) closeRead() bool {
+	if l.sendWindow != nil {
+		l.sendWindow.close()
+	}
 	return l.setError(ErrPeerClosed)
 }
 
@@ -52,48 +103,118 @@ func (l *Link) close() {
 	l.closeWrite()
 }
 
+// reset 关闭 link 并关闭本地连接，阻塞在本地连接上的读写随之返回
+func (l *Link) reset() {
+	l.close()
+
+	l.lock.Lock()
+	l.reclaimed = true
+	conn := l.conn
+	l.lock.Unlock()
+
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
 // read data from Link
 func (l *Link) read() ([]byte, error) {
-	if l.err != nil {
-		return nil, l.err
+	if err := l.getError(); err != nil {
+		return nil, err
 	}
-	b := mPool.Get()
+	b := mPool.GetSize(l.packetSize)
 	n, err := l.conn.Read(b)
 	if err != nil {
+		mPool.Put(b)
 		l.setError(err)
-		return nil, l.err
+		return nil, l.getError()
 	}
-	if l.err != nil {
-		return nil, l.err
+	if err := l.getError(); err != nil {
+		mPool.Put(b)
+		return nil, err
 	}
 	return b[:n], nil
 }
 
-// write data into Link
-func (l *Link) write(b []byte) bool {
-	return l.writeBuffer.Put(b)
+// getError 读取关闭原因，link 可能同时被隧道关闭
+func (l *Link) getError() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.err
+}
+
+// acquire 申请发送 n 字节数据的额度，额度不足时阻塞，link 关闭时返回 false
+func (l *Link) acquire(n int) bool {
+	if l.sendWindow == nil {
+		return true
+	}
+	return l.sendWindow.acquire(n)
+}
+
+// release 对端归还发送额度
+func (l *Link) release(credit uint32) {
+	if l.sendWindow != nil {
+		l.sendWindow.release(int(credit))
+	}
+}
+
+// compact 启用流量控制时将小数据包拷贝到独立的缓冲区，使缓存占用的内存与窗口大小成正比
+func (l *Link) compact(b []byte) []byte {
+	if l.recvWindow == nil {
+		return b
+	}
+	return compact(b)
+}
+
+// write data into Link, the data is released when write failed
+func (l *Link) write(b []byte) error {
+	if l.recvWindow != nil {
+		if !l.recvWindow.receive(len(b)) {
+			mPool.Put(b)
+			return ErrWindowExceeded
+		}
+	}
+
+	if !l.writeBuffer.Put(b) {
+		mPool.Put(b)
+		return ErrPeerClosed
+	}
+	return nil
 }
 
-// inject data low level connection
-func (l *Link) _write() error {
+// inject data low level connection, onConsumed is called with the credit to return to the peer
+func (l *Link) _write(onConsumed func(credit uint32)) error {
 	for {
 		data, ok := l.writeBuffer.Pop()
 		if !ok {
 			return ErrPeerClosed
 		}
 
-		_, err := l.conn.Write(data)
+		l.waitInbound(len(data))
+		n, err := l.conn.Write(data)
 		mPool.Put(data)
 		if err != nil {
 			return err
 		}
+
+		if l.recvWindow != nil {
+			if credit := l.recvWindow.consume(n); credit > 0 {
+				onConsumed(credit)
+			}
+		}
 	}
 }
 
 // set low level connection
-func (l *Link) setConn(conn *net.TCPConn) {
+func (l *Link) setConn(conn Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
 	if l.conn != nil {
 		panic(fmt.Errorf("Link(%d) repeated set conn", l.ID))
 	}
 	l.conn = conn
+	if l.reclaimed {
+		_ = conn.Close()
+	}
 }
@@ -28,3 +28,42 @@ func newPool(sz int) *pool {
 	}
 	return p
 }
+
+// sizedPool 按容量划分的多级缓冲池，pools 按容量从小到大排列
+type sizedPool struct {
+	pools []*pool
+}
+
+// Get 获取最小一级的缓冲区
+func (p *sizedPool) Get() []byte {
+	return p.pools[0].Get()
+}
+
+// GetSize 获取长度为 n 的缓冲区，超出最大一级容量时直接分配
+func (p *sizedPool) GetSize(n int) []byte {
+	for _, pl := range p.pools {
+		if n <= pl.sz {
+			return pl.Get()[:n]
+		}
+	}
+
+	return make([]byte, n)
+}
+
+// Put 按容量将缓冲区归还到对应的缓冲池，容量不匹配的缓冲区直接丢弃
+func (p *sizedPool) Put(x []byte) {
+	for _, pl := range p.pools {
+		if cap(x) == pl.sz {
+			pl.Put(x)
+			return
+		}
+	}
+}
+
+func newSizedPool(sizes ...int) *sizedPool {
+	p := &sizedPool{}
+	for _, sz := range sizes {
+		p.pools = append(p.pools, newPool(sz))
+	}
+	return p
+}
@@ -0,0 +1,232 @@
+package hub
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Priority link 的调度优先级，决定 link 在隧道中分得的发送带宽比例
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityLow
+	PriorityHigh
+)
+
+// ParsePriority 解析优先级：high|normal|low，为空时为 normal
+func ParsePriority(name string) (Priority, error) {
+	switch name {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+
+	return PriorityNormal, fmt.Errorf("invalid priority %s: must be one of high|normal|low", name)
+}
+
+// weight 每轮调度中 link 可以发送的数据量相对于 quantum 的倍数
+func (p Priority) weight() int {
+	switch p {
+	case PriorityLow:
+		return 1
+	case PriorityHigh:
+		return 16
+	}
+	return 4
+}
+
+const (
+	// quantum 权重为 1 的 link 每轮调度可以发送的字节数
+	quantum = 2048
+	// linkQueueSize 每个 link 发送队列的长度，队列满时只阻塞该 link 的 WritePacket
+	linkQueueSize = 32
+)
+
+// linkQueue 单个 link 等待发送的数据包
+type linkQueue struct {
+	id      uint32
+	packets []packet
+	deficit int
+	turn    bool // 本轮是否已经获得过 quantum
+}
+
+// scheduler 在多个 link 之间按加权差额轮询（DRR）调度数据包，隧道级别的控制命令优先发送
+// link 的关闭命令放入该 link 的发送队列，不会越过尚未发送的数据
+// 批量传输的 link 每轮只能发送与其权重相应的数据量，交互式 link 的小数据包不会排在大量数据之后
+type scheduler struct {
+	lock  sync.Mutex
+	ready *sync.Cond // 有数据包可以发送或调度器关闭
+	space *sync.Cond // link 发送队列有空位或调度器关闭
+
+	control    []packet
+	queues     map[uint32]*linkQueue
+	active     []*linkQueue // 有数据包待发送的 link，按轮询顺序排列
+	cur        int
+	priorities map[uint32]Priority
+	closed     bool
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		queues:     make(map[uint32]*linkQueue),
+		priorities: make(map[uint32]Priority),
+	}
+	s.ready = sync.NewCond(&s.lock)
+	s.space = sync.NewCond(&s.lock)
+	return s
+}
+
+// setPriority 设置 link 的优先级，对之后获得的 quantum 生效
+func (s *scheduler) setPriority(id uint32, p Priority) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if p == PriorityNormal {
+		delete(s.priorities, id)
+		return
+	}
+	s.priorities[id] = p
+}
+
+// push 放入待发送的数据包，link 的发送队列满时阻塞，调度器关闭时返回 false
+func (s *scheduler) push(p packet) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if p.queue() == 0 {
+		if s.closed {
+			return false
+		}
+
+		s.control = append(s.control, p)
+		s.ready.Signal()
+		return true
+	}
+
+	for {
+		if s.closed {
+			return false
+		}
+
+		q := s.queues[p.queue()]
+		if q == nil {
+			q = &linkQueue{id: p.queue()}
+			s.queues[p.queue()] = q
+			s.active = append(s.active, q)
+		}
+
+		if len(q.packets) < linkQueueSize {
+			q.packets = append(q.packets, p)
+			s.ready.Signal()
+			return true
+		}
+
+		s.space.Wait()
+	}
+}
+
+// pop 取出下一个要发送的数据包，block 为 false 时没有数据包立即返回，调度器关闭后返回 false
+func (s *scheduler) pop(block bool) (packet, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.control) == 0 && len(s.active) == 0 {
+		if s.closed || !block {
+			return packet{}, false
+		}
+		s.ready.Wait()
+	}
+
+	if s.closed {
+		return packet{}, false
+	}
+
+	if len(s.control) > 0 {
+		p := s.control[0]
+		s.control[0] = packet{}
+		s.control = s.control[1:]
+		return p, true
+	}
+
+	for {
+		if s.cur >= len(s.active) {
+			s.cur = 0
+		}
+
+		q := s.active[s.cur]
+		if !q.turn {
+			q.turn = true
+			q.deficit += quantum * s.priorities[q.id].weight()
+		}
+
+		p := q.packets[0]
+		if len(p.data) > q.deficit {
+			// 额度不足，轮到下一个 link，剩余额度留到下一轮
+			q.turn = false
+			s.cur++
+			continue
+		}
+
+		q.deficit -= len(p.data)
+		q.packets[0] = packet{}
+		q.packets = q.packets[1:]
+		if len(q.packets) == 0 {
+			// 队列为空的 link 退出轮询，不保留额度
+			delete(s.queues, q.id)
+			s.active = append(s.active[:s.cur], s.active[s.cur+1:]...)
+		}
+
+		s.space.Broadcast()
+		return p, true
+	}
+}
+
+// drop 丢弃 link 尚未发送的数据包，唤醒等待该 link 队列空位的调用方
+func (s *scheduler) drop(id uint32) []packet {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q := s.queues[id]
+	if q == nil {
+		return nil
+	}
+
+	delete(s.queues, id)
+	for i, a := range s.active {
+		if a == q {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			if i < s.cur {
+				s.cur--
+			}
+			break
+		}
+	}
+
+	s.space.Broadcast()
+	return q.packets
+}
+
+// close 关闭调度器，唤醒所有等待中的调用方，返回尚未发送的数据包
+func (s *scheduler) close() []packet {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	pending := s.control
+	for _, q := range s.active {
+		pending = append(pending, q.packets...)
+	}
+	s.control, s.active, s.queues = nil, nil, make(map[uint32]*linkQueue)
+
+	s.ready.Broadcast()
+	s.space.Broadcast()
+	return pending
+}
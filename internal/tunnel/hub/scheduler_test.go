@@ -0,0 +1,150 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerFairness(t *testing.T) {
+	s := newScheduler()
+
+	// 批量传输的 link 已经积压了大量数据
+	for i := 0; i < linkQueueSize; i++ {
+		s.push(packet{linkID: 1, data: make([]byte, PacketSize)})
+	}
+	s.push(packet{linkID: 2, data: []byte("PING")})
+	s.push(packet{linkID: 0, data: []byte{TunHeartbeat}})
+
+	if p, _ := s.pop(false); p.linkID != 0 {
+		t.Fatalf("control packet should be sent first, got link(%d)", p.linkID)
+	}
+
+	// 交互式 link 的小数据包最多等待一轮批量数据
+	for i := 0; ; i++ {
+		p, ok := s.pop(false)
+		if !ok {
+			t.Fatal("interactive packet lost")
+		}
+
+		if p.linkID == 2 {
+			if i > 1 {
+				t.Fatalf("interactive packet waited for %d bulk packets", i)
+			}
+			break
+		}
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := newScheduler()
+	s.setPriority(1, PriorityHigh)
+	s.setPriority(2, PriorityLow)
+
+	for i := 0; i < linkQueueSize; i++ {
+		s.push(packet{linkID: 1, data: make([]byte, 1024)})
+		s.push(packet{linkID: 2, data: make([]byte, 1024)})
+	}
+
+	sent := make(map[uint32]int)
+	for i := 0; i < linkQueueSize; i++ {
+		p, _ := s.pop(false)
+		sent[p.linkID]++
+	}
+
+	if sent[1] < sent[2]*4 {
+		t.Fatalf("high priority link should get more bandwidth, high %d, low %d", sent[1], sent[2])
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := newScheduler()
+	for i := 0; i < linkQueueSize; i++ {
+		s.push(packet{linkID: 1, data: []byte("data")})
+	}
+
+	// 队列已满，push 阻塞直到调度器关闭
+	pushed := make(chan bool)
+	go func() { pushed <- s.push(packet{linkID: 1, data: []byte("data")}) }()
+
+	select {
+	case <-pushed:
+		t.Fatal("push should block when link queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if pending := s.close(); len(pending) != linkQueueSize {
+		t.Fatalf("expect %d pending packets, got %d", linkQueueSize, len(pending))
+	}
+
+	if <-pushed {
+		t.Fatal("push should fail after scheduler closed")
+	}
+
+	if _, ok := s.pop(true); ok {
+		t.Fatal("pop should fail after scheduler closed")
+	}
+}
+
+func TestSchedulerLinkCommandOrder(t *testing.T) {
+	s := newScheduler()
+
+	// link 读到 EOF 前已经积压了数据，随后发送 LinkCloseSend
+	for i := 0; i < 3; i++ {
+		s.push(packet{linkID: 1, data: []byte{byte(i)}})
+	}
+	s.push(packet{owner: 1, data: []byte{LinkCloseSend}})
+	s.push(packet{linkID: 0, data: []byte{TunHeartbeat}})
+
+	if p, _ := s.pop(false); p.linkID != 0 || p.data[0] != TunHeartbeat {
+		t.Fatalf("tunnel command should be sent first, got %+v", p)
+	}
+
+	for i := 0; i < 3; i++ {
+		if p, _ := s.pop(false); p.linkID != 1 || p.data[0] != byte(i) {
+			t.Fatalf("link data should be sent before its close command, got %+v", p)
+		}
+	}
+
+	if p, _ := s.pop(false); p.linkID != 0 || p.data[0] != LinkCloseSend {
+		t.Fatalf("expect LinkCloseSend after link data, got %+v", p)
+	}
+
+	if _, ok := s.pop(false); ok {
+		t.Fatal("scheduler should be empty")
+	}
+}
+
+func TestSchedulerDrop(t *testing.T) {
+	s := newScheduler()
+	for i := 0; i < linkQueueSize; i++ {
+		s.push(packet{linkID: 1, data: []byte{byte(i)}})
+	}
+	s.push(packet{linkID: 2, data: []byte{2}})
+
+	// 队列已满的 link 被丢弃后，等待空位的调用方可以继续写入
+	pushed := make(chan bool)
+	go func() { pushed <- s.push(packet{linkID: 1, data: []byte{0xff}}) }()
+
+	if dropped := s.drop(1); len(dropped) != linkQueueSize {
+		t.Fatalf("expect %d dropped packets, got %d", linkQueueSize, len(dropped))
+	}
+
+	select {
+	case ok := <-pushed:
+		if !ok {
+			t.Fatal("push should succeed after link queue dropped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("push should be woken up after link queue dropped")
+	}
+
+	for _, expect := range []packet{{linkID: 2, data: []byte{2}}, {linkID: 1, data: []byte{0xff}}} {
+		if p, _ := s.pop(false); p.linkID != expect.linkID || p.data[0] != expect.data[0] {
+			t.Fatalf("expect %+v, got %+v", expect, p)
+		}
+	}
+
+	if _, ok := s.pop(false); ok {
+		t.Fatal("scheduler should be empty")
+	}
+}
@@ -0,0 +1,142 @@
+package hub
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+)
+
+// 流类型，QUIC 等支持多路流的传输方式中，客户端打开的每个流以 1 字节类型开头
+const (
+	// StreamTunnel 隧道流，承载握手和控制命令，每个连接只有一个
+	StreamTunnel uint8 = iota + 1
+	// StreamLink link 数据流，类型之后为 LinkID uint32 | 目标后端长度 uint16 | 目标后端
+	StreamLink
+)
+
+// maxStreamTarget 流头部中目标后端名称的最大长度
+const maxStreamTarget = 1024
+
+// Stream link 独占的数据流（如 QUIC stream），link 的数据直接在流上传输，不经过隧道分帧
+type Stream interface {
+	io.ReadWriteCloser
+	CloseRead() error
+	CloseWrite() error
+}
+
+// WriteStreamHeader 写入 link 数据流的头部，target 为目标后端，只在多路复用的隧道中使用
+func WriteStreamHeader(w io.Writer, id uint32, target string) error {
+	if len(target) > maxStreamTarget {
+		return fmt.Errorf("stream target %s too long", target)
+	}
+
+	buf := make([]byte, 0, 7+len(target))
+	buf = append(buf, StreamLink)
+	buf = binary.LittleEndian.AppendUint32(buf, id)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(target)))
+	buf = append(buf, target...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadStreamHeader 读取 link 数据流的头部
+func ReadStreamHeader(r io.Reader) (id uint32, target string, err error) {
+	var header [7]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	if header[0] != StreamLink {
+		return 0, "", fmt.Errorf("unexpected stream type %d", header[0])
+	}
+
+	id = binary.LittleEndian.Uint32(header[1:])
+	size := int(binary.LittleEndian.Uint16(header[5:]))
+	if size > maxStreamTarget {
+		return 0, "", fmt.Errorf("stream target too long: %d", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+
+	return id, string(buf), nil
+}
+
+// StartStreamLink 在 link 独占的数据流和本地连接之间转发数据，流量控制由数据流自身负责
+func (h *Hub) StartStreamLink(link *Link, stream Stream, conn Conn, authedUser *auth.AuthedUser) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetKeepAlive(true)
+		_ = tcpConn.SetKeepAlivePeriod(time.Second * 60)
+	}
+	link.setConn(conn)
+
+	log.With(authedUser).Debugf("link(%d) start stream %v", link.ID, conn.RemoteAddr())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			_ = link.conn.CloseRead()
+			_ = stream.CloseWrite()
+		}()
+
+		for {
+			data, err := link.read()
+			if err != nil {
+				break
+			}
+
+			if h.OnDataFilter != nil {
+				h.OnDataFilter(true, link, data)
+			}
+
+			link.waitOutbound(len(data))
+			_, err = stream.Write(data)
+			mPool.Put(data)
+			if err != nil {
+				break
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			_ = link.conn.CloseWrite()
+			_ = stream.CloseRead()
+		}()
+
+		for {
+			data := mPool.GetSize(link.packetSize)
+			n, err := stream.Read(data)
+			if n > 0 {
+				if h.OnDataFilter != nil {
+					h.OnDataFilter(false, link, data[:n])
+				}
+
+				link.waitInbound(n)
+				if _, werr := link.conn.Write(data[:n]); werr != nil {
+					err = werr
+				}
+			}
+
+			mPool.Put(data)
+			if err != nil {
+				break
+			}
+		}
+	}()
+	wg.Wait()
+	_ = link.conn.Close()
+	log.Debugf("link(%d) close", link.ID)
+}
@@ -0,0 +1,33 @@
+package hub
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStreamHeader(t *testing.T) {
+	for _, target := range []string{"", "mysql-dev"} {
+		var buf bytes.Buffer
+		if err := WriteStreamHeader(&buf, 0x12345678, target); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("data")
+
+		id, got, err := ReadStreamHeader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id != 0x12345678 || got != target {
+			t.Fatalf("expect link(%d) %q, got link(%d) %q", 0x12345678, target, id, got)
+		}
+
+		if buf.String() != "data" {
+			t.Fatalf("header should not consume data, left %q", buf.String())
+		}
+	}
+
+	if _, _, err := ReadStreamHeader(bytes.NewReader([]byte{StreamTunnel, 0, 0, 0, 0, 0, 0})); err == nil {
+		t.Fatal("tunnel stream should not be accepted as link stream")
+	}
+}
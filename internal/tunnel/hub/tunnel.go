@@ -7,29 +7,72 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
 )
 
 const (
+	// PacketSize v1 帧格式中数据包最大长度，也是缓冲池中最小一级缓冲区的大小
 	PacketSize = 8192
+	// LargePacketSize v2 帧格式中 link 每次读取的最大数据量
+	LargePacketSize = 64 * 1024
+	// MaxPacketSize v2 帧格式中允许的数据包最大长度
+	MaxPacketSize = 256 * 1024
+
+	headerSize     = 4
+	wideHeaderSize = 8
+	maxFrameSize   = headerSize + PacketSize
+
+	// compressedFlag 帧头中 Len 的最高位，表示数据包已压缩
+	compressedFlag     = 1 << 15
+	wideCompressedFlag = 1 << 31
+
+	// writeBufferSize 写缓冲区大小，写 goroutine 在缓冲区满或发送队列为空时 flush
+	writeBufferSize = PacketSize * 8
 )
 
 var ErrTooLarge = fmt.Errorf("tunnel.Read: packet too large")
+var ErrInvalidFrame = fmt.Errorf("tunnel.Read: invalid frame")
+var ErrTunnelClosed = fmt.Errorf("tunnel.Write: tunnel closed")
 
-var mPool = newPool(PacketSize)
+var mPool = newSizedPool(PacketSize, LargePacketSize)
 
-// Tunnel packet header
-// a Tunnel packet consists of a header and a body
-// Len is the length of subsequent packet body
-type header struct {
-	LinkID uint16
-	Len    uint16
+// packet 发送队列中等待写入的数据包
+type packet struct {
+	linkID uint32
+	owner  uint32 // link 控制命令所属的 link，命令与该 link 的数据在同一队列中按顺序发送
+	data   []byte
+}
+
+// queue 数据包所在的发送队列，为 0 时是隧道级别的控制命令，优先发送
+func (p packet) queue() uint32 {
+	if p.linkID != 0 {
+		return p.linkID
+	}
+	return p.owner
 }
 
 type Tunnel struct {
 	*Connection
 
-	lock sync.Mutex // protect concurrent write
-	err  error      // write error
+	lock   sync.Mutex // protect concurrent write
+	err    error      // write error
+	frame  []byte     // AEAD 模式下待加密的明文帧，只由当前写入方使用
+	header []byte     // 明文模式下待写入的帧头，只由当前写入方使用
+
+	wide    bool // 是否使用 v2 帧格式，握手完成后、启动写 goroutine 前设置
+	rheader [wideHeaderSize]byte
+
+	compression     common.Compression
+	compressor      frameCompressor // 未启用压缩时为 nil，握手完成后、启动写 goroutine 前设置
+	cbuf            []byte          // 压缩缓冲区，只由当前写入方使用
+	rawBytes        int64
+	compressedBytes int64
+
+	sched     *scheduler // 发送队列，启动写 goroutine 后所有数据包都经由调度器发送
+	writing   bool       // 是否已启动写 goroutine
+	closeOnce sync.Once
 }
 
 func NewTunnel(conn net.Conn) *Tunnel {
@@ -37,65 +80,369 @@ func NewTunnel(conn net.Conn) *Tunnel {
 	tun.Connection = newConnection(
 		conn,
 		bufio.NewReaderSize(conn, PacketSize*2),
-		bufio.NewWriterSize(conn, PacketSize*2),
+		bufio.NewWriterSize(conn, writeBufferSize),
 		nil,
 		nil,
 	)
+	tun.sched = newScheduler()
 	return &tun
 }
 
-// WritePacket can write concurrently
-func (tun *Tunnel) WritePacket(linkID uint16, data []byte) (err error) {
+// EnableWideFrames 启用 v2 帧格式：32 位 link ID 和 32 位长度，单个数据包可以超过 64KB
+// 必须在握手完成后、创建 Hub 之前调用
+func (tun *Tunnel) EnableWideFrames() {
+	tun.wide = true
+}
+
+// SetCompression 启用数据帧压缩，必须在握手完成后、创建 Hub 之前调用
+func (tun *Tunnel) SetCompression(c common.Compression) error {
+	compressor, err := newFrameCompressor(c)
+	if err != nil {
+		return err
+	}
+
+	tun.compression, tun.compressor = c, compressor
+	return nil
+}
+
+// CompressionStats 压缩统计信息
+func (tun *Tunnel) CompressionStats() CompressionStats {
+	return CompressionStats{
+		Compression:     tun.compression,
+		RawBytes:        atomic.LoadInt64(&tun.rawBytes),
+		CompressedBytes: atomic.LoadInt64(&tun.compressedBytes),
+	}
+}
+
+// MaxLinkID 当前帧格式支持的最大 link ID
+func (tun *Tunnel) MaxLinkID() uint32 {
+	if tun.wide {
+		return ^uint32(0)
+	}
+	return uint32(^uint16(0))
+}
+
+// PacketSize link 每次读取的最大数据量
+func (tun *Tunnel) PacketSize() int {
+	if tun.wide {
+		return LargePacketSize
+	}
+	return PacketSize
+}
+
+// maxPacketSize 当前帧格式允许的数据包最大长度
+func (tun *Tunnel) maxPacketSize() int {
+	if tun.wide {
+		return MaxPacketSize
+	}
+	return PacketSize
+}
+
+func (tun *Tunnel) headerSize() int {
+	if tun.wide {
+		return wideHeaderSize
+	}
+	return headerSize
+}
+
+// appendHeader 追加帧头
+// v1 帧头为 LinkID uint16 | Len uint16，v2 帧头为 LinkID uint32 | Len uint32，Len 为后续数据包长度
+// Len 的最高位表示数据包已压缩，只在启用压缩后使用
+func (tun *Tunnel) appendHeader(dst []byte, linkID uint32, size int, compressed bool) []byte {
+	if tun.wide {
+		n := uint32(size)
+		if compressed {
+			n |= wideCompressedFlag
+		}
+
+		dst = binary.LittleEndian.AppendUint32(dst, linkID)
+		return binary.LittleEndian.AppendUint32(dst, n)
+	}
+
+	n := uint16(size)
+	if compressed {
+		n |= compressedFlag
+	}
+
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(linkID))
+	return binary.LittleEndian.AppendUint16(dst, n)
+}
+
+// parseHeader 解析帧头
+func (tun *Tunnel) parseHeader(src []byte) (linkID uint32, size int, compressed bool) {
+	if tun.wide {
+		n := binary.LittleEndian.Uint32(src[4:])
+		return binary.LittleEndian.Uint32(src[0:]), int(n &^ wideCompressedFlag), n&wideCompressedFlag != 0
+	}
+
+	n := binary.LittleEndian.Uint16(src[2:])
+	return uint32(binary.LittleEndian.Uint16(src[0:])), int(n &^ compressedFlag), n&compressedFlag != 0
+}
+
+// compress 压缩数据包，控制命令、小数据包和压缩后体积没有明显减小的数据包按原样发送
+func (tun *Tunnel) compress(linkID uint32, data []byte) ([]byte, bool) {
+	if tun.compressor == nil || linkID == 0 || len(data) < minCompressSize {
+		return data, false
+	}
+
+	tun.cbuf = tun.compressor.compress(tun.cbuf, data)
+	atomic.AddInt64(&tun.rawBytes, int64(len(data)))
+
+	if len(tun.cbuf) >= len(data)-len(data)/16 {
+		atomic.AddInt64(&tun.compressedBytes, int64(len(data)))
+		return data, false
+	}
+
+	atomic.AddInt64(&tun.compressedBytes, int64(len(tun.cbuf)))
+	return tun.cbuf, true
+}
+
+// decompress 解压数据包，释放压缩数据所在的缓冲区
+func (tun *Tunnel) decompress(data []byte) ([]byte, error) {
 	defer mPool.Put(data)
 
+	if tun.compressor == nil {
+		return nil, ErrInvalidFrame
+	}
+
+	size, err := tun.compressor.decodedLen(data)
+	if err != nil {
+		return nil, ErrInvalidFrame
+	}
+
+	if size > tun.maxPacketSize() {
+		return nil, ErrTooLarge
+	}
+
+	buf := mPool.GetSize(size)
+	out, err := tun.compressor.decompress(buf, data)
+	if err != nil || len(out) != size {
+		mPool.Put(buf)
+		return nil, ErrInvalidFrame
+	}
+
+	atomic.AddInt64(&tun.rawBytes, int64(size))
+	atomic.AddInt64(&tun.compressedBytes, int64(len(data)))
+	return out, nil
+}
+
+// startWriter 启动写 goroutine，此后 WritePacket 只将数据包放入发送队列，由写 goroutine 按调度顺序合并写入
+// 握手阶段需要在切换加密方式前确保数据已经发送，因此必须在握手完成后才能调用
+func (tun *Tunnel) startWriter() {
 	tun.lock.Lock()
 	defer tun.lock.Unlock()
 
-	if tun.err != nil {
-		return tun.err
+	if tun.writing {
+		return
 	}
 
-	if err = binary.Write(tun, binary.LittleEndian, header{linkID, uint16(len(data))}); err != nil {
-		tun.err = err
-		_ = tun.Close()
-		return err
+	tun.writing = true
+	go tun.writeLoop()
+}
+
+// setLinkPriority 设置 link 在发送队列中的优先级
+func (tun *Tunnel) setLinkPriority(linkID uint32, p Priority) {
+	tun.sched.setPriority(linkID, p)
+}
+
+// WritePacket can write concurrently
+// 写 goroutine 启动前同步写入并 flush，启动后放入发送队列，写入失败的错误在后续调用中返回
+func (tun *Tunnel) WritePacket(linkID uint32, data []byte) error {
+	return tun.write(packet{linkID: linkID, data: data})
+}
+
+// writeLinkCommand 写入 link 相关的控制命令，命令在该 link 已经放入发送队列的数据之后发送
+func (tun *Tunnel) writeLinkCommand(linkID uint32, data []byte) error {
+	return tun.write(packet{owner: linkID, data: data})
+}
+
+// resetLink 丢弃 link 尚未发送的数据，重置 link 的控制命令放入控制队列，不会因为 link 的发送队列已满而阻塞
+func (tun *Tunnel) resetLink(linkID uint32, data []byte) error {
+	for _, p := range tun.sched.drop(linkID) {
+		mPool.Put(p.data)
 	}
 
-	if _, err = tun.Write(data); err != nil {
-		tun.err = err
-		_ = tun.Close()
+	return tun.write(packet{data: data})
+}
+
+func (tun *Tunnel) write(p packet) (err error) {
+	linkID, data := p.linkID, p.data
+	if linkID > tun.MaxLinkID() || p.owner > tun.MaxLinkID() || len(data) > tun.maxPacketSize() {
+		mPool.Put(data)
+		return ErrInvalidFrame
+	}
+
+	tun.lock.Lock()
+	if !tun.writing {
+		defer tun.lock.Unlock()
+		defer mPool.Put(data)
+
+		if err = tun.writePacket(linkID, data); err == nil {
+			err = tun.Flush()
+		}
+
+		return tun.setError(err)
+	}
+
+	err = tun.err
+	tun.lock.Unlock()
+
+	if err != nil {
+		mPool.Put(data)
 		return err
 	}
 
-	if err = tun.Flush(); err != nil {
+	// 发送队列满时只阻塞当前 link，隧道关闭时返回
+	if !tun.sched.push(p) {
+		mPool.Put(data)
+		return tun.writeError()
+	}
+
+	return nil
+}
+
+// writeLoop 写 goroutine，依次写入调度器给出的数据包，没有待发送的数据包时才 flush
+func (tun *Tunnel) writeLoop() {
+	for {
+		p, ok := tun.sched.pop(true)
+		if !ok {
+			return
+		}
+
+		err := tun.writeQueued(p)
+		for err == nil {
+			if p, ok = tun.sched.pop(false); !ok {
+				break
+			}
+			err = tun.writeQueued(p)
+		}
+
+		if err == nil {
+			err = tun.Flush()
+		}
+
+		if err != nil {
+			tun.lock.Lock()
+			_ = tun.setError(err)
+			tun.lock.Unlock()
+			return
+		}
+	}
+}
+
+func (tun *Tunnel) writeQueued(p packet) error {
+	defer mPool.Put(p.data)
+	return tun.writePacket(p.linkID, p.data)
+}
+
+func (tun *Tunnel) writePacket(linkID uint32, data []byte) error {
+	data, compressed := tun.compress(linkID, data)
+	if tun.sealed() {
+		return tun.writeSealedPacket(linkID, data, compressed)
+	}
+	return tun.writePlainPacket(linkID, data, compressed)
+}
+
+// setError 记录写入错误并关闭隧道，调用方需持有 lock
+func (tun *Tunnel) setError(err error) error {
+	if err != nil && tun.err == nil {
 		tun.err = err
 		_ = tun.Close()
+	}
+	return err
+}
+
+func (tun *Tunnel) writeError() error {
+	tun.lock.Lock()
+	defer tun.lock.Unlock()
+
+	if tun.err != nil {
+		return tun.err
+	}
+	return ErrTunnelClosed
+}
+
+func (tun *Tunnel) writePlainPacket(linkID uint32, data []byte, compressed bool) error {
+	tun.header = tun.appendHeader(tun.header[:0], linkID, len(data), compressed)
+	if _, err := tun.Write(tun.header); err != nil {
 		return err
 	}
-	return
+
+	_, err := tun.Write(data)
+	return err
+}
+
+func (tun *Tunnel) writeSealedPacket(linkID uint32, data []byte, compressed bool) error {
+	tun.frame = tun.appendHeader(tun.frame[:0], linkID, len(data), compressed)
+	tun.frame = append(tun.frame, data...)
+
+	return tun.writeSealed(tun.frame)
 }
 
 // ReadPacket can't read concurrently
-func (tun *Tunnel) ReadPacket() (linkID uint16, data []byte, err error) {
-	var h header
+func (tun *Tunnel) ReadPacket() (linkID uint32, data []byte, err error) {
+	if tun.sealed() {
+		return tun.readSealedPacket()
+	}
 
-	if err = binary.Read(tun, binary.LittleEndian, &h); err != nil {
+	h := tun.rheader[:tun.headerSize()]
+	if _, err = io.ReadFull(tun, h); err != nil {
 		return
 	}
 
-	if h.Len > PacketSize {
+	linkID, size, compressed := tun.parseHeader(h)
+	if size > tun.maxPacketSize() {
 		err = ErrTooLarge
 		return
 	}
 
-	data = mPool.Get()[0:h.Len]
+	data = mPool.GetSize(size)
 	if _, err = io.ReadFull(tun, data); err != nil {
 		return
 	}
-	linkID = h.LinkID
+
+	if compressed {
+		data, err = tun.decompress(data)
+	}
+	return
+}
+
+func (tun *Tunnel) readSealedPacket() (linkID uint32, data []byte, err error) {
+	frame, err := tun.readSealed(tun.headerSize() + tun.maxPacketSize())
+	if err != nil {
+		return
+	}
+
+	if len(frame) < tun.headerSize() {
+		err = ErrInvalidFrame
+		return
+	}
+
+	linkID, size, compressed := tun.parseHeader(frame)
+	if size != len(frame)-tun.headerSize() {
+		err = ErrInvalidFrame
+		return
+	}
+
+	data = mPool.GetSize(size)
+	copy(data, frame[tun.headerSize():])
+
+	if compressed {
+		data, err = tun.decompress(data)
+	}
 	return
 }
 
+// Close 关闭隧道，同时停止写 goroutine，丢弃尚未发送的数据包
+func (tun *Tunnel) Close() error {
+	tun.closeOnce.Do(func() {
+		for _, p := range tun.sched.close() {
+			mPool.Put(p.data)
+		}
+	})
+	return tun.Connection.Close()
+}
+
 func (tun *Tunnel) String() string {
 	return fmt.Sprintf("tunnel[%s -> %s]", tun.Conn.LocalAddr(), tun.Conn.RemoteAddr())
 }
@@ -0,0 +1,264 @@
+package hub
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+)
+
+// newTunnelPair 创建基于本地 TCP 连接的一对隧道
+func newTunnelPair(tb testing.TB) (*Tunnel, *Tunnel) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	peer := <-accepted
+	if peer == nil {
+		tb.Fatal("accept failed")
+	}
+
+	local, remote := NewTunnel(conn), NewTunnel(peer)
+	tb.Cleanup(func() {
+		_ = local.Close()
+		_ = remote.Close()
+	})
+
+	return local, remote
+}
+
+func TestTunnelQueuedWrite(t *testing.T) {
+	local, remote := newTunnelPair(t)
+	local.startWriter()
+
+	for i := 1; i <= 100; i++ {
+		data := mPool.Get()[:i]
+		for j := range data {
+			data[j] = byte(i)
+		}
+
+		if err := local.WritePacket(uint32(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 1; i <= 100; i++ {
+		id, data, err := remote.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if int(id) != i || len(data) != i || data[0] != byte(i) {
+			t.Fatalf("unexpected packet %d: id=%d, len=%d", i, id, len(data))
+		}
+		mPool.Put(data)
+	}
+
+	_ = local.Close()
+	if err := local.WritePacket(1, mPool.Get()[:1]); err == nil {
+		t.Fatal("write to closed tunnel should fail")
+	}
+}
+
+// BenchmarkTunnelThroughput 多个 link 并发写入时的吞吐量，sync 为每个数据包 flush 一次的同步写入
+func BenchmarkTunnelThroughput(b *testing.B) {
+	for _, size := range []int{512, PacketSize} {
+		for _, queued := range []bool{false, true} {
+			benchmarkThroughput(b, size, queued)
+		}
+	}
+}
+
+func benchmarkThroughput(b *testing.B, size int, queued bool) {
+	name := fmt.Sprintf("sync/%d", size)
+	if queued {
+		name = fmt.Sprintf("queued/%d", size)
+	}
+
+	b.Run(name, func(b *testing.B) {
+		local, remote := newTunnelPair(b)
+		if queued {
+			local.startWriter()
+		}
+		go func() { _, _ = io.Copy(io.Discard, remote.Conn) }()
+
+		b.SetBytes(int64(size))
+		b.SetParallelism(8)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := local.WritePacket(1, mPool.Get()[:size]); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkTunnelLatency 单个小数据包从写入到对端读取的往返延迟
+func BenchmarkTunnelLatency(b *testing.B) {
+	for _, queued := range []bool{false, true} {
+		name := "sync"
+		if queued {
+			name = "queued"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			local, remote := newTunnelPair(b)
+			if queued {
+				local.startWriter()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := local.WritePacket(1, mPool.Get()[:64]); err != nil {
+					b.Fatal(err)
+				}
+
+				_, data, err := remote.ReadPacket()
+				if err != nil {
+					b.Fatal(err)
+				}
+				mPool.Put(data)
+			}
+		})
+	}
+}
+
+func TestTunnelWideFrames(t *testing.T) {
+	local, remote := newTunnelPair(t)
+	if err := local.WritePacket(0x10000, mPool.Get()[:1]); err != ErrInvalidFrame {
+		t.Fatalf("link id beyond uint16 should be rejected in v1 frames, got %v", err)
+	}
+
+	local.EnableWideFrames()
+	remote.EnableWideFrames()
+	local.startWriter()
+
+	data := mPool.GetSize(MaxPacketSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	if err := local.WritePacket(0x10000, data); err != nil {
+		t.Fatal(err)
+	}
+
+	id, got, err := remote.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != 0x10000 || len(got) != MaxPacketSize || got[MaxPacketSize-1] != byte((MaxPacketSize-1)%256) {
+		t.Fatalf("unexpected packet: id=%d, len=%d", id, len(got))
+	}
+
+	if err := local.WritePacket(1, mPool.GetSize(MaxPacketSize+1)); err != ErrInvalidFrame {
+		t.Fatalf("packet larger than max packet size should be rejected, got %v", err)
+	}
+}
+
+func TestTunnelCompression(t *testing.T) {
+	for _, c := range []common.Compression{common.CompressionSnappy, common.CompressionZstd} {
+		for _, wide := range []bool{false, true} {
+			local, remote := newTunnelPair(t)
+			if wide {
+				local.EnableWideFrames()
+				remote.EnableWideFrames()
+			}
+
+			if err := local.SetCompression(c); err != nil {
+				t.Fatal(err)
+			}
+			if err := remote.SetCompression(c); err != nil {
+				t.Fatal(err)
+			}
+			local.startWriter()
+
+			compressible := bytes.Repeat([]byte("select * from users where id = 1;"), 200)
+			incompressible := make([]byte, 4096)
+			_, _ = rand.Read(incompressible)
+
+			for _, payload := range [][]byte{compressible, incompressible} {
+				data := mPool.GetSize(len(payload))
+				copy(data, payload)
+				if err := local.WritePacket(1, data); err != nil {
+					t.Fatal(err)
+				}
+
+				_, got, err := remote.ReadPacket()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(got, payload) {
+					t.Fatalf("%s: payload mismatch", c)
+				}
+			}
+
+			stats := local.CompressionStats()
+			if stats.Compression != c || stats.RawBytes != int64(len(compressible)+len(incompressible)) {
+				t.Fatalf("%s: unexpected stats %+v", c, stats)
+			}
+
+			// 不可压缩的数据包按原样发送
+			if stats.CompressedBytes < int64(len(incompressible)) || stats.Ratio() <= 1 {
+				t.Fatalf("%s: unexpected stats %+v", c, stats)
+			}
+		}
+	}
+}
+
+func TestTunnelSealedWideFrames(t *testing.T) {
+	local, remote := newTunnelPair(t)
+
+	key := make([]byte, 32)
+	if err := local.SetFrameCipher(common.CipherAES256GCM, key, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.SetFrameCipher(common.CipherAES256GCM, key, key); err != nil {
+		t.Fatal(err)
+	}
+
+	local.EnableWideFrames()
+	remote.EnableWideFrames()
+	local.startWriter()
+
+	for i := 0; i < 2; i++ {
+		if err := local.WritePacket(1, mPool.GetSize(MaxPacketSize)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, got, err := remote.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != MaxPacketSize {
+			t.Fatalf("unexpected packet size: %d", len(got))
+		}
+	}
+
+	// 扩容后的密文缓冲区需要保留下来，避免每个 v2 大帧都重新分配
+	if cap(local.sbuf) < MaxPacketSize {
+		t.Fatalf("sealed buffer should keep grown capacity, got %d", cap(local.sbuf))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/mylxsw/asteria/log"
 	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/secure-tunnel/internal/auth/oidc"
 	"github.com/mylxsw/secure-tunnel/internal/config"
 	"github.com/mylxsw/secure-tunnel/internal/tunnel/client"
 	"github.com/mylxsw/secure-tunnel/internal/tunnel/server"
@@ -19,13 +20,38 @@ func (p ClientProvider) Daemon(ctx context.Context, app infra.Resolver) {
 	app.MustResolve(func(conf *config.Client, gf infra.Graceful) {
 		version := app.MustGet(infra.VersionKey).(string)
 
+		// 所有客户端共享同一个 OIDC 令牌获取器，只需要在浏览器中登录一次
+		var tokens *oidc.TokenSource
+		if conf.OIDCEnabled() {
+			tokens = oidc.NewTokenSource(*conf.OIDC)
+			if _, err := tokens.IDToken(); err != nil {
+				log.Errorf("oidc sign in failed: %v", err)
+				gf.Shutdown()
+				return
+			}
+		}
+
+		// 多路复用时所有后端共享同一个客户端
+		if conf.Multiplex {
+			clientServer, err := client.NewClient(version, conf.Server, conf.Secret, conf.Backends, conf.Tunnels, conf, tokens)
+			if err != nil {
+				log.Errorf("create client failed: %v", err)
+				return
+			}
+
+			if err := clientServer.Start(ctx, gf); err != nil {
+				log.Errorf("client started failed: %v", err)
+			}
+			return
+		}
+
 		var wg sync.WaitGroup
 		wg.Add(len(conf.Backends))
 		for _, backend := range conf.Backends {
 			go func(backend config.BackendPortMapping) {
 				defer wg.Done()
 
-				clientServer, err := client.NewClient(version, conf.Server, conf.Secret, backend, conf.Tunnels, conf)
+				clientServer, err := client.NewClient(version, conf.Server, conf.Secret, []config.BackendPortMapping{backend}, conf.Tunnels, conf, tokens)
 				if err != nil {
 					log.With(backend).Errorf("create client failed: %v", err)
 					return
@@ -45,7 +71,7 @@ type ServerProvider struct{}
 
 func (p ServerProvider) Register(app infra.Binder) {
 	app.MustSingletonOverride(func(conf *config.Server) (*server.Server, error) {
-		return server.NewServer(conf.Listen, conf.Backends, conf.Secret)
+		return server.NewServer(conf)
 	})
 }
 
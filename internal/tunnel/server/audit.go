@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+)
+
+// 审计事件类型
+const (
+	AuditAccessRequested = "access_requested"
+	AuditAccessApproved  = "access_approved"
+	AuditAccessRejected  = "access_rejected"
+	AuditAccessRevoked   = "access_revoked"
+	AuditAccessExpired   = "access_expired"
+	AuditTunnelClosed    = "tunnel_closed"
+)
+
+// AuditEvent 审计事件
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	RequestID string    `json:"request_id,omitempty"`
+	Account   string    `json:"account,omitempty"` // 申请人
+	Backend   string    `json:"backend,omitempty"`
+	Actor     string    `json:"actor,omitempty"` // 执行操作的用户，由服务端自动执行时为空
+	Reason    string    `json:"reason,omitempty"`
+	Duration  string    `json:"duration,omitempty"`
+}
+
+// auditLog 以 JSON Lines 格式追加写入审计事件，同时输出到日志
+type auditLog struct {
+	path string
+	lock sync.Mutex
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+func (a *auditLog) record(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	log.Module("audit").WithFields(log.Fields{
+		"request_id": event.RequestID,
+		"account":    event.Account,
+		"backend":    event.Backend,
+		"actor":      event.Actor,
+		"reason":     event.Reason,
+		"duration":   event.Duration,
+	}).Infof("audit: %s", event.Event)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("encode audit event failed: %v", err)
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Errorf("open audit log %s failed: %v", a.path, err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Errorf("write audit log %s failed: %v", a.path, err)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+)
+
+// drainCheckInterval 排空隧道时检查 link 是否全部结束的间隔
+const drainCheckInterval = 500 * time.Millisecond
+
+// Drain 通知所有客户端隧道即将关闭，客户端不再创建新的 link 并建立新的隧道替代，已有的 link 继续传输。
+// 隧道上的 link 全部结束后关闭隧道，超过 timeout 时强制关闭剩余的隧道。排空期间不再接受新的隧道连接
+func (s *Server) Drain(timeout time.Duration) {
+	s.drainOnce.Do(func() {
+		close(s.draining)
+
+		hubs := s.hubs()
+		log.Infof("draining %d tunnels, timeout %s", len(hubs), timeout)
+		for _, h := range hubs {
+			h.SendGoAway()
+		}
+
+		deadline := time.Now().Add(timeout)
+		ticker := time.NewTicker(drainCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			remaining := 0
+			for _, h := range s.hubs() {
+				if h.LinkCount() == 0 {
+					h.Close()
+					continue
+				}
+				remaining++
+			}
+
+			if remaining == 0 {
+				log.Infof("all tunnels drained")
+				return
+			}
+
+			if time.Now().After(deadline) {
+				log.Warningf("drain timeout, close %d tunnels with active links", remaining)
+				for _, h := range s.hubs() {
+					h.Close()
+				}
+				return
+			}
+		}
+	})
+}
+
+func (s *Server) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// hubs 当前所有已完成握手的隧道
+func (s *Server) hubs() []*Hub {
+	s.connectionsLock.RLock()
+	defer s.connectionsLock.RUnlock()
+
+	hubs := make([]*Hub, 0, len(s.connections))
+	for _, conn := range s.connections {
+		hubs = append(hubs, conn.hub)
+	}
+
+	return hubs
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+)
+
+// addTestConn 将隧道登记到服务端的连接列表中
+func addTestConn(s *Server, id string, h *testHub) {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+
+	s.connections[id] = &connInfo{id: id, user: h.authedUser, hub: h.Hub}
+}
+
+func TestServerDrain(t *testing.T) {
+	user := &auth.AuthedUser{Account: "alice"}
+	backend := newTestBackend(t, config.BackendServer{Name: "echo"})
+	timeouts := hubTimeouts{heartbeat: time.Minute}
+
+	t.Run("finish in-flight links", func(t *testing.T) {
+		s := &Server{connections: make(map[string]*connInfo), draining: make(chan struct{})}
+
+		h, c := newTestHub(t, user, nil, backend.Backend, common.CapGoAway, timeouts)
+		addTestConn(s, "c1", h)
+
+		conn := c.openLink(t, 1, "")
+		echo(t, conn, "before")
+
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			s.Drain(10 * time.Second)
+		}()
+
+		c.waitCommand(t, hub.TunGoAway, 0, time.Second)
+		if !s.isDraining() {
+			t.Fatal("server should be draining")
+		}
+
+		// 已有的 link 在排空期间继续传输
+		time.Sleep(2 * drainCheckInterval)
+		echo(t, conn, "during")
+		if closed(h.done) || closed(drained) {
+			t.Fatal("hub with in-flight link should not be closed")
+		}
+
+		_ = conn.Close()
+		waitFor(t, 3*time.Second, func() bool { return closed(h.done) }, "drained hub closed")
+		waitFor(t, 2*time.Second, func() bool { return closed(drained) }, "drain finished")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		s := &Server{connections: make(map[string]*connInfo), draining: make(chan struct{})}
+
+		h, c := newTestHub(t, user, nil, backend.Backend, common.CapGoAway, timeouts)
+		addTestConn(s, "c1", h)
+
+		conn := c.openLink(t, 1, "")
+		echo(t, conn, "hello")
+
+		start := time.Now()
+		s.Drain(time.Second)
+
+		if !closed(h.done) {
+			waitFor(t, time.Second, func() bool { return closed(h.done) }, "hub closed after drain timeout")
+		}
+
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Fatalf("hub with active link should be closed after drain timeout, closed in %s", elapsed)
+		}
+	})
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+)
+
+// handshakeResult 握手结果
+type handshakeResult struct {
+	client       *common.SystemInfo
+	user         *auth.AuthedUser
+	remote       string
+	backend      *Backend // 多路复用的隧道为 nil
+	version      uint16
+	capabilities common.Capability
+	compression  common.Compression
+}
+
+// access 隧道的访问上下文
+func (result *handshakeResult) access() accessContext {
+	return accessContext{user: result.user, client: result.client, remote: result.remote}
+}
+
+// negotiateSession 完成临时密钥交换并协商隧道加密算法，旧版本客户端不提供密钥交换信息，只能使用 RC4
+// 客户端握手消息格式：token | 客户端随机数 | 客户端临时公钥 | 加密算法列表 | 签名
+// 服务端响应格式：选择的加密算法 | 服务端临时公钥 | 服务端身份公钥 | 服务端身份签名 | 签名
+func (s *Server) negotiateSession(tun *hub.Tunnel, a *common.EncryptAlgorithm, challenge []byte, hello []byte) (legacy bool, err error) {
+	if len(hello) == common.TaaBlockSize {
+		if !common.ContainsCipherSuite(s.ciphers, common.CipherRC4) {
+			return true, fmt.Errorf("legacy rc4 cipher is disabled")
+		}
+
+		if err := s.replays.Add(string(hello)); err != nil {
+			return true, fmt.Errorf("check token failed: %v", err)
+		}
+
+		tun.SetCipherKey(a.GetRc4key())
+		return true, nil
+	}
+
+	if len(hello) < common.TaaBlockSize+common.ClientNonceSize+common.KeyExchangeSize+common.HandshakeMacSize {
+		return false, fmt.Errorf("invalid client hello")
+	}
+
+	sign := hello[len(hello)-common.HandshakeMacSize:]
+	hello = hello[:len(hello)-common.HandshakeMacSize]
+
+	a.Transcript(challenge, hello)
+	if !a.VerifyTranscript(sign) {
+		return false, fmt.Errorf("verify client hello signature failed")
+	}
+
+	nonce := hello[common.TaaBlockSize : common.TaaBlockSize+common.ClientNonceSize]
+	if err := s.replays.Add(string(nonce)); err != nil {
+		return false, fmt.Errorf("check client nonce failed: %v", err)
+	}
+
+	clientPublic := hello[common.TaaBlockSize+common.ClientNonceSize : common.TaaBlockSize+common.ClientNonceSize+common.KeyExchangeSize]
+	offered := hello[common.TaaBlockSize+common.ClientNonceSize+common.KeyExchangeSize:]
+
+	suite, ok := common.NegotiateCipherSuite(offered, s.ciphers)
+	if !ok {
+		herr := common.NewHandshakeError(common.ErrCodeNoCommonCipher, "no supported cipher", map[string]string{
+			"supported": strings.Join(common.CipherSuiteNames(s.ciphers), ","),
+		})
+		_ = tun.WritePacket(0, common.EncodeMessage(common.MsgHandshakeError, herr))
+		return false, fmt.Errorf("no supported cipher in %v", offered)
+	}
+
+	if err := a.GenerateKeyPair(); err != nil {
+		return false, err
+	}
+
+	if err := a.ExchangeKey(clientPublic); err != nil {
+		return false, err
+	}
+
+	reply := append([]byte{byte(suite)}, a.PublicKey()...)
+	reply = append(reply, s.hostKey.Public().(ed25519.PublicKey)...)
+	a.Transcript(reply)
+
+	hostSign := a.SignTranscriptWithHostKey(s.hostKey)
+	a.Transcript(hostSign)
+
+	reply = append(reply, hostSign...)
+	if err := tun.WritePacket(0, append(reply, a.SignTranscript()...)); err != nil {
+		return false, err
+	}
+
+	clientKey, serverKey := a.SessionKeys(suite)
+	return false, tun.SetFrameCipher(suite, serverKey, clientKey)
+}
+
+// handshake 使用结构化的握手消息完成版本协商和身份认证，binding 为 QUIC 连接的通道绑定值，其他传输方式为 nil
+// remote 为客户端地址，用于执行访问策略
+func (s *Server) handshake(tun *hub.Tunnel, author auth.Author, clientCert *x509.Certificate, binding []byte, remote string) (*handshakeResult, error) {
+	_, data, err := tun.ReadPacket()
+	if err != nil {
+		return nil, fmt.Errorf("read client hello failed: %v", err)
+	}
+
+	var hello common.ClientHello
+	if err := common.DecodeMessage(data, common.MsgClientHello, &hello); err != nil {
+		return nil, s.replyError(tun, common.MsgServerHello, &common.ServerHello{}, err)
+	}
+
+	version, ok := common.NegotiateVersion(hello.Version)
+	if !ok {
+		return nil, s.replyError(tun, common.MsgServerHello, &common.ServerHello{}, common.NewHandshakeError(
+			common.ErrCodeUnsupportedVersion,
+			fmt.Sprintf("protocol version %d is not supported", hello.Version),
+			map[string]string{"min_version": fmt.Sprintf("%d", common.MinProtocolVersion), "max_version": fmt.Sprintf("%d", common.ProtocolVersion)},
+		))
+	}
+
+	result := &handshakeResult{
+		client:       &hello.Client,
+		remote:       remote,
+		version:      version,
+		capabilities: hello.Capabilities & common.SupportedCapabilities,
+	}
+
+	if err := tun.WritePacket(0, common.EncodeMessage(common.MsgServerHello, common.ServerHello{
+		Version:      result.version,
+		Capabilities: result.capabilities,
+	})); err != nil {
+		return nil, fmt.Errorf("write server hello failed: %v", err)
+	}
+
+	// 客户端身份认证
+	_, data, err = tun.ReadPacket()
+	if err != nil {
+		return nil, fmt.Errorf("read auth request failed: %v", err)
+	}
+
+	var req common.AuthRequest
+	if err := common.DecodeMessage(data, common.MsgAuthRequest, &req); err != nil {
+		return nil, s.replyError(tun, common.MsgAuthResponse, &common.AuthResponse{}, err)
+	}
+
+	// 通道绑定值不一致说明 QUIC 连接被中间人劫持，link 数据流不能使用该连接
+	if binding != nil && !hmac.Equal(req.ChannelBinding, binding) {
+		return nil, s.replyError(tun, common.MsgAuthResponse, &common.AuthResponse{}, common.NewHandshakeError(
+			common.ErrCodeChannelBinding,
+			"quic channel binding mismatch",
+			nil,
+		))
+	}
+
+	if result.user, err = s.login(author, clientCert, req.Username, req.Password); err != nil {
+		return nil, s.replyError(tun, common.MsgAuthResponse, &common.AuthResponse{}, common.NewHandshakeError(
+			common.ErrCodeAuthFailed,
+			err.Error(),
+			map[string]string{"username": req.Username},
+		))
+	}
+
+	// 多路复用的隧道不绑定后端，只使用所有后端都允许的压缩算法
+	compressions := s.compressions
+	if req.Backend != "" || !result.capabilities.Has(common.CapMultiplex) {
+		if result.backend, ok = s.backends[req.Backend]; !ok {
+			return nil, s.replyError(tun, common.MsgAuthResponse, &common.AuthResponse{}, common.NewHandshakeError(
+				common.ErrCodeUnknownBackend,
+				fmt.Sprintf("backend %s not found", req.Backend),
+				map[string]string{"backend": req.Backend},
+			))
+		}
+
+		if access := s.authorize(result.access(), result.backend); !access.Allowed {
+			return nil, s.replyError(tun, common.MsgAuthResponse, &common.AuthResponse{}, common.NewHandshakeError(
+				common.ErrCodeAccessDenied,
+				access.Reason,
+				map[string]string{"backend": req.Backend, "username": result.user.Account},
+			))
+		}
+
+		compressions = result.backend.Compressions
+	}
+
+	resp := common.AuthResponse{Account: result.user.Account, ChannelBinding: binding}
+	if result.backend == nil {
+		resp.Backends = s.allowedBackends(result.user)
+	}
+	if result.compression = common.NegotiateCompression(req.Compressions, compressions); result.compression != common.CompressionNone {
+		resp.Compression = result.compression.String()
+	}
+
+	if err := tun.WritePacket(0, common.EncodeMessage(common.MsgAuthResponse, resp)); err != nil {
+		return nil, fmt.Errorf("write auth response failed: %v", err)
+	}
+
+	return result, nil
+}
+
+// replyError 向客户端返回握手错误，msg 为带有 Error 字段的响应消息
+func (s *Server) replyError(tun *hub.Tunnel, typ common.MessageType, msg interface{}, err error) error {
+	herr, ok := err.(*common.HandshakeError)
+	if !ok {
+		herr = common.NewHandshakeError(common.ErrCodeInternal, err.Error(), nil)
+	}
+
+	switch m := msg.(type) {
+	case *common.ServerHello:
+		m.Error = herr
+	case *common.AuthResponse:
+		m.Error = herr
+	}
+
+	_ = tun.WritePacket(0, common.EncodeMessage(typ, msg))
+	return herr
+}
+
+// legacyHandshake 兼容旧版本客户端的握手流程，使用 "ok" 和 "error: ..." 字符串作为响应
+func (s *Server) legacyHandshake(tun *hub.Tunnel, author auth.Author, clientCert *x509.Certificate, remote string) (*handshakeResult, error) {
+	_, clientInfoPacket, err := tun.ReadPacket()
+	if err != nil {
+		_ = tun.WritePacket(0, []byte(fmt.Sprintf("error: read client info failed: %v", err)))
+		return nil, fmt.Errorf("read client info failed: %v", err)
+	}
+
+	if err := tun.WritePacket(0, []byte("ok")); err != nil {
+		return nil, fmt.Errorf("write client info exchange response packet to client failed: %v", err)
+	}
+
+	// 客户端身份认证
+	_, authPacket, err := tun.ReadPacket()
+	if err != nil {
+		return nil, fmt.Errorf("read username & password failed: %v", err)
+	}
+
+	username, password, backend, err := common.ParseAuthPacket(authPacket)
+	if err != nil {
+		_ = tun.WritePacket(0, []byte(fmt.Sprintf("error: %v", err)))
+		return nil, err
+	}
+
+	authedUser, err := s.login(author, clientCert, username, password)
+	if err != nil {
+		_ = tun.WritePacket(0, []byte(fmt.Sprintf("error: invalid password for user %s: %v", username, err)))
+		return nil, fmt.Errorf("login failed for user %s: %v", username, err)
+	}
+
+	bak, ok := s.backends[backend]
+	if !ok {
+		_ = tun.WritePacket(0, []byte(fmt.Sprintf("error: backend %s not found", backend)))
+		return nil, fmt.Errorf("backend %s not found", backend)
+	}
+
+	result := &handshakeResult{
+		client:  common.DecodeSystemInfo(clientInfoPacket),
+		user:    authedUser,
+		remote:  remote,
+		backend: bak,
+	}
+
+	if access := s.authorize(result.access(), bak); !access.Allowed {
+		_ = tun.WritePacket(0, []byte(fmt.Sprintf("error: access to backend %s denied: %s", backend, access.Reason)))
+		return nil, fmt.Errorf("access to backend %s denied: %s", backend, access.Reason)
+	}
+
+	if err := tun.WritePacket(0, []byte("ok")); err != nil {
+		return nil, fmt.Errorf("write authed packet to client failed: %v", err)
+	}
+
+	return result, nil
+}
+
+// login 客户端身份认证，启用证书认证时使用客户端证书中的身份，否则使用账号密码
+func (s *Server) login(author auth.Author, clientCert *x509.Certificate, username, password string) (*auth.AuthedUser, error) {
+	if s.tlsConf.CertAuth && clientCert != nil {
+		authedUser, err := certLogin(author, clientCert, s.tlsConf)
+		if err != nil {
+			return nil, err
+		}
+
+		if username != "" && username != authedUser.Account {
+			return nil, fmt.Errorf("username does not match client certificate %s", authedUser.Account)
+		}
+
+		return authedUser, nil
+	}
+
+	return author.Login(username, password)
+}
@@ -6,61 +6,278 @@ import (
 	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
 	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// hubWatchInterval 检查隧道超时以及发送 TunPing 的间隔，与客户端的心跳间隔一致
+const hubWatchInterval = time.Second
+
 type Hub struct {
 	*hub.Hub
-	backend    *Backend
+	backends   map[string]*Backend
+	backend    *Backend // 隧道绑定的后端，多路复用的隧道为 nil，由每个 link 单独指定
 	authedUser *auth.AuthedUser
+	authorize  func(backend *Backend) AccessResult // 检查隧道的用户是否可以访问后端
+
+	linkBackendsLock sync.RWMutex
+	linkBackends     map[uint32]*Backend
+
+	timeouts      hubTimeouts
+	probe         bool  // 客户端支持回应 TunPing，可以测量往返时间
+	goAway        bool  // 客户端支持 TunGoAway
+	lastHeartbeat int64 // 最后一次收到客户端心跳的时间，UnixNano
+	rtt           int64 // 最近一次测量的往返时间，未测量时为 0
+	pingSeq       uint32
+	pingSentAt    int64 // 最近一次发送 TunPing 的时间，UnixNano
+
+	limits    *rateLimits
+	throttled int64 // link 因限速等待的累计时间，纳秒
+}
+
+// hubTimeouts 服务端判断隧道失效的超时时间
+type hubTimeouts struct {
+	heartbeat time.Duration // 未收到心跳的最长时间
+	idle      time.Duration // 没有 link 时的最长空闲时间，为 0 时不限制
 }
 
-func newHub(tunnel *hub.Tunnel, backend *Backend, authedUser *auth.AuthedUser) *Hub {
+func newHub(tunnel *hub.Tunnel, backends map[string]*Backend, backend *Backend, authedUser *auth.AuthedUser, capabilities common.Capability, timeouts hubTimeouts, limits *rateLimits) *Hub {
 	h := &Hub{
-		Hub:        hub.NewHub(tunnel),
-		backend:    backend,
-		authedUser: authedUser,
+		Hub:           hub.NewHub(tunnel),
+		backends:      backends,
+		backend:       backend,
+		authedUser:    authedUser,
+		linkBackends:  make(map[uint32]*Backend),
+		timeouts:      timeouts,
+		probe:         capabilities.Has(common.CapHeartbeatProbe),
+		goAway:        capabilities.Has(common.CapGoAway),
+		lastHeartbeat: time.Now().UnixNano(),
+		limits:        limits,
+	}
+	if capabilities.Has(common.CapFlowControl) {
+		h.Hub.EnableFlowControl()
 	}
 	h.Hub.OnCtrlFilter = h.onCtrlFilter
-	h.Hub.OnDataFilter = h.buildDataFilter(backend, authedUser)
+	h.Hub.OnDataFilter = h.buildDataFilter(authedUser)
 	return h
 }
 
-func (h *Hub) handleLink(l *hub.Link) {
+// resolveBackend 查找 link 的目标后端，绑定了后端的隧道只能连接到该后端
+func (h *Hub) resolveBackend(target string) (*Backend, bool) {
+	if h.backend != nil {
+		return h.backend, target == "" || target == h.backend.Backend.Name
+	}
+
+	backend, ok := h.backends[target]
+	return backend, ok
+}
+
+// usesBackend 隧道是否绑定了该后端，或者隧道中是否有连接到该后端的 link
+func (h *Hub) usesBackend(name string) bool {
+	if h.backend != nil {
+		return h.backend.Backend.Name == name
+	}
+
+	h.linkBackendsLock.RLock()
+	defer h.linkBackendsLock.RUnlock()
+
+	for _, backend := range h.linkBackends {
+		if backend.Backend.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *Hub) linkBackend(id uint32) *Backend {
+	h.linkBackendsLock.RLock()
+	defer h.linkBackendsLock.RUnlock()
+	return h.linkBackends[id]
+}
+
+// createLink 创建连接到 target 后端的 link，stream 不为空时 link 的数据经由该数据流传输
+func (h *Hub) createLink(id uint32, target string, stream hub.Stream) bool {
+	backend, ok := h.resolveBackend(target)
+	if !ok {
+		log.With(h.authedUser).Errorf("link(%d) backend %s not found", id, target)
+		return false
+	}
+
+	// 多路复用的隧道在握手时没有绑定后端，访问策略也可能随时间变化，需要在创建 link 时检查访问权限
+	if access := h.authorize(backend); !access.Allowed {
+		log.With(h.authedUser).Errorf("link(%d) access to backend %s denied: %s", id, backend.Backend.Name, access.Reason)
+		return false
+	}
+
+	l := h.CreateLink(id)
+	if l == nil {
+		return false
+	}
+
+	l.SetRateLimiters(h.limits.forLink(h.authedUser, backend.Backend.Name, &h.throttled))
+	if stream == nil {
+		h.SetLinkPriority(id, backend.Priority)
+	}
+
+	// link 数据可能在连接后端之前到达，需要先记录 link 的后端
+	h.linkBackendsLock.Lock()
+	h.linkBackends[id] = backend
+	h.linkBackendsLock.Unlock()
+
+	go h.handleLink(l, backend, stream)
+	return true
+}
+
+func (h *Hub) handleLink(l *hub.Link, backend *Backend, stream hub.Stream) {
 	defer common.ErrorHandler()
 	defer h.DeleteLink(l.ID)
+	defer func() {
+		h.linkBackendsLock.Lock()
+		delete(h.linkBackends, l.ID)
+		h.linkBackendsLock.Unlock()
+	}()
 
-	conn, err := net.DialTCP("tcp", nil, h.backend.Addr)
+	conn, err := h.dialBackend(backend)
 	if err != nil {
-		log.With(h.authedUser).Errorf("link(%d) connect to %s failed: %v", l.ID, h.backend.Addr, err)
-		h.SendCommand(l.ID, hub.LinkClose)
+		log.With(h.authedUser).Errorf("link(%d) connect to %s failed: %v", l.ID, backend.Backend.Addr, err)
+		if stream != nil {
+			_ = stream.Close()
+		} else {
+			h.SendCommand(l.ID, hub.LinkClose)
+		}
 		h.DeleteLink(l.ID)
 		return
 	}
 
+	if stream != nil {
+		h.StartStreamLink(l, stream, conn, h.authedUser)
+		return
+	}
+
 	h.StartLink(l, conn, h.authedUser)
 }
 
+// dialBackend 连接后端，udp 后端每个 link 使用单独的 UDP 会话，空闲超时后关闭
+func (h *Hub) dialBackend(backend *Backend) (hub.Conn, error) {
+	if backend.UnixAddr != nil {
+		conn, err := net.DialUnix("unix", nil, backend.UnixAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	if backend.UDPAddr != nil {
+		conn, err := net.DialUDP("udp", nil, backend.UDPAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		return hub.NewDatagramConn(conn, hub.DatagramIdleTimeout), nil
+	}
+
+	conn, err := net.DialTCP("tcp", nil, backend.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
 func (h *Hub) onCtrlFilter(cmd hub.Command) bool {
 	id := cmd.ID
 	switch cmd.Cmd {
 	case hub.LinkCreate:
-		l := h.CreateLink(id)
-		if l != nil {
-			go h.handleLink(l)
-		} else {
+		if !h.createLink(id, cmd.Target, nil) {
 			h.SendCommand(id, hub.LinkClose)
 		}
 		return true
 	case hub.TunHeartbeat:
+		atomic.StoreInt64(&h.lastHeartbeat, time.Now().UnixNano())
 		h.SendCommand(id, hub.TunHeartbeat)
 		return true
+	case hub.TunPong:
+		now := time.Now().UnixNano()
+		atomic.StoreInt64(&h.lastHeartbeat, now)
+		if id == atomic.LoadUint32(&h.pingSeq) {
+			atomic.StoreInt64(&h.rtt, now-atomic.LoadInt64(&h.pingSentAt))
+		}
+		return true
 	}
 	return false
 }
 
-func (h *Hub) buildDataFilter(backend *Backend, authedUser *auth.AuthedUser) func(isResp bool, link *hub.Link, data []byte) {
+// LastHeartbeat 最后一次收到客户端心跳的时间
+func (h *Hub) LastHeartbeat() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&h.lastHeartbeat))
+}
+
+// RTT 最近一次测量的隧道往返时间，客户端不支持测量时为 0
+func (h *Hub) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.rtt))
+}
+
+// SendGoAway 通知客户端不再在该隧道上创建 link，客户端不支持时只能等待已有 link 结束
+func (h *Hub) SendGoAway() {
+	if h.goAway {
+		h.SendCommand(0, hub.TunGoAway)
+	}
+}
+
+// Start 处理隧道数据直到隧道断开，期间检查心跳和空闲超时，超时后关闭隧道回收所有 link
+func (h *Hub) Start() {
+	done := make(chan struct{})
+	defer close(done)
+
+	go h.watch(done)
+	h.Hub.Start()
+}
+
+func (h *Hub) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(hubWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if span := now.Sub(h.LastHeartbeat()); span > h.timeouts.heartbeat {
+				log.With(h.authedUser).Errorf("%s heartbeat timeout, last heartbeat %s ago", h.TunnelName(), span)
+				h.Close()
+				return
+			}
+
+			if h.timeouts.idle > 0 && h.LinkCount() == 0 {
+				if span := now.Sub(h.LastActive()); span > h.timeouts.idle {
+					log.With(h.authedUser).Warningf("%s idle timeout, no link for %s", h.TunnelName(), span)
+					h.Close()
+					return
+				}
+			}
+
+			if h.probe {
+				// v1 帧格式中命令 ID 只有 16 位
+				seq := (atomic.LoadUint32(&h.pingSeq) + 1) & 0xffff
+				atomic.StoreUint32(&h.pingSeq, seq)
+				atomic.StoreInt64(&h.pingSentAt, now.UnixNano())
+				h.SendCommand(seq, hub.TunPing)
+			}
+		}
+	}
+}
+
+func (h *Hub) buildDataFilter(authedUser *auth.AuthedUser) func(isResp bool, link *hub.Link, data []byte) {
 	return func(isResp bool, link *hub.Link, data []byte) {
-		if backend.Backend.Protocol == "" || isResp {
+		if isResp {
+			return
+		}
+
+		backend := h.linkBackend(link.ID)
+		if backend == nil || backend.Backend.Protocol == "" {
 			return
 		}
 
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+)
+
+// testBackend 原样返回数据的 TCP 后端，记录建立的连接数
+type testBackend struct {
+	*Backend
+	accepted int32
+}
+
+func newTestBackend(t *testing.T, conf config.BackendServer) *testBackend {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	conf.Addr = ln.Addr().String()
+	backend := &testBackend{Backend: &Backend{Addr: ln.Addr().(*net.TCPAddr), Backend: conf}}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&backend.accepted, 1)
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return backend
+}
+
+func (b *testBackend) Accepted() int {
+	return int(atomic.LoadInt32(&b.accepted))
+}
+
+// testClient 通过 net.Pipe 与服务端 Hub 相连的客户端 Hub，收到的隧道命令和没有对应 link 的命令写入 cmds
+type testClient struct {
+	*hub.Hub
+	user *auth.AuthedUser
+	cmds chan hub.Command
+	done chan struct{} // 客户端 Hub 退出（隧道断开）后关闭
+}
+
+// testHub 服务端 Hub，done 在 Start 返回后关闭
+type testHub struct {
+	*Hub
+	done chan struct{}
+}
+
+// newTestHub 创建通过 net.Pipe 连接的服务端 Hub 和客户端 Hub，并启动双方的数据处理
+// 服务端 Hub 默认允许访问所有后端
+func newTestHub(t *testing.T, user *auth.AuthedUser, backends map[string]*Backend, backend *Backend, capabilities common.Capability, timeouts hubTimeouts) (*testHub, *testClient) {
+	t.Helper()
+
+	limits, err := newRateLimits(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+
+	h := &testHub{
+		Hub:  newHub(hub.NewTunnel(serverConn), backends, backend, user, capabilities, timeouts, limits),
+		done: make(chan struct{}),
+	}
+	h.authorize = func(backend *Backend) AccessResult { return AccessResult{Allowed: true} }
+
+	c := &testClient{
+		Hub:  hub.NewHub(hub.NewTunnel(clientConn)),
+		user: user,
+		cmds: make(chan hub.Command, 64),
+		done: make(chan struct{}),
+	}
+	c.OnCtrlFilter = func(cmd hub.Command) bool {
+		if cmd.ID != 0 && c.GetLink(cmd.ID) != nil {
+			return false
+		}
+
+		select {
+		case c.cmds <- cmd:
+		default:
+		}
+		return true
+	}
+
+	go func() {
+		defer close(h.done)
+		h.Start()
+	}()
+	go func() {
+		defer close(c.done)
+		c.Start()
+	}()
+
+	t.Cleanup(func() {
+		h.Close()
+		c.Close()
+		<-h.done
+		<-c.done
+	})
+
+	return h, c
+}
+
+// openLink 在客户端创建连接到 target 后端的 link，返回 link 的本地连接
+func (c *testClient) openLink(t *testing.T, id uint32, target string) net.Conn {
+	t.Helper()
+
+	local, remote := newTCPPair(t)
+
+	l := c.CreateLink(id)
+	if l == nil {
+		t.Fatalf("create link %d failed", id)
+	}
+
+	if target == "" {
+		c.SendCommand(id, hub.LinkCreate)
+	} else {
+		c.SendLinkCreate(id, target)
+	}
+
+	go func() {
+		defer c.DeleteLink(id)
+		c.StartLink(l, remote, c.user)
+	}()
+
+	return local
+}
+
+// waitCommand 等待客户端收到指定的命令
+func (c *testClient) waitCommand(t *testing.T, cmd uint8, id uint32, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case got := <-c.cmds:
+			if got.Cmd == cmd && got.ID == id {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("command %d for link %d not received in %s", cmd, id, timeout)
+		}
+	}
+}
+
+func newTCPPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := <-accepted
+	if peer == nil {
+		t.Fatal("accept failed")
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = peer.Close()
+	})
+
+	return conn.(*net.TCPConn), peer.(*net.TCPConn)
+}
+
+// echo 通过 link 发送数据并等待后端原样返回
+func echo(t *testing.T, conn net.Conn, data string) {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != data {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+}
+
+// waitFor 等待 cond 成立
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not satisfied in %s", msg, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHubHeartbeatTimeout(t *testing.T) {
+	user := &auth.AuthedUser{Account: "alice"}
+	backend := newTestBackend(t, config.BackendServer{Name: "echo"})
+
+	t.Run("reap", func(t *testing.T) {
+		h, c := newTestHub(t, user, nil, backend.Backend, 0, hubTimeouts{heartbeat: 1500 * time.Millisecond})
+
+		waitFor(t, 4*time.Second, func() bool { return closed(h.done) }, "hub closed without heartbeat")
+		waitFor(t, time.Second, func() bool { return closed(c.done) }, "client disconnected")
+	})
+
+	t.Run("keepalive", func(t *testing.T) {
+		h, c := newTestHub(t, user, nil, backend.Backend, 0, hubTimeouts{heartbeat: 1500 * time.Millisecond})
+
+		for i := 0; i < 15; i++ {
+			c.SendCommand(0, hub.TunHeartbeat)
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		if closed(h.done) {
+			t.Fatal("hub with heartbeats should not be closed")
+		}
+
+		c.waitCommand(t, hub.TunHeartbeat, 0, time.Second)
+	})
+}
+
+func TestHubIdleTimeout(t *testing.T) {
+	user := &auth.AuthedUser{Account: "alice"}
+	backend := newTestBackend(t, config.BackendServer{Name: "echo"})
+
+	h, c := newTestHub(t, user, nil, backend.Backend, 0, hubTimeouts{heartbeat: time.Minute, idle: time.Second})
+
+	// 有 link 时不会因空闲而关闭
+	conn := c.openLink(t, 1, "")
+	echo(t, conn, "hello")
+	time.Sleep(2500 * time.Millisecond)
+	if closed(h.done) {
+		t.Fatal("hub with active link should not be closed")
+	}
+	echo(t, conn, "world")
+
+	_ = conn.Close()
+	waitFor(t, 3*time.Second, func() bool { return h.LinkCount() == 0 }, "link closed")
+	waitFor(t, 4*time.Second, func() bool { return closed(h.done) }, "idle hub closed")
+}
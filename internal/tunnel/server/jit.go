@@ -0,0 +1,426 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/go-utils/file"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+)
+
+const (
+	// grantCheckInterval 检查授权是否过期的间隔
+	grantCheckInterval = 5 * time.Second
+	// pendingTimeout 访问申请等待审批的最长时间，超过后自动过期
+	pendingTimeout = 24 * time.Hour
+)
+
+// AccessRequestStatus 临时访问申请的状态
+type AccessRequestStatus string
+
+const (
+	AccessPending  AccessRequestStatus = "pending"
+	AccessApproved AccessRequestStatus = "approved"
+	AccessRejected AccessRequestStatus = "rejected"
+	AccessRevoked  AccessRequestStatus = "revoked"
+	AccessExpired  AccessRequestStatus = "expired"
+)
+
+var (
+	ErrAccessRequestNotFound = errors.New("access request not found")
+	ErrJITNotEnabled         = errors.New("backend does not accept access requests")
+	ErrNotEligible           = errors.New("user is not allowed to request access to the backend")
+	ErrNotApprover           = errors.New("user is not an approver of the backend")
+	ErrSelfApproval          = errors.New("access request can not be approved by the requester")
+	ErrInvalidAccessRequest  = errors.New("invalid access request")
+)
+
+// AccessRequest 临时访问申请，审批通过后在 ExpiresAt 之前允许申请人访问后端
+type AccessRequest struct {
+	ID        string              `json:"id"`
+	Account   string              `json:"account"`
+	Backend   string              `json:"backend"`
+	Reason    string              `json:"reason"`
+	Duration  string              `json:"duration"`
+	Status    AccessRequestStatus `json:"status"`
+	CreatedAt time.Time           `json:"created_at"`
+
+	Approver  string     `json:"approver,omitempty"` // 审批、撤销申请的用户
+	Comment   string     `json:"comment,omitempty"`  // 拒绝、撤销的原因
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // 授权的过期时间，审批通过后设置
+}
+
+// active 授权是否在有效期内
+func (req *AccessRequest) active(now time.Time) bool {
+	return req.Status == AccessApproved && req.ExpiresAt != nil && now.Before(*req.ExpiresAt)
+}
+
+// grantStore 持久化保存的临时访问申请，每次修改后整体写入文件
+type grantStore struct {
+	path     string
+	lock     sync.RWMutex
+	requests map[string]*AccessRequest
+}
+
+func loadGrantStore(path string) (*grantStore, error) {
+	st := &grantStore{path: path, requests: make(map[string]*AccessRequest)}
+	if !file.Exist(path) {
+		return st, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read grant store %s failed: %v", path, err)
+	}
+
+	var requests []*AccessRequest
+	if err := json.Unmarshal(data, &requests); err != nil {
+		return nil, fmt.Errorf("decode grant store %s failed: %v", path, err)
+	}
+
+	for _, req := range requests {
+		st.requests[req.ID] = req
+	}
+
+	return st, nil
+}
+
+// save 写入临时文件后替换，避免写入过程中退出导致文件损坏，调用方需要持有锁
+func (st *grantStore) save() error {
+	requests := make([]*AccessRequest, 0, len(st.requests))
+	for _, req := range st.requests {
+		requests = append(requests, req)
+	}
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].CreatedAt.Before(requests[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(requests, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := st.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write grant store %s failed: %v", tmp, err)
+	}
+
+	return os.Rename(tmp, st.path)
+}
+
+// update 在锁内修改申请并保存，fn 返回错误时不保存
+func (st *grantStore) update(id string, fn func(req *AccessRequest) error) (AccessRequest, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	req, ok := st.requests[id]
+	if !ok {
+		return AccessRequest{}, ErrAccessRequestNotFound
+	}
+
+	backup := *req
+	if err := fn(req); err != nil {
+		*req = backup
+		return AccessRequest{}, err
+	}
+
+	if err := st.save(); err != nil {
+		*req = backup
+		return AccessRequest{}, err
+	}
+
+	return *req, nil
+}
+
+// active 用户是否持有后端的有效授权
+func (st *grantStore) active(account, backend string) bool {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	now := time.Now()
+	for _, req := range st.requests {
+		if req.Account == account && req.Backend == backend && req.active(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RequestAccess 申请在 duration 时间内访问启用了临时访问授权的后端
+func (s *Server) RequestAccess(user *auth.AuthedUser, backendName string, duration time.Duration, reason string) (*AccessRequest, error) {
+	backend, ok := s.backends[backendName]
+	if !ok {
+		return nil, fmt.Errorf("%w: backend %s not found", ErrInvalidAccessRequest, backendName)
+	}
+
+	jit := backend.Backend.JIT
+	if !jit.Enabled() {
+		return nil, ErrJITNotEnabled
+	}
+
+	if !backend.Allowed(user) {
+		return nil, ErrNotEligible
+	}
+
+	if !user.InScope(backendName) {
+		return nil, fmt.Errorf("%w: backend %s is out of the scopes of token %s", ErrNotEligible, backendName, user.TokenID)
+	}
+
+	if duration <= 0 || duration > jit.MaxDuration {
+		return nil, fmt.Errorf("%w: duration must be between 0 and %s", ErrInvalidAccessRequest, jit.MaxDuration)
+	}
+
+	if reason == "" {
+		return nil, fmt.Errorf("%w: reason is required", ErrInvalidAccessRequest)
+	}
+
+	req := &AccessRequest{
+		ID:        uuid.New().String(),
+		Account:   user.Account,
+		Backend:   backendName,
+		Reason:    reason,
+		Duration:  duration.String(),
+		Status:    AccessPending,
+		CreatedAt: time.Now(),
+	}
+
+	s.grants.lock.Lock()
+	s.grants.requests[req.ID] = req
+	if err := s.grants.save(); err != nil {
+		delete(s.grants.requests, req.ID)
+		s.grants.lock.Unlock()
+		return nil, err
+	}
+	created := *req
+	s.grants.lock.Unlock()
+
+	s.audit.record(AuditEvent{
+		Event:     AuditAccessRequested,
+		RequestID: created.ID,
+		Account:   created.Account,
+		Backend:   created.Backend,
+		Actor:     user.Account,
+		Reason:    reason,
+		Duration:  created.Duration,
+	})
+
+	return &created, nil
+}
+
+// AccessRequests 用户可以查看的访问申请：自己提交的申请和自己可以审批的申请，按提交时间倒序排列
+func (s *Server) AccessRequests(user *auth.AuthedUser) []AccessRequest {
+	s.grants.lock.RLock()
+	defer s.grants.lock.RUnlock()
+
+	requests := make([]AccessRequest, 0)
+	for _, req := range s.grants.requests {
+		if req.Account == user.Account || s.isApprover(user, req.Backend) {
+			requests = append(requests, *req)
+		}
+	}
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].CreatedAt.After(requests[j].CreatedAt) })
+	return requests
+}
+
+// isApprover 用户是否可以审批后端的访问申请，使用令牌登录时后端需要在令牌的范围内
+func (s *Server) isApprover(user *auth.AuthedUser, backendName string) bool {
+	backend, ok := s.backends[backendName]
+	return ok && user.InScope(backendName) && backend.Backend.JIT.IsApprover(user.Account, user.Groups)
+}
+
+// ApproveAccess 审批通过访问申请，授权从审批时开始计算有效期
+func (s *Server) ApproveAccess(approver *auth.AuthedUser, id string) (*AccessRequest, error) {
+	req, err := s.grants.update(id, func(req *AccessRequest) error {
+		if !s.isApprover(approver, req.Backend) {
+			return ErrNotApprover
+		}
+
+		if req.Account == approver.Account {
+			return ErrSelfApproval
+		}
+
+		if req.Status != AccessPending {
+			return fmt.Errorf("%w: access request is %s", ErrInvalidAccessRequest, req.Status)
+		}
+
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidAccessRequest, err)
+		}
+
+		now := time.Now()
+		expiresAt := now.Add(duration)
+		req.Status, req.Approver, req.DecidedAt, req.ExpiresAt = AccessApproved, approver.Account, &now, &expiresAt
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.audit.record(AuditEvent{
+		Event:     AuditAccessApproved,
+		RequestID: req.ID,
+		Account:   req.Account,
+		Backend:   req.Backend,
+		Actor:     approver.Account,
+		Reason:    req.Reason,
+		Duration:  req.Duration,
+	})
+
+	return &req, nil
+}
+
+// RejectAccess 拒绝访问申请
+func (s *Server) RejectAccess(approver *auth.AuthedUser, id string, comment string) (*AccessRequest, error) {
+	req, err := s.grants.update(id, func(req *AccessRequest) error {
+		if !s.isApprover(approver, req.Backend) {
+			return ErrNotApprover
+		}
+
+		if req.Status != AccessPending {
+			return fmt.Errorf("%w: access request is %s", ErrInvalidAccessRequest, req.Status)
+		}
+
+		now := time.Now()
+		req.Status, req.Approver, req.Comment, req.DecidedAt = AccessRejected, approver.Account, comment, &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.audit.record(AuditEvent{
+		Event:     AuditAccessRejected,
+		RequestID: req.ID,
+		Account:   req.Account,
+		Backend:   req.Backend,
+		Actor:     approver.Account,
+		Reason:    comment,
+	})
+
+	return &req, nil
+}
+
+// RevokeAccess 提前撤销授权或取消等待审批的申请，申请人和审批人都可以撤销，撤销后立即断开申请人访问该后端的隧道
+func (s *Server) RevokeAccess(user *auth.AuthedUser, id string, comment string) (*AccessRequest, error) {
+	req, err := s.grants.update(id, func(req *AccessRequest) error {
+		if req.Account != user.Account && !s.isApprover(user, req.Backend) {
+			return ErrNotApprover
+		}
+
+		if req.Status != AccessPending && req.Status != AccessApproved {
+			return fmt.Errorf("%w: access request is %s", ErrInvalidAccessRequest, req.Status)
+		}
+
+		now := time.Now()
+		req.Status, req.Approver, req.Comment = AccessRevoked, user.Account, comment
+		if req.DecidedAt == nil {
+			req.DecidedAt = &now
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.audit.record(AuditEvent{
+		Event:     AuditAccessRevoked,
+		RequestID: req.ID,
+		Account:   req.Account,
+		Backend:   req.Backend,
+		Actor:     user.Account,
+		Reason:    comment,
+	})
+
+	s.terminateAccess(req)
+	return &req, nil
+}
+
+// expireGrants 定期检查授权和访问申请是否过期
+func (s *Server) expireGrants(done <-chan struct{}) {
+	ticker := time.NewTicker(grantCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.expireGrantsAt(now)
+		}
+	}
+}
+
+// expireGrantsAt 将 now 时已过期的授权和超时未审批的申请标记为过期，并断开授权过期的隧道
+func (s *Server) expireGrantsAt(now time.Time) {
+	expired := make([]AccessRequest, 0)
+
+	s.grants.lock.Lock()
+	for _, req := range s.grants.requests {
+		grantExpired := req.Status == AccessApproved && !req.active(now)
+		pendingExpired := req.Status == AccessPending && now.Sub(req.CreatedAt) > pendingTimeout
+		if grantExpired || pendingExpired {
+			req.Status = AccessExpired
+			expired = append(expired, *req)
+		}
+	}
+
+	if len(expired) > 0 {
+		if err := s.grants.save(); err != nil {
+			log.Errorf("save grant store failed: %v", err)
+		}
+	}
+	s.grants.lock.Unlock()
+
+	for _, req := range expired {
+		s.audit.record(AuditEvent{
+			Event:     AuditAccessExpired,
+			RequestID: req.ID,
+			Account:   req.Account,
+			Backend:   req.Backend,
+			Duration:  req.Duration,
+		})
+
+		if req.ExpiresAt != nil {
+			s.terminateAccess(req)
+		}
+	}
+}
+
+// terminateAccess 授权失效后断开申请人正在访问该后端的隧道，用户还有其他有效授权时保留
+// 多路复用的隧道中可能还有其他后端的连接，客户端会重新建立隧道，之后访问该后端的 link 会被拒绝
+func (s *Server) terminateAccess(req AccessRequest) {
+	if s.grants.active(req.Account, req.Backend) {
+		return
+	}
+
+	s.connectionsLock.RLock()
+	conns := make([]*connInfo, 0)
+	for _, conn := range s.connections {
+		if conn.user != nil && conn.user.Account == req.Account && conn.hub.usesBackend(req.Backend) {
+			conns = append(conns, conn)
+		}
+	}
+	s.connectionsLock.RUnlock()
+
+	for _, conn := range conns {
+		conn.hub.Close()
+		s.audit.record(AuditEvent{
+			Event:     AuditTunnelClosed,
+			RequestID: req.ID,
+			Account:   req.Account,
+			Backend:   req.Backend,
+			Reason:    fmt.Sprintf("access %s, tunnel %s closed", req.Status, conn.id),
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+// newJITTestServer 创建后端 db 启用临时访问授权、后端 open 不启用的服务端
+func newJITTestServer(t *testing.T) (*Server, map[string]*testBackend) {
+	t.Helper()
+
+	dir := t.TempDir()
+	grants, err := loadGrantStore(filepath.Join(dir, "grants.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := map[string]*testBackend{
+		"db":   newTestBackend(t, config.BackendServer{Name: "db", JIT: config.JITAccess{Approvers: []string{"bob"}, MaxDuration: time.Hour}}),
+		"open": newTestBackend(t, config.BackendServer{Name: "open"}),
+	}
+
+	s := &Server{
+		backends:    map[string]*Backend{"db": backends["db"].Backend, "open": backends["open"].Backend},
+		grants:      grants,
+		audit:       newAuditLog(filepath.Join(dir, "audit.log")),
+		connections: make(map[string]*connInfo),
+		draining:    make(chan struct{}),
+	}
+
+	return s, backends
+}
+
+// grantAccess 申请并审批 account 访问后端 db
+func grantAccess(t *testing.T, s *Server, account string) *AccessRequest {
+	t.Helper()
+
+	req, err := s.RequestAccess(&auth.AuthedUser{Account: account}, "db", time.Hour, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req, err = s.ApproveAccess(&auth.AuthedUser{Account: "bob"}, req.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	return req
+}
+
+// connectJITBackends 建立 alice 分别访问 db 和 open 的隧道
+func connectJITBackends(t *testing.T, s *Server, backends map[string]*testBackend) (db, open *testHub) {
+	t.Helper()
+
+	user := &auth.AuthedUser{Account: "alice"}
+	timeouts := hubTimeouts{heartbeat: time.Minute}
+
+	for _, name := range []string{"db", "open"} {
+		if access := s.authorize(accessContext{user: user}, backends[name].Backend); !access.Allowed {
+			t.Fatalf("access to %s should be allowed: %s", name, access.Reason)
+		}
+
+		h, c := newTestHub(t, user, nil, backends[name].Backend, 0, timeouts)
+		addTestConn(s, name, h)
+		echo(t, c.openLink(t, 1, ""), "hello "+name)
+
+		if name == "db" {
+			db = h
+		} else {
+			open = h
+		}
+	}
+
+	return db, open
+}
+
+func TestRevokeAccessClosesTunnel(t *testing.T) {
+	s, backends := newJITTestServer(t)
+
+	if access := s.authorize(accessContext{user: &auth.AuthedUser{Account: "alice"}}, backends["db"].Backend); access.Allowed {
+		t.Fatal("access without grant should be denied")
+	}
+
+	req := grantAccess(t, s, "alice")
+	db, open := connectJITBackends(t, s, backends)
+
+	if _, err := s.RevokeAccess(&auth.AuthedUser{Account: "bob"}, req.ID, "done"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool { return closed(db.done) }, "tunnel closed after revoke")
+	if closed(open.done) {
+		t.Fatal("tunnel to backend without jit should not be closed")
+	}
+
+	data, err := ioutil.ReadFile(s.audit.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(data), AuditAccessRevoked) || !strings.Contains(string(data), AuditTunnelClosed) {
+		t.Fatalf("revoke and tunnel close should be audited: %s", data)
+	}
+}
+
+func TestExpireGrantsClosesTunnel(t *testing.T) {
+	s, backends := newJITTestServer(t)
+
+	req := grantAccess(t, s, "alice")
+	db, open := connectJITBackends(t, s, backends)
+
+	// 授权未过期时保留隧道
+	s.expireGrantsAt(time.Now())
+	time.Sleep(100 * time.Millisecond)
+	if closed(db.done) {
+		t.Fatal("tunnel with active grant should not be closed")
+	}
+
+	s.expireGrantsAt(req.ExpiresAt.Add(time.Second))
+
+	waitFor(t, 2*time.Second, func() bool { return closed(db.done) }, "tunnel closed after grant expired")
+	if closed(open.done) {
+		t.Fatal("tunnel to backend without jit should not be closed")
+	}
+
+	requests := s.AccessRequests(&auth.AuthedUser{Account: "alice"})
+	if len(requests) != 1 || requests[0].Status != AccessExpired {
+		t.Fatalf("grant should be expired: %+v", requests)
+	}
+}
+
+func TestTerminateAccessKeepsOtherGrant(t *testing.T) {
+	s, backends := newJITTestServer(t)
+
+	first := grantAccess(t, s, "alice")
+	grantAccess(t, s, "alice")
+	db, _ := connectJITBackends(t, s, backends)
+
+	// 用户还有其他有效授权时保留隧道
+	if _, err := s.RevokeAccess(&auth.AuthedUser{Account: "alice"}, first.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if closed(db.done) {
+		t.Fatal("tunnel should be kept while another grant is active")
+	}
+}
+
+func TestAccessRequestTokenScope(t *testing.T) {
+	s, _ := newJITTestServer(t)
+
+	scoped := &auth.AuthedUser{Account: "alice", TokenID: "tok", Scopes: []string{"open"}}
+	if _, err := s.RequestAccess(scoped, "db", time.Hour, "debug"); !errors.Is(err, ErrNotEligible) {
+		t.Fatalf("token out of scope should not request access, got %v", err)
+	}
+
+	req, err := s.RequestAccess(&auth.AuthedUser{Account: "alice"}, "db", time.Hour, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 审批人使用范围之外的令牌时不能审批
+	approver := &auth.AuthedUser{Account: "bob", TokenID: "tok", Scopes: []string{"open"}}
+	if _, err := s.ApproveAccess(approver, req.ID); !errors.Is(err, ErrNotApprover) {
+		t.Fatalf("token out of scope should not approve access, got %v", err)
+	}
+
+	if len(s.AccessRequests(approver)) != 0 {
+		t.Fatal("requests out of token scope should not be listed for approver")
+	}
+
+	approver.Scopes = []string{"db"}
+	if _, err := s.ApproveAccess(approver, req.ID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/tls"
 	"net"
 	"time"
 )
@@ -28,3 +29,12 @@ func newTCPListener(addr string) (net.Listener, error) {
 	tl := tcpListener{ln.(*net.TCPListener)}
 	return &tl, nil
 }
+
+// newTLSListener create a tls listener for server
+func newTLSListener(addr string, conf *tls.Config) (net.Listener, error) {
+	ln, err := newTCPListener(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, conf), nil
+}
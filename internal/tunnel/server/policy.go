@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/policy"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+)
+
+// accessContext 隧道建立时确定的访问上下文，隧道中的每个 link 连接后端前都使用它检查访问权限
+type accessContext struct {
+	user   *auth.AuthedUser
+	client *common.SystemInfo
+	remote string
+}
+
+// AccessResult 访问权限检查结果
+type AccessResult struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+	// Policy 访问策略的执行结果，未配置访问策略或之前的检查已经拒绝访问时为空
+	Policy *policy.Decision `json:"policy,omitempty"`
+}
+
+// CheckAccess 检查用户是否可以访问后端，依次检查后端的访问控制规则、临时访问授权和访问策略，用于访问策略的试运行
+func (s *Server) CheckAccess(in policy.Input) AccessResult {
+	backend, ok := s.backends[in.Backend.Name]
+	if !ok {
+		return AccessResult{Reason: fmt.Sprintf("backend %s not found", in.Backend.Name)}
+	}
+
+	return s.checkAccess(backend, in)
+}
+
+// authorize 检查隧道的用户是否可以访问后端
+func (s *Server) authorize(ac accessContext, backend *Backend) AccessResult {
+	in := policy.Input{User: *ac.user, Remote: ac.remote}
+	if ac.client != nil {
+		in.Client = *ac.client
+	}
+
+	return s.checkAccess(backend, in)
+}
+
+func (s *Server) checkAccess(backend *Backend, in policy.Input) AccessResult {
+	if !in.User.InScope(backend.Backend.Name) {
+		return AccessResult{Reason: fmt.Sprintf("backend %s is out of the scopes of token %s", backend.Backend.Name, in.User.TokenID)}
+	}
+
+	if !backend.Allowed(&in.User) {
+		return AccessResult{Reason: fmt.Sprintf("user %s is not in the access rules of backend %s", in.User.Account, backend.Backend.Name)}
+	}
+
+	if backend.Backend.JIT.Enabled() && !s.grants.active(in.User.Account, backend.Backend.Name) {
+		return AccessResult{Reason: fmt.Sprintf("no active access grant for backend %s, please request access first", backend.Backend.Name)}
+	}
+
+	if s.policy == nil {
+		return AccessResult{Allowed: true}
+	}
+
+	in.Backend = policy.Backend{Name: backend.Backend.Name, Addr: backend.Backend.Addr, Protocol: backend.Backend.Protocol}
+	decision := s.policy.Evaluate(in)
+
+	result := AccessResult{Allowed: decision.Allowed, Policy: &decision}
+	if !decision.Allowed {
+		result.Reason = fmt.Sprintf("policy: %s", decision)
+	}
+
+	return result
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+)
+
+// testAuthor 不校验密码的用户认证
+type testAuthor map[string]*auth.AuthedUser
+
+func (a testAuthor) Login(username, password string) (*auth.AuthedUser, error) {
+	return a.GetUser(username)
+}
+
+func (a testAuthor) GetUser(username string) (*auth.AuthedUser, error) {
+	user, ok := a[username]
+	if !ok {
+		return nil, fmt.Errorf("user %s not found", username)
+	}
+
+	return user, nil
+}
+
+func (a testAuthor) Users() ([]auth.AuthedUser, error) {
+	users := make([]auth.AuthedUser, 0, len(a))
+	for _, user := range a {
+		users = append(users, *user)
+	}
+
+	return users, nil
+}
+
+// clientHandshake 作为客户端完成握手，返回服务端的认证响应
+func clientHandshake(t *testing.T, tun *hub.Tunnel, req common.AuthRequest) common.AuthResponse {
+	t.Helper()
+
+	if err := tun.WritePacket(0, common.EncodeMessage(common.MsgClientHello, common.ClientHello{Version: common.ProtocolVersion})); err != nil {
+		t.Fatal(err)
+	}
+
+	_, data, err := tun.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hello common.ServerHello
+	if err := common.DecodeMessage(data, common.MsgServerHello, &hello); err != nil || hello.Error != nil {
+		t.Fatalf("unexpected server hello: %v, %v", err, hello.Error)
+	}
+
+	if err := tun.WritePacket(0, common.EncodeMessage(common.MsgAuthRequest, req)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, data, err = tun.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp common.AuthResponse
+	if err := common.DecodeMessage(data, common.MsgAuthResponse, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestHandshakeAccessRules(t *testing.T) {
+	db := newTestBackend(t, config.BackendServer{Name: "db", DenyUsers: []string{"alice"}, AllowGroups: []string{"dba"}})
+	s := &Server{backends: map[string]*Backend{"db": db.Backend}}
+	author := testAuthor{
+		"alice": {Account: "alice", Groups: []string{"dba"}},
+		"bob":   {Account: "bob", Groups: []string{"dba"}},
+		"carol": {Account: "carol", Groups: []string{"dev"}},
+	}
+
+	for _, tc := range []struct {
+		username string
+		allowed  bool
+	}{
+		{username: "alice", allowed: false}, // 禁止规则优先于允许规则
+		{username: "bob", allowed: true},
+		{username: "carol", allowed: false},
+	} {
+		t.Run(tc.username, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer func() { _ = serverConn.Close(); _ = clientConn.Close() }()
+
+			result := make(chan error, 1)
+			go func() {
+				_, err := s.handshake(hub.NewTunnel(serverConn), author, nil, nil, "pipe")
+				result <- err
+			}()
+
+			resp := clientHandshake(t, hub.NewTunnel(clientConn), common.AuthRequest{Username: tc.username, Backend: "db"})
+			err := <-result
+
+			if tc.allowed {
+				if err != nil || resp.Error != nil {
+					t.Fatalf("user %s should be allowed: %v, %v", tc.username, err, resp.Error)
+				}
+				return
+			}
+
+			if err == nil || resp.Error == nil || resp.Error.Code != common.ErrCodeAccessDenied {
+				t.Fatalf("user %s should be denied: %v, %v", tc.username, err, resp.Error)
+			}
+		})
+	}
+
+	if db.Accepted() != 0 {
+		t.Fatalf("backend should not be connected during handshake, got %d connections", db.Accepted())
+	}
+}
+
+func TestCreateLinkAccessRules(t *testing.T) {
+	user := &auth.AuthedUser{Account: "alice", Groups: []string{"contractor"}}
+	db := newTestBackend(t, config.BackendServer{Name: "db", DenyGroups: []string{"contract*"}})
+	open := newTestBackend(t, config.BackendServer{Name: "open"})
+
+	s := &Server{backends: map[string]*Backend{"db": db.Backend, "open": open.Backend}}
+
+	// 多路复用的隧道不绑定后端，创建 link 时检查访问权限
+	h, c := newTestHub(t, user, s.backends, nil, common.CapMultiplex, hubTimeouts{heartbeat: time.Minute})
+	h.authorize = func(backend *Backend) AccessResult { return s.authorize(accessContext{user: user}, backend) }
+
+	c.SendLinkCreate(1, "db")
+	c.waitCommand(t, hub.LinkClose, 1, time.Second)
+
+	if h.LinkCount() != 0 || h.linkBackend(1) != nil {
+		t.Fatal("denied link should not be created")
+	}
+
+	if db.Accepted() != 0 {
+		t.Fatalf("denied backend should not be connected, got %d connections", db.Accepted())
+	}
+
+	conn := c.openLink(t, 2, "open")
+	echo(t, conn, "hello")
+	if open.Accepted() != 1 {
+		t.Fatalf("allowed backend should be connected once, got %d connections", open.Accepted())
+	}
+}
+
+func TestTerminateToken(t *testing.T) {
+	s := &Server{
+		audit:       newAuditLog(filepath.Join(t.TempDir(), "audit.log")),
+		connections: make(map[string]*connInfo),
+		draining:    make(chan struct{}),
+	}
+	backend := newTestBackend(t, config.BackendServer{Name: "echo"})
+	timeouts := hubTimeouts{heartbeat: time.Minute}
+
+	revoked, _ := newTestHub(t, &auth.AuthedUser{Account: "alice", TokenID: "t1"}, nil, backend.Backend, 0, timeouts)
+	other, _ := newTestHub(t, &auth.AuthedUser{Account: "alice", TokenID: "t2"}, nil, backend.Backend, 0, timeouts)
+	password, _ := newTestHub(t, &auth.AuthedUser{Account: "alice"}, nil, backend.Backend, 0, timeouts)
+	addTestConn(s, "c1", revoked)
+	addTestConn(s, "c2", other)
+	addTestConn(s, "c3", password)
+
+	s.TerminateToken(&auth.AuthedUser{Account: "alice"}, "t1")
+
+	waitFor(t, 2*time.Second, func() bool { return closed(revoked.done) }, "tunnel closed after token revoked")
+	if closed(other.done) || closed(password.done) {
+		t.Fatal("tunnels not using the revoked token should not be closed")
+	}
+
+	data, err := ioutil.ReadFile(s.audit.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(data), AuditTunnelClosed) || !strings.Contains(string(data), "token t1 revoked") {
+		t.Fatalf("tunnel close should be audited: %s", data)
+	}
+}
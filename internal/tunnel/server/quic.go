@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+	"github.com/quic-go/quic-go"
+)
+
+// newQUICListener 创建 QUIC 监听，未配置 tls 证书时使用由服务端身份密钥生成的自签名证书，
+// 此时服务端身份由握手中的身份签名校验，并通过通道绑定确认 QUIC 连接两端与握手双方一致
+func newQUICListener(addr string, conf config.ServerTLS, hostKey ed25519.PrivateKey) (*quic.Listener, error) {
+	var tlsConf *tls.Config
+	if conf.Enabled() {
+		var err error
+		if tlsConf, err = buildTLSConfig(conf); err != nil {
+			return nil, err
+		}
+	} else {
+		cert, err := selfSignedCert(hostKey)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	tlsConf.MinVersion = tls.VersionTLS13
+	tlsConf.NextProtos = []string{common.QUICProtocol}
+
+	return quic.ListenAddr(addr, tlsConf, common.NewQUICConfig())
+}
+
+// selfSignedCert 使用服务端身份密钥生成自签名证书
+func selfSignedCert(key ed25519.PrivateKey) (tls.Certificate, error) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "secure-tunnel"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create self-signed certificate failed: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// serveQUIC 接收 QUIC 连接，直到 ctx 结束或监听关闭
+func (s *Server) serveQUIC(ctx context.Context, author auth.Author) {
+	defer func() { _ = s.quicListener.Close() }()
+
+	for {
+		conn, err := s.quicListener.Accept(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("quic accept failed: %v", err)
+			}
+			return
+		}
+
+		go s.handleQUICConnection(conn, author)
+	}
+}
+
+// handleQUICConnection 客户端打开的第一个流为隧道流，之后与 TCP 连接使用相同的握手流程
+func (s *Server) handleQUICConnection(conn *quic.Conn, author auth.Author) {
+	ctx, cancel := context.WithTimeout(conn.Context(), 10*time.Second)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		log.Errorf("accept tunnel stream from %s failed: %v", conn.RemoteAddr(), err)
+		_ = conn.CloseWithError(0, "")
+		return
+	}
+
+	var typ [1]byte
+	_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(stream, typ[:]); err != nil || typ[0] != hub.StreamTunnel {
+		log.Errorf("invalid tunnel stream from %s", conn.RemoteAddr())
+		_ = conn.CloseWithError(0, "")
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	s.ServeConn(common.NewQUICConn(conn, stream), author)
+}
+
+// acceptStreams 接收客户端为每个 link 打开的数据流，直到 QUIC 连接关闭
+func (h *Hub) acceptStreams(conn *common.QUICConn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go h.handleStream(stream)
+	}
+}
+
+func (h *Hub) handleStream(stream *common.QUICStream) {
+	_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	id, target, err := hub.ReadStreamHeader(stream)
+	if err != nil {
+		log.With(h.authedUser).Errorf("read stream header failed: %v", err)
+		_ = stream.Close()
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	if !h.createLink(id, target, stream) {
+		_ = stream.Close()
+	}
+}
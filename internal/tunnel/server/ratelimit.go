@@ -0,0 +1,208 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mylxsw/go-utils/str"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rateLimitBucket 一条限速规则对应的令牌桶，上传和下载方向分别限速
+type rateLimitBucket struct {
+	scope    string // backend|user|group
+	name     string
+	upload   *common.TokenBucket // 客户端发往后端
+	download *common.TokenBucket // 后端发往客户端
+}
+
+func newRateLimitBucket(scope, name string, limit config.RateLimit) (*rateLimitBucket, error) {
+	rate, burst, err := limit.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimitBucket{
+		scope:    scope,
+		name:     name,
+		upload:   common.NewTokenBucket(rate, burst),
+		download: common.NewTokenBucket(rate, burst),
+	}, nil
+}
+
+// userRateLimit 用户或用户组的限速规则
+type userRateLimit struct {
+	rule   config.UserRateLimit
+	bucket *rateLimitBucket
+}
+
+// rateLimits 服务端所有的限速规则，规则在启动时创建，所有隧道共享
+type rateLimits struct {
+	backends map[string]*rateLimitBucket
+	users    []userRateLimit
+	ordered  []*rateLimitBucket // 按配置顺序排列的所有令牌桶
+}
+
+func newRateLimits(backends []config.BackendServer, users []config.UserRateLimit) (*rateLimits, error) {
+	limits := &rateLimits{backends: make(map[string]*rateLimitBucket)}
+	for _, backend := range backends {
+		if !backend.RateLimit.Enabled() {
+			continue
+		}
+
+		bucket, err := newRateLimitBucket("backend", backend.Name, backend.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+		limits.backends[backend.Name] = bucket
+		limits.ordered = append(limits.ordered, bucket)
+	}
+
+	for _, rule := range users {
+		scope, name := "user", rule.Account
+		if rule.Account == "" {
+			scope, name = "group", rule.Group
+		}
+
+		bucket, err := newRateLimitBucket(scope, name, rule.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+		limits.users = append(limits.users, userRateLimit{rule: rule, bucket: bucket})
+		limits.ordered = append(limits.ordered, bucket)
+	}
+
+	return limits, nil
+}
+
+// buckets 当前用户访问后端时生效的所有令牌桶
+func (limits *rateLimits) buckets(user *auth.AuthedUser, backend string) []*rateLimitBucket {
+	buckets := make([]*rateLimitBucket, 0)
+	if bucket, ok := limits.backends[backend]; ok {
+		buckets = append(buckets, bucket)
+	}
+
+	if user == nil {
+		return buckets
+	}
+
+	for _, limit := range limits.users {
+		if limit.rule.Account != "" && limit.rule.Account == user.Account {
+			buckets = append(buckets, limit.bucket)
+			continue
+		}
+
+		if limit.rule.Group != "" && str.In(limit.rule.Group, user.Groups) {
+			buckets = append(buckets, limit.bucket)
+		}
+	}
+
+	return buckets
+}
+
+// forLink 创建 link 两个方向的限速器，没有生效的规则时返回 nil，throttled 累计该隧道因限速等待的时间
+func (limits *rateLimits) forLink(user *auth.AuthedUser, backend string, throttled *int64) (inbound, outbound hub.RateLimiter) {
+	buckets := limits.buckets(user, backend)
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+
+	upload := &linkLimiter{throttled: throttled}
+	download := &linkLimiter{throttled: throttled}
+	for _, b := range buckets {
+		upload.buckets = append(upload.buckets, b.upload)
+		download.buckets = append(download.buckets, b.download)
+	}
+
+	// 服务端 link 的本地连接为后端连接，写入后端的是上传的数据
+	return upload, download
+}
+
+// linkLimiter 同时受多个令牌桶限制的 link 限速器
+type linkLimiter struct {
+	buckets   []*common.TokenBucket
+	throttled *int64
+}
+
+func (l *linkLimiter) Wait(n int) {
+	if wait := common.WaitTokens(l.buckets, n); wait > 0 {
+		atomic.AddInt64(l.throttled, int64(wait))
+	}
+}
+
+// RateLimitStatus 限速规则的状态
+type RateLimitStatus struct {
+	Scope     string  `json:"scope"`
+	Name      string  `json:"name"`
+	Direction string  `json:"direction"`
+	Rate      int64   `json:"rate"`
+	Waiting   int     `json:"waiting"` // 正在等待的 link 数量，大于 0 表示正在限速
+	Throttled float64 `json:"throttled_seconds"`
+}
+
+// RateLimitStatus 所有限速规则的状态
+func (s *Server) RateLimitStatus() []RateLimitStatus {
+	statuses := make([]RateLimitStatus, 0)
+	for _, bucket := range s.limits.ordered {
+		statuses = append(statuses, bucket.status("upload", bucket.upload), bucket.status("download", bucket.download))
+	}
+
+	return statuses
+}
+
+func (bucket *rateLimitBucket) status(direction string, tb *common.TokenBucket) RateLimitStatus {
+	return RateLimitStatus{
+		Scope:     bucket.scope,
+		Name:      bucket.name,
+		Direction: direction,
+		Rate:      tb.Rate(),
+		Waiting:   tb.Waiting(),
+		Throttled: tb.Throttled().Seconds(),
+	}
+}
+
+var (
+	rateLimitWaitingDesc = prometheus.NewDesc(
+		"secure_tunnel_rate_limit_waiting",
+		"Number of links waiting for the rate limit",
+		[]string{"scope", "name", "direction"}, nil,
+	)
+	rateLimitThrottledDesc = prometheus.NewDesc(
+		"secure_tunnel_rate_limit_throttled_seconds_total",
+		"Total time links spent waiting for the rate limit",
+		[]string{"scope", "name", "direction"}, nil,
+	)
+	rateLimitRateDesc = prometheus.NewDesc(
+		"secure_tunnel_rate_limit_bytes_per_second",
+		"Configured rate of the rate limit",
+		[]string{"scope", "name", "direction"}, nil,
+	)
+)
+
+// rateLimitCollector 在采集时读取限速规则的状态
+type rateLimitCollector struct {
+	server *Server
+}
+
+func (c rateLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rateLimitWaitingDesc
+	ch <- rateLimitThrottledDesc
+	ch <- rateLimitRateDesc
+}
+
+func (c rateLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, st := range c.server.RateLimitStatus() {
+		ch <- prometheus.MustNewConstMetric(rateLimitWaitingDesc, prometheus.GaugeValue, float64(st.Waiting), st.Scope, st.Name, st.Direction)
+		ch <- prometheus.MustNewConstMetric(rateLimitThrottledDesc, prometheus.CounterValue, st.Throttled, st.Scope, st.Name, st.Direction)
+		ch <- prometheus.MustNewConstMetric(rateLimitRateDesc, prometheus.GaugeValue, float64(st.Rate), st.Scope, st.Name, st.Direction)
+	}
+}
+
+// throttledSeconds 隧道因限速等待的累计时间
+func throttledSeconds(throttled *int64) float64 {
+	return time.Duration(atomic.LoadInt64(throttled)).Seconds()
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errReplayed        = errors.New("replayed handshake")
+	errReplayCacheFull = errors.New("too many handshakes in progress, replay cache is full")
+)
+
+type replayEntry struct {
+	key       string
+	expiredAt time.Time
+}
+
+// replayCache 记录有效期内已使用过的握手随机数，容量有限，未过期的记录超出容量时拒绝新的握手
+type replayCache struct {
+	lock     sync.Mutex
+	ttl      time.Duration
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func newReplayCache(ttl time.Duration, capacity int) *replayCache {
+	return &replayCache{
+		ttl:      ttl,
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Add 记录 key，key 已经使用过或者缓存中全部是未过期的记录时返回错误
+// 只淘汰已过期的记录，未过期的记录被淘汰后对应的握手消息可以被重放
+func (c *replayCache) Add(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*replayEntry)
+		if entry.expiredAt.After(now) {
+			break
+		}
+
+		c.order.Remove(front)
+		delete(c.entries, entry.key)
+	}
+
+	if _, ok := c.entries[key]; ok {
+		return errReplayed
+	}
+
+	if c.order.Len() >= c.capacity {
+		return errReplayCacheFull
+	}
+
+	c.entries[key] = c.order.PushBack(&replayEntry{key: key, expiredAt: now.Add(c.ttl)})
+	return nil
+}
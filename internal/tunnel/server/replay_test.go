@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	c := newReplayCache(time.Hour, 2)
+
+	if err := c.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Add("a"); err != errReplayed {
+		t.Fatalf("replayed key should be rejected, got %v", err)
+	}
+
+	if err := c.Add("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 缓存已满且记录均未过期，不能淘汰已有记录
+	if err := c.Add("c"); err != errReplayCacheFull {
+		t.Fatalf("new key should be rejected when cache is full, got %v", err)
+	}
+
+	if err := c.Add("a"); err != errReplayed {
+		t.Fatalf("unexpired key should not be evicted, got %v", err)
+	}
+
+	expired := newReplayCache(time.Millisecond, 1)
+	if err := expired.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if err := expired.Add("b"); err != nil {
+		t.Fatalf("expired entries should be evicted, got %v", err)
+	}
+}
@@ -2,31 +2,75 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/x509"
 	"fmt"
 	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
 	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/glacier"
 	"github.com/mylxsw/glacier/infra"
 	"github.com/mylxsw/secure-tunnel/internal/auth"
 	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/policy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go"
 )
 
 type Server struct {
 	listener        net.Listener
+	quicListener    *quic.Listener // 未启用 QUIC 时为 nil
 	backends        map[string]*Backend
 	secret          string
+	ciphers         []common.CipherSuite
+	compressions    []common.Compression // 所有后端都允许的压缩算法，用于多路复用的隧道
+	tlsConf         config.ServerTLS
+	clientCAs       *x509.CertPool // 校验客户端证书的 CA，未配置 tls.client_ca 时为 nil
+	hostKey         ed25519.PrivateKey
+	replays         *replayCache
+	timeouts        hubTimeouts
+	limits          *rateLimits
+	policy          *policy.Policy // 未配置访问策略时为 nil
+	grants          *grantStore
+	audit           *auditLog
 	connections     map[string]*connInfo
 	connectionsLock sync.RWMutex
+
+	drainOnce sync.Once
+	draining  chan struct{} // 开始排空隧道后关闭
 }
 
 type Backend struct {
-	Addr    *net.TCPAddr
-	Backend config.BackendServer
+	Addr         *net.TCPAddr
+	UDPAddr      *net.UDPAddr  // 协议为 udp 的后端地址
+	UnixAddr     *net.UnixAddr // 地址为 unix:/path 的后端地址
+	Backend      config.BackendServer
+	Compressions []common.Compression
+	Priority     hub.Priority
+}
+
+// Allowed 用户是否可以访问该后端
+func (b *Backend) Allowed(user *auth.AuthedUser) bool {
+	return b.Backend.Allowed(user.Account, user.Groups)
+}
+
+// allowedBackends 用户可以访问的所有后端名称
+func (s *Server) allowedBackends(user *auth.AuthedUser) []string {
+	names := make([]string, 0, len(s.backends))
+	for name, backend := range s.backends {
+		if backend.Allowed(user) && user.InScope(name) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
 }
 
 type ConnStatus struct {
@@ -38,6 +82,17 @@ type ConnStatus struct {
 	ReadBytes  int64            `json:"read_bytes"`
 	WriteBytes int64            `json:"write_bytes"`
 	CreatedAt  time.Time        `json:"created_at"`
+
+	// Compression 压缩算法，CompressionRatio 为压缩前的数据量与实际传输的数据量之比
+	Compression      string  `json:"compression"`
+	CompressionRatio float64 `json:"compression_ratio"`
+
+	// LastHeartbeat 最后一次收到客户端心跳的时间，RTT 为最近一次测量的往返时间（毫秒），客户端不支持测量时为 0
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	RTT           float64   `json:"rtt_ms"`
+
+	// Throttled 隧道上的 link 因限速等待的累计时间（秒）
+	Throttled float64 `json:"throttled_seconds"`
 }
 
 type connInfo struct {
@@ -48,31 +103,138 @@ type connInfo struct {
 	createdAt  time.Time
 	user       *auth.AuthedUser
 	backend    string
+	tun        *hub.Tunnel
+	hub        *Hub
 }
 
 // NewServer create a tunnel server
-func NewServer(listen string, backends []config.BackendServer, secret string) (*Server, error) {
-	ln, err := newTCPListener(listen)
+func NewServer(conf *config.Server) (*Server, error) {
+	ciphers, err := common.ParseCipherSuites(conf.Ciphers)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKey, err := common.LoadOrCreateHostKey(conf.HostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("server host key fingerprint: %s", common.Fingerprint(hostKey.Public().(ed25519.PublicKey)))
+
+	var clientCAs *x509.CertPool
+	if conf.TLS.ClientCA != "" {
+		if clientCAs, err = common.LoadCertPool(conf.TLS.ClientCA); err != nil {
+			return nil, err
+		}
+	}
+
+	var ln net.Listener
+	if conf.TLS.Enabled() {
+		tlsConf, err := buildTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+
+		ln, err = newTLSListener(conf.Listen, tlsConf)
+	} else {
+		ln, err = newTCPListener(conf.Listen)
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
+	var quicLn *quic.Listener
+	if conf.QUICListen != "" {
+		if quicLn, err = newQUICListener(conf.QUICListen, conf.TLS, hostKey); err != nil {
+			_ = ln.Close()
+			return nil, fmt.Errorf("listen quic on %s failed: %v", conf.QUICListen, err)
+		}
+	}
+
 	backendAddrs := make(map[string]*Backend)
-	for _, backend := range backends {
-		addr, err := net.ResolveTCPAddr("tcp", backend.Addr)
+	var allCompressions []common.Compression
+	for i, backend := range conf.Backends {
+		b := &Backend{Backend: backend}
+		if path, ok := config.UnixSocketPath(backend.Addr); ok {
+			b.UnixAddr, err = net.ResolveUnixAddr("unix", path)
+		} else if backend.Protocol == "udp" {
+			b.UDPAddr, err = net.ResolveUDPAddr("udp", backend.Addr)
+		} else {
+			b.Addr, err = net.ResolveTCPAddr("tcp", backend.Addr)
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		backendAddrs[backend.Name] = &Backend{Addr: addr, Backend: backend}
+		compressions, err := common.ParseCompressions(backend.Compression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compression for backend %s: %v", backend.Name, err)
+		}
+
+		b.Compressions = compressions
+		if b.Priority, err = hub.ParsePriority(backend.Priority); err != nil {
+			return nil, err
+		}
+
+		backendAddrs[backend.Name] = b
+		if i == 0 {
+			allCompressions = compressions
+			continue
+		}
+
+		shared := make([]common.Compression, 0, len(allCompressions))
+		for _, c := range allCompressions {
+			if common.ContainsCompression(compressions, c) {
+				shared = append(shared, c)
+			}
+		}
+		allCompressions = shared
+	}
+
+	limits, err := newRateLimits(conf.Backends, conf.Users.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	var accessPolicy *policy.Policy
+	if conf.PolicyFile != "" {
+		if accessPolicy, err = policy.LoadFile(conf.PolicyFile); err != nil {
+			return nil, err
+		}
+		log.Infof("access policy loaded from %s, %d rules", conf.PolicyFile, len(accessPolicy.Rules))
+	}
+
+	grants, err := loadGrantStore(conf.GrantStore)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{
+		listener:     ln,
+		quicListener: quicLn,
+		backends:     backendAddrs,
+		secret:       conf.Secret,
+		ciphers:      ciphers,
+		compressions: allCompressions,
+		tlsConf:      conf.TLS,
+		clientCAs:    clientCAs,
+		hostKey:      hostKey,
+		replays:      newReplayCache(common.MaxTokenAge, 100000),
+		timeouts:     hubTimeouts{heartbeat: conf.HeartbeatTimeout, idle: conf.IdleTimeout},
+		limits:       limits,
+		policy:       accessPolicy,
+		grants:       grants,
+		audit:        newAuditLog(conf.AuditLog),
+		connections:  make(map[string]*connInfo),
+		draining:     make(chan struct{}),
 	}
 
-	return &Server{
-		listener:    ln,
-		backends:    backendAddrs,
-		secret:      secret,
-		connections: make(map[string]*connInfo),
-	}, nil
+	if err := prometheus.Register(rateLimitCollector{server: srv}); err != nil {
+		log.Warningf("register rate limit metrics failed: %v", err)
+	}
+
+	return srv, nil
 }
 
 // Read reads data from the connection.
@@ -97,6 +259,12 @@ func (s *Server) handleConnection(conn *connInfo, author auth.Author) {
 	defer func() { _ = conn.Close() }()
 	defer common.ErrorHandler()
 
+	clientCert, err := tlsHandshake(conn.Conn)
+	if err != nil {
+		log.Errorf("tls handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
 	tun := hub.NewTunnel(conn)
 	// authenticate connection
 	a := common.NewEncryptAlgorithm(s.secret)
@@ -108,81 +276,128 @@ func (s *Server) handleConnection(conn *connInfo, author auth.Author) {
 		return
 	}
 
-	_, token, err := tun.ReadPacket()
+	_, hello, err := tun.ReadPacket()
 	if err != nil {
 		log.Errorf("read token failed(%v):%s", tun, err)
 		return
 	}
 
-	if !a.VerifyCipherBlock(token) {
+	if len(hello) < common.TaaBlockSize || !a.VerifyCipherBlock(hello[:common.TaaBlockSize]) {
 		log.Errorf("verify token failed(%v)", tun)
 		return
 	}
 
-	tun.SetCipherKey(a.GetRc4key())
-
-	_, clientInfoPacket, err := tun.ReadPacket()
+	legacy, err := s.negotiateSession(tun, a, challenge, hello)
 	if err != nil {
-		log.Errorf("read client info failed(%v): %v", tun, err)
-		_ = tun.WritePacket(0, []byte(fmt.Sprintf("error: read client info failed: %v", err)))
+		log.Errorf("negotiate session failed(%v): %v", tun, err)
 		return
 	}
 
-	if err := tun.WritePacket(0, []byte("ok")); err != nil {
-		log.Errorf("write client info exchange response packet to client failed: %v", err)
-		return
+	// QUIC 连接需要在握手消息中交换通道绑定值，旧版本协议不支持
+	quicConn, isQUIC := conn.Conn.(*common.QUICConn)
+	var binding []byte
+	if isQUIC {
+		if legacy {
+			log.Errorf("handshake failed(%v): legacy protocol is not supported over quic", tun)
+			return
+		}
+
+		if binding, err = quicConn.ChannelBinding(); err != nil {
+			log.Errorf("export channel binding failed(%v): %v", tun, err)
+			return
+		}
 	}
 
-	// 客户端身份认证
-	_, authPacket, err := tun.ReadPacket()
-	if err != nil {
-		log.Errorf("read username & password failed(%v):%v", tun, err)
-		return
+	var result *handshakeResult
+	if legacy {
+		result, err = s.legacyHandshake(tun, author, clientCert, conn.RemoteAddr().String())
+	} else {
+		result, err = s.handshake(tun, author, clientCert, binding, conn.RemoteAddr().String())
 	}
 
-	username, password, backend := common.ParseAuthPacket(authPacket)
-	authedUser, err := author.Login(username, password)
 	if err != nil {
-		log.Errorf("invalid password for user %s", username)
-		_ = tun.WritePacket(0, []byte(fmt.Sprintf("error: invalid password for user %s: %v", username, err)))
+		log.Errorf("handshake failed(%v): %v", tun, err)
 		return
 	}
 
-	if err := tun.WritePacket(0, []byte("ok")); err != nil {
-		log.Errorf("write authed packet to client failed: %v", err)
+	conn.user = result.user
+	conn.backend = "*"
+	if result.backend != nil {
+		conn.backend = result.backend.Backend.Name
+	}
+
+	if result.version >= common.WideFrameVersion {
+		tun.EnableWideFrames()
+	}
+
+	if err := tun.SetCompression(result.compression); err != nil {
+		log.Errorf("enable compression failed(%v): %v", tun, err)
 		return
 	}
 
-	if bak, ok := s.backends[backend]; ok {
-		conn.user = authedUser
-		conn.backend = backend
+	// 切换网络期间 QUIC 连接保持可用，客户端的心跳超时与 QUIC 连接的空闲超时一致
+	timeouts := s.timeouts
+	if isQUIC && timeouts.heartbeat < common.QUICIdleTimeout {
+		timeouts.heartbeat = common.QUICIdleTimeout
+	}
+
+	h := newHub(tun, s.backends, result.backend, result.user, result.capabilities, timeouts, s.limits)
+	access := result.access()
+	h.authorize = func(backend *Backend) AccessResult { return s.authorize(access, backend) }
+	conn.tun = tun
+	conn.hub = h
+
+	s.connectionsLock.Lock()
+	s.connections[conn.id] = conn
+	s.connectionsLock.Unlock()
 
+	defer func() {
 		s.connectionsLock.Lock()
-		s.connections[conn.id] = conn
+		delete(s.connections, conn.id)
 		s.connectionsLock.Unlock()
+	}()
 
-		defer func() {
-			s.connectionsLock.Lock()
-			delete(s.connections, conn.id)
-			s.connectionsLock.Unlock()
-		}()
-
-		log.WithFields(log.Fields{
-			"client":      common.DecodeSystemInfo(clientInfoPacket),
-			"user":        authedUser,
-			"backend":     bak,
-			"conn_id":     conn.id,
-			"remote_addr": conn.RemoteAddr().String(),
-		}).Infof("user %s connected from %s", authedUser.Account, conn.RemoteAddr().String())
+	// 排空开始之后才完成握手的隧道同样需要通知客户端
+	if s.isDraining() {
+		h.SendGoAway()
+	}
 
-		newHub(tun, bak, authedUser).Start()
+	log.WithFields(log.Fields{
+		"client":      result.client,
+		"user":        result.user,
+		"backend":     result.backend,
+		"version":     result.version,
+		"compression": result.compression.String(),
+		"conn_id":     conn.id,
+		"remote_addr": conn.RemoteAddr().String(),
+	}).Infof("user %s connected from %s", result.user.Account, conn.RemoteAddr().String())
+
+	if isQUIC {
+		go h.acceptStreams(quicConn)
 	}
+
+	h.Start()
 }
 
 func (s *Server) Start(ctx context.Context, resolver infra.Resolver) error {
-	return resolver.ResolveWithError(func(author auth.Author) error {
+	return resolver.ResolveWithError(func(author auth.Author, gf infra.Graceful, gconf *glacier.Config) error {
 		defer func() { _ = s.listener.Close() }()
 
+		// 停机时先排空隧道再关闭监听，为关闭处理留出一秒的余量
+		gf.AddShutdownHandler(func() {
+			s.Drain(drainTimeout(gconf.ShutdownTimeout))
+			_ = s.listener.Close()
+			if s.quicListener != nil {
+				_ = s.quicListener.Close()
+			}
+		})
+
+		if s.quicListener != nil {
+			go s.serveQUIC(ctx, author)
+		}
+
+		go s.expireGrants(ctx.Done())
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -190,6 +405,10 @@ func (s *Server) Start(ctx context.Context, resolver infra.Resolver) error {
 			default:
 				conn, err := s.listener.Accept()
 				if err != nil {
+					if s.isDraining() {
+						return nil
+					}
+
 					if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 						log.Warningf("accept failed temporary: %s", netErr.Error())
 						continue
@@ -197,33 +416,81 @@ func (s *Server) Start(ctx context.Context, resolver infra.Resolver) error {
 						return err
 					}
 				}
-				cinfo := connInfo{
-					Conn:      conn,
-					id:        fmt.Sprintf("%s-%s", conn.LocalAddr().String(), conn.RemoteAddr().String()),
-					createdAt: time.Now(),
-				}
-				log.With(cinfo).Debugf("new connection from %v", conn.RemoteAddr())
-				go s.handleConnection(&cinfo, author)
+				go s.ServeConn(conn, author)
 			}
 		}
 	})
 }
 
+// drainTimeout 排空隧道的最长时间，需要在停机超时之前结束
+func drainTimeout(shutdownTimeout time.Duration) time.Duration {
+	if shutdownTimeout <= 2*time.Second {
+		return shutdownTimeout / 2
+	}
+
+	return shutdownTimeout - time.Second
+}
+
+// ServeConn 处理已建立的隧道连接，阻塞直到连接关闭，用于隧道端口之外的传输方式（如 WebSocket、QUIC）
+func (s *Server) ServeConn(conn net.Conn, author auth.Author) {
+	if s.isDraining() {
+		log.Debugf("server is draining, reject connection from %v", conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+
+	cinfo := connInfo{
+		Conn:      conn,
+		id:        fmt.Sprintf("%s-%s", conn.LocalAddr().String(), conn.RemoteAddr().String()),
+		createdAt: time.Now(),
+	}
+	log.With(cinfo).Debugf("new connection from %v", conn.RemoteAddr())
+	s.handleConnection(&cinfo, author)
+}
+
+// TerminateToken 令牌撤销后断开使用该令牌登录的隧道
+func (s *Server) TerminateToken(actor *auth.AuthedUser, tokenID string) {
+	s.connectionsLock.RLock()
+	conns := make([]*connInfo, 0)
+	for _, conn := range s.connections {
+		if conn.user != nil && conn.user.TokenID == tokenID {
+			conns = append(conns, conn)
+		}
+	}
+	s.connectionsLock.RUnlock()
+
+	for _, conn := range conns {
+		conn.hub.Close()
+		s.audit.record(AuditEvent{
+			Event:   AuditTunnelClosed,
+			Account: conn.user.Account,
+			Actor:   actor.Account,
+			Reason:  fmt.Sprintf("token %s revoked, tunnel %s closed", tokenID, conn.id),
+		})
+	}
+}
+
 func (s *Server) Status() []ConnStatus {
 	s.connectionsLock.RLock()
 	defer s.connectionsLock.RUnlock()
 
 	statuses := make([]ConnStatus, 0)
 	for _, conn := range s.connections {
+		compression := conn.tun.CompressionStats()
 		statuses = append(statuses, ConnStatus{
-			ID:         conn.id,
-			LocalAddr:  conn.Conn.LocalAddr().String(),
-			RemoteAddr: conn.Conn.RemoteAddr().String(),
-			User:       conn.user,
-			Backend:    conn.backend,
-			ReadBytes:  conn.readBytes,
-			WriteBytes: conn.writeBytes,
-			CreatedAt:  conn.createdAt,
+			ID:               conn.id,
+			LocalAddr:        conn.Conn.LocalAddr().String(),
+			RemoteAddr:       conn.Conn.RemoteAddr().String(),
+			User:             conn.user,
+			Backend:          conn.backend,
+			ReadBytes:        atomic.LoadInt64(&conn.readBytes),
+			WriteBytes:       atomic.LoadInt64(&conn.writeBytes),
+			CreatedAt:        conn.createdAt,
+			Compression:      compression.Compression.String(),
+			CompressionRatio: compression.Ratio(),
+			LastHeartbeat:    conn.hub.LastHeartbeat(),
+			RTT:              float64(conn.hub.RTT()) / float64(time.Millisecond),
+			Throttled:        throttledSeconds(&conn.hub.throttled),
 		})
 	}
 
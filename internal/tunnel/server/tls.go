@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+)
+
+// buildTLSConfig 根据配置创建服务端 TLS 配置
+func buildTLSConfig(conf config.ServerTLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load tls certificate failed: %v", err)
+	}
+
+	minVersion, err := common.ParseTLSVersion(conf.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		ClientAuth:   tls.NoClientCert,
+	}
+
+	if conf.ClientCA != "" {
+		pool, err := common.LoadCertPool(conf.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+		if conf.RequireClientCert || conf.CertAuth {
+			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConf, nil
+}
+
+// certConn 在建立隧道之前已经校验过客户端证书的连接，如 WebSocket 连接
+type certConn struct {
+	net.Conn
+	cert *x509.Certificate // 未提供证书时为 nil
+}
+
+// tlsHandshake 对 TLS 连接完成握手，返回经过校验的客户端证书，非 TLS 连接或未提供证书时返回 nil
+// QUIC 连接在建立时已经完成 TLS 握手
+func tlsHandshake(conn net.Conn) (*x509.Certificate, error) {
+	if quicConn, ok := conn.(*common.QUICConn); ok {
+		return verifiedPeerCert(quicConn.ConnectionState()), nil
+	}
+
+	if cc, ok := conn.(*certConn); ok {
+		return cc.cert, nil
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+
+	_ = tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer func() { _ = tlsConn.SetDeadline(time.Time{}) }()
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return verifiedPeerCert(tlsConn.ConnectionState()), nil
+}
+
+// verifiedPeerCert 经过校验的客户端证书，未提供证书时返回 nil
+func verifiedPeerCert(state tls.ConnectionState) *x509.Certificate {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return state.PeerCertificates[0]
+}
+
+// verifyClientCert 使用 tls.client_ca 校验隧道端口之外（如 WebSocket）的 TLS 连接中的客户端证书，未提供证书时返回 nil
+// 要求客户端证书或使用证书登录时，未提供有效的证书返回错误
+func (s *Server) verifyClientCert(state *tls.ConnectionState) (*x509.Certificate, error) {
+	required := s.tlsConf.RequireClientCert || s.tlsConf.CertAuth
+	if s.clientCAs == nil || state == nil || len(state.PeerCertificates) == 0 {
+		if required {
+			return nil, errors.New("client certificate is required")
+		}
+
+		return nil, nil
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         s.clientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := state.PeerCertificates[0].Verify(opts); err != nil {
+		return nil, fmt.Errorf("verify client certificate failed: %v", err)
+	}
+
+	return state.PeerCertificates[0], nil
+}
+
+// certIdentity 从客户端证书中提取账号
+func certIdentity(cert *x509.Certificate, field string) string {
+	switch field {
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
+
+// certLogin 使用客户端证书身份登录，账号在用户系统中存在时使用其用户信息
+// 否则只有开启了 cert_groups 时才使用证书中的 OU 作为用户组
+func certLogin(author auth.Author, cert *x509.Certificate, conf config.ServerTLS) (*auth.AuthedUser, error) {
+	account := certIdentity(cert, conf.CertUserField)
+	if account == "" {
+		return nil, fmt.Errorf("no %s in client certificate", conf.CertUserField)
+	}
+
+	if user, err := author.GetUser(account); err == nil {
+		return user, nil
+	}
+
+	user := &auth.AuthedUser{
+		Type:    "cert",
+		UUID:    fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s-%s-%s", account, cert.Subject.CommonName, "cert")))),
+		Name:    cert.Subject.CommonName,
+		Account: account,
+		Status:  1,
+	}
+	if conf.CertGroups {
+		user.Groups = cert.Subject.OrganizationalUnit
+	}
+
+	return user, nil
+}
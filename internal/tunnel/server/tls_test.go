@@ -0,0 +1,289 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+// testCA 测试用的 CA，签发服务端和客户端证书
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	file string // CA 证书的 PEM 文件
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{cert: cert, key: key, pool: x509.NewCertPool(), file: filepath.Join(t.TempDir(), name+".crt")}
+	ca.pool.AddCert(cert)
+	writePEM(t, ca.file, "CERTIFICATE", der)
+
+	return ca
+}
+
+// issue 签发证书，client 为 true 时签发客户端证书，否则签发 127.0.0.1 的服务端证书
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, client bool) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		tmpl.IPAddresses = nil
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// serverTLS 签发服务端证书并写入文件，返回服务端 TLS 配置
+func (ca *testCA) serverTLS(t *testing.T) config.ServerTLS {
+	t.Helper()
+
+	cert := ca.issue(t, pkix.Name{CommonName: "127.0.0.1"}, false)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	conf := config.ServerTLS{Cert: filepath.Join(dir, "server.crt"), Key: filepath.Join(dir, "server.key"), CertUserField: "cn"}
+	writePEM(t, conf.Cert, "CERTIFICATE", cert.Certificate[0])
+	writePEM(t, conf.Key, "EC PRIVATE KEY", keyDER)
+
+	return conf
+}
+
+func writePEM(t *testing.T, path string, typ string, der []byte) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsConnect 使用 buildTLSConfig 创建的配置在本地建立 TLS 连接，返回服务端 tlsHandshake 的结果
+func tlsConnect(t *testing.T, conf config.ServerTLS, ca *testCA, clientCert *tls.Certificate) (*x509.Certificate, error) {
+	t.Helper()
+
+	tlsConf, err := buildTLSConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := newTLSListener("127.0.0.1:0", tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	type result struct {
+		cert *x509.Certificate
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		cert, err := tlsHandshake(conn)
+		results <- result{cert: cert, err: err}
+	}()
+
+	clientConf := &tls.Config{RootCAs: ca.pool, ServerName: "127.0.0.1"}
+	if clientCert != nil {
+		clientConf.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConf)
+	if err == nil {
+		// TLS 1.3 中服务端在客户端完成握手之后才校验客户端证书，需要读取一次才能得到结果
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _ = conn.Read(make([]byte, 1))
+		_ = conn.Close()
+	}
+
+	res := <-results
+	return res.cert, res.err
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	conf := ca.serverTLS(t)
+
+	for _, tc := range []struct {
+		name       string
+		clientCA   string
+		require    bool
+		certAuth   bool
+		clientAuth tls.ClientAuthType
+	}{
+		{name: "tls", clientAuth: tls.NoClientCert},
+		{name: "optional", clientCA: ca.file, clientAuth: tls.VerifyClientCertIfGiven},
+		{name: "require", clientCA: ca.file, require: true, clientAuth: tls.RequireAndVerifyClientCert},
+		{name: "cert auth", clientCA: ca.file, certAuth: true, clientAuth: tls.RequireAndVerifyClientCert},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := conf
+			c.ClientCA, c.RequireClientCert, c.CertAuth = tc.clientCA, tc.require, tc.certAuth
+
+			tlsConf, err := buildTLSConfig(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tlsConf.ClientAuth != tc.clientAuth {
+				t.Fatalf("unexpected client auth: %v", tlsConf.ClientAuth)
+			}
+		})
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	other := newTestCA(t, "other")
+	conf := ca.serverTLS(t)
+
+	clientCert := ca.issue(t, pkix.Name{CommonName: "alice"}, true)
+	untrusted := other.issue(t, pkix.Name{CommonName: "mallory"}, true)
+
+	t.Run("tls", func(t *testing.T) {
+		cert, err := tlsConnect(t, conf, ca, &clientCert)
+		if err != nil || cert != nil {
+			t.Fatalf("client certificate should be ignored without client_ca: %v, %v", cert, err)
+		}
+	})
+
+	mtls := conf
+	mtls.ClientCA, mtls.RequireClientCert = ca.file, true
+
+	t.Run("mtls", func(t *testing.T) {
+		cert, err := tlsConnect(t, mtls, ca, &clientCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cert == nil || cert.Subject.CommonName != "alice" {
+			t.Fatalf("unexpected client certificate: %v", cert)
+		}
+	})
+
+	t.Run("mtls without certificate", func(t *testing.T) {
+		if _, err := tlsConnect(t, mtls, ca, nil); err == nil {
+			t.Fatal("client without certificate should be rejected")
+		}
+	})
+
+	t.Run("mtls untrusted certificate", func(t *testing.T) {
+		if _, err := tlsConnect(t, mtls, ca, &untrusted); err == nil {
+			t.Fatal("client certificate from untrusted ca should be rejected")
+		}
+	})
+}
+
+func TestCertLogin(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	author := testAuthor{"alice": {Account: "alice", Groups: []string{"dba"}}}
+	conf := config.ServerTLS{CertUserField: "cn"}
+
+	// 用户系统中存在的账号使用其用户信息，证书中的 OU 不生效
+	alice := ca.issue(t, pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"admin"}}, true)
+	user, err := certLogin(author, alice.Leaf, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Account != "alice" || len(user.Groups) != 1 || user.Groups[0] != "dba" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	// 未开启 cert_groups 时，证书中的 OU 不能作为用户组
+	bob := ca.issue(t, pkix.Name{CommonName: "bob", OrganizationalUnit: []string{"admin"}}, true)
+	if user, err = certLogin(author, bob.Leaf, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Account != "bob" || user.Type != "cert" || len(user.Groups) != 0 {
+		t.Fatalf("certificate ou should not be used as groups by default: %+v", user)
+	}
+
+	conf.CertGroups = true
+	if user, err = certLogin(author, bob.Leaf, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(user.Groups) != 1 || user.Groups[0] != "admin" {
+		t.Fatalf("certificate ou should be used as groups with cert_groups: %+v", user)
+	}
+
+	// 证书中没有作为账号的字段时登录失败
+	conf.CertUserField = "email"
+	if _, err := certLogin(author, bob.Leaf, conf); err == nil {
+		t.Fatal("certificate without email should be rejected")
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/secure-tunnel/internal/auth"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/common"
+	"github.com/mylxsw/secure-tunnel/internal/tunnel/hub"
+)
+
+// WebSocketHandler 将 HTTP 请求升级为 WebSocket 连接，之后与隧道端口使用相同的客户端证书校验和握手流程
+func (s *Server) WebSocketHandler(author auth.Author) http.Handler {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  hub.PacketSize,
+		WriteBufferSize: hub.PacketSize,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 与隧道端口使用相同的客户端证书要求，WebSocket 请求需要在 TLS 连接中直接提供证书
+		clientCert, err := s.verifyClientCert(r.TLS)
+		if err != nil {
+			log.Errorf("websocket connection from %s rejected: %v", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Errorf("websocket upgrade from %s failed: %v", r.RemoteAddr, err)
+			return
+		}
+
+		s.ServeConn(&certConn{Conn: common.NewWebSocketConn(ws), cert: clientCert}, author)
+	})
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mylxsw/secure-tunnel/internal/config"
+)
+
+// dialWebSocket 连接 WebSocket 隧道入口，返回升级失败时的 HTTP 状态码
+func dialWebSocket(t *testing.T, url string, clientCert *tls.Certificate) (*websocket.Conn, int) {
+	t.Helper()
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 3 * time.Second,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
+	}
+	if clientCert != nil {
+		dialer.TLSClientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	ws, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return nil, resp.StatusCode
+	}
+
+	t.Cleanup(func() { _ = ws.Close() })
+	return ws, http.StatusSwitchingProtocols
+}
+
+func TestWebSocketClientCert(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	other := newTestCA(t, "other")
+	clientCert := ca.issue(t, pkix.Name{CommonName: "alice"}, true)
+	untrusted := other.issue(t, pkix.Name{CommonName: "mallory"}, true)
+
+	s := &Server{
+		tlsConf:     config.ServerTLS{ClientCA: ca.file, RequireClientCert: true, CertUserField: "cn"},
+		clientCAs:   ca.pool,
+		connections: make(map[string]*connInfo),
+		draining:    make(chan struct{}),
+	}
+	handler := s.WebSocketHandler(testAuthor{})
+
+	t.Run("plain http", func(t *testing.T) {
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+
+		if _, status := dialWebSocket(t, "ws"+strings.TrimPrefix(srv.URL, "http"), nil); status != http.StatusForbidden {
+			t.Fatalf("websocket without client certificate should be rejected, got status %d", status)
+		}
+	})
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	url := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	t.Run("no certificate", func(t *testing.T) {
+		if _, status := dialWebSocket(t, url, nil); status != http.StatusForbidden {
+			t.Fatalf("websocket without client certificate should be rejected, got status %d", status)
+		}
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		if _, status := dialWebSocket(t, url, &untrusted); status != http.StatusForbidden {
+			t.Fatalf("websocket with untrusted client certificate should be rejected, got status %d", status)
+		}
+	})
+
+	t.Run("trusted certificate", func(t *testing.T) {
+		ws, status := dialWebSocket(t, url, &clientCert)
+		if status != http.StatusSwitchingProtocols {
+			t.Fatalf("websocket with trusted client certificate should be accepted, got status %d", status)
+		}
+
+		// 升级成功后服务端开始隧道握手，首先发送 challenge
+		_ = ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if typ, _, err := ws.ReadMessage(); err != nil || typ != websocket.BinaryMessage {
+			t.Fatalf("read challenge failed: %v", err)
+		}
+	})
+}